@@ -1,5 +1,15 @@
 package config
 
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/withz/ptun/pkg/firewall"
+)
+
 func InitClient() (err error) {
 	return InitClientPath("ptun-node1.toml")
 }
@@ -21,6 +31,45 @@ type client struct {
 
 	ServerHost string
 	ServerPort int
+	// Hubs are the host:port of federated hubs, tried in order when ServerHost fails
+	Hubs []string
+	// Network is the id of virtual network on hub, the default network when empty
+	Network string
+	// Key is the path of node identity key, generated by `node keygen`
+	Key string
+	// Control is the unix socket of local control api, queried by `node status` and `node peers`
+	Control string
+	// Metrics is the listen address of prometheus metrics, disabled when empty
+	Metrics string
+	// Codec is preferred for messages with hub, json is the fallback
+	Codec CodecType
+
+	TLS struct {
+		// Enable logins hub over tls at ServerPort
+		Enable bool
+		// ServerName is verified against hub certificate, the host of each hub when empty
+		ServerName string
+		// CA is the pem file of trusted roots, system roots are used when empty
+		CA string
+		// Pins are the public key pins of hub certificate, printed by `hub pin`
+		Pins []string
+	} `toml:"TLS"`
+
+	WebSocket struct {
+		// Enable logins hub over websocket at ServerPort, wss when TLS is enabled
+		Enable bool
+		// Path is the http path of websocket, "/ptun" when empty
+		Path string
+		// Proxy is the url of http proxy, HTTPS_PROXY or HTTP_PROXY of environment when empty
+		Proxy string
+	} `toml:"WebSocket"`
+
+	Firewall struct {
+		// Enable denies the packets from peers unless they reply to connections of this node or Rules allow them
+		Enable bool
+		// Rules allow inbound packets like "node1:22/tcp", "*:80,443" or "*/icmp"
+		Rules []string
+	} `toml:"Firewall"`
 
 	Stun struct {
 		Type          StunServerType
@@ -30,8 +79,28 @@ type client struct {
 	} `toml:"Stun"`
 
 	Net struct {
-		Tun       string
-		IP        string
+		Tun        string
+		IP         string
+		Encryption EncryptionType
+		Transport  TransportType
+		// Kcp tuning takes the default when a field is not set, zero is a value like NoDelay = 0.
+		// DataShards and ParityShards are negotiated with peers, kcp is used only with the same ones
+		Kcp struct {
+			NoDelay      *int
+			Interval     *int
+			Resend       *int
+			NoCongestion *int
+			SndWnd       *int
+			RcvWnd       *int
+			Mtu          *int
+			DataShards   *int
+			ParityShards *int
+		} `toml:"Kcp"`
+		Quic struct {
+			// IdleTimeout and KeepAlivePeriod are in seconds
+			IdleTimeout     int
+			KeepAlivePeriod int
+		} `toml:"Quic"`
 		AllowNets []string
 		Routers   []struct {
 			Next     string
@@ -42,6 +111,51 @@ type client struct {
 
 var c client
 
+const defaultControlSocket = "/var/run/ptun-node.sock"
+
+var (
+	errInvalidHubAddress = errors.New("invalid hub address, need host:port")
+	errInvalidName       = errors.New("name and network cannot contain /")
+	errInvalidKcpShards  = errors.New("kcp shards cannot be negative")
+)
+
 func checkClientConfig() (err error) {
+	if strings.Contains(c.Name, "/") || strings.Contains(c.Network, "/") {
+		return errInvalidName
+	}
+	if c.Control == "" {
+		c.Control = defaultControlSocket
+	}
+	if err = validateStunServerType(c.Stun.Type); err != nil {
+		return err
+	}
+	if err = validateEncryptionType(c.Net.Encryption); err != nil {
+		return err
+	}
+	if err = validateTransportType(c.Net.Transport); err != nil {
+		return err
+	}
+	if err = validateCodecType(c.Codec); err != nil {
+		return err
+	}
+	for _, v := range []*int{c.Net.Kcp.DataShards, c.Net.Kcp.ParityShards} {
+		if v != nil && *v < 0 {
+			return errInvalidKcpShards
+		}
+	}
+	for _, addr := range c.Hubs {
+		_, port, err := net.SplitHostPort(addr)
+		if err == nil {
+			_, err = strconv.Atoi(port)
+		}
+		if err != nil {
+			return fmt.Errorf("%w, %s", errInvalidHubAddress, addr)
+		}
+	}
+	for _, r := range c.Firewall.Rules {
+		if _, err = firewall.ParseRule(r); err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -45,6 +45,9 @@ var (
 	}
 	errInvalidConfigVariable = errors.New("invalid config variable, need pointer")
 	errInvalidStunServerType = errors.New("invalid stun server type")
+	errInvalidEncryptionType = errors.New("invalid encryption type")
+	errInvalidTransportType  = errors.New("invalid transport type")
+	errInvalidCodecType      = errors.New("invalid codec type")
 )
 
 func init() {
@@ -71,3 +74,51 @@ func validateStunServerType(t StunServerType) (err error) {
 	}
 	return errInvalidStunServerType
 }
+
+type EncryptionType string
+
+const (
+	NoEncryption   EncryptionType = "none"
+	AEADEncryption EncryptionType = "aead"
+)
+
+func validateEncryptionType(t EncryptionType) (err error) {
+	if t == "" || t == NoEncryption {
+		return nil
+	}
+	if t == AEADEncryption {
+		return nil
+	}
+	return errInvalidEncryptionType
+}
+
+type TransportType string
+
+const (
+	UDPTransport  TransportType = "udp"
+	KCPTransport  TransportType = "kcp"
+	QUICTransport TransportType = "quic"
+)
+
+func validateTransportType(t TransportType) (err error) {
+	switch t {
+	case "", UDPTransport, KCPTransport, QUICTransport:
+		return nil
+	}
+	return errInvalidTransportType
+}
+
+type CodecType string
+
+const (
+	JSONCodec CodecType = "json"
+	CBORCodec CodecType = "cbor"
+)
+
+func validateCodecType(t CodecType) (err error) {
+	switch t {
+	case "", JSONCodec, CBORCodec:
+		return nil
+	}
+	return errInvalidCodecType
+}
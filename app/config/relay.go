@@ -0,0 +1,49 @@
+package config
+
+import (
+	"errors"
+)
+
+func InitRelay() (err error) {
+	return InitRelayPath("ptun-relay.toml")
+}
+
+func InitRelayPath(f string) (err error) {
+	if err = InitFile(f, &r); err != nil {
+		return err
+	}
+	r.common = &com
+	return checkRelayConfig()
+}
+
+func Relay() *relay {
+	return &r
+}
+
+type relay struct {
+	*common
+
+	ServerPort int `toml:"ServerPort"`
+	TLS        struct {
+		// Cert and Key are the pem files of relay certificate, binds are served over tls when set
+		Cert string
+		Key  string
+	} `toml:"TLS"`
+}
+
+var r relay
+
+var (
+	errInvalidRelayPort  = errors.New("invalid relay port")
+	errRelayTLSCertEmpty = errors.New("relay tls needs both certificate and key")
+)
+
+func checkRelayConfig() (err error) {
+	if r.ServerPort <= 0 {
+		return errInvalidRelayPort
+	}
+	if (r.TLS.Cert == "") != (r.TLS.Key == "") {
+		return errRelayTLSCertEmpty
+	}
+	return nil
+}
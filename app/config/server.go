@@ -2,6 +2,12 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/withz/ptun/pkg/acl"
 )
 
 func InitServer() (err error) {
@@ -23,18 +29,134 @@ func Server() *server {
 type server struct {
 	*common
 
+	// ServerPort serves login in plaintext, disabled when zero
 	ServerPort int `toml:"ServerPort"`
-	Stun       struct {
+	// Metrics is the listen address of prometheus metrics, disabled when empty
+	Metrics string
+	// State is the path of hub state like known nodes and punches, kept across restarts, disabled when empty
+	State string
+	Stun  struct {
 		Type          StunServerType
+		PrimaryIP     string
+		SecondaryIP   string
 		PrimaryPort   int
 		SecondaryPort int
 	} `toml:"Stun"`
+	Relay struct {
+		Host string
+		Port int
+		// Token is the token of relay server, it signs the relay tickets of nodes
+		Token string
+		// TLS tells nodes the relay serves tls, they verify it with their TLS settings of hub
+		TLS bool
+	} `toml:"Relay"`
+	Auth struct {
+		// Nodes is the path of node enrollment store, enables identity login when set
+		Nodes string
+	} `toml:"Auth"`
+	Net struct {
+		// CIDR enables address allocation by hub, nodes without IP get leases from it
+		CIDR string
+		// Leases is the path of lease file, leases are kept in memory when empty
+		Leases string
+		// Pool is the part of CIDR which this hub leases from, all of CIDR when empty. Federated
+		// hubs sharing a network need disjoint pools
+		Pool string
+		// Routes are the networks which nodes may advertise, other advertised routes are dropped
+		Routes []string
+	} `toml:"Net"`
+	TLS struct {
+		// Port serves login over tls, disabled when zero, it can run along with ServerPort
+		Port int
+		// Cert and Key are the pem files of hub certificate
+		Cert string
+		Key  string
+	} `toml:"TLS"`
+	WebSocket struct {
+		// Port serves login over websocket, disabled when zero
+		Port int
+		// Path is the http path of websocket, "/ptun" when empty
+		Path string
+		// TLS serves wss with the certificate of TLS
+		TLS bool
+	} `toml:"WebSocket"`
+	// ACL is of the default network
+	ACL ACL `toml:"ACL"`
+	// Networks are isolated from each other and from the default network of Token, Auth, Net and ACL
+	Networks   []Network `toml:"Networks"`
+	Federation struct {
+		// Name identifies this hub among federated hubs, federation is disabled when empty
+		Name string
+		// Token is shared by federated hubs
+		Token string
+		// Port accepts links of other hubs, disabled when zero
+		Port int
+		// Peers are the host:port of other hubs to link
+		Peers []string
+		// TLS serves links with the certificate of TLS, and verifies peers by CA or Pins
+		TLS  bool
+		CA   string
+		Pins []string
+	} `toml:"Federation"`
+	Admin struct {
+		// Listen is the address of admin api, disabled when empty
+		Listen string
+		// Token is required by admin api as bearer authorization
+		Token string
+		// TLS serves https with the certificate of TLS, the token is sent in cleartext without it
+		TLS bool
+	} `toml:"Admin"`
+}
+
+// Network is a virtual network of hub, nodes select it by ID at login.
+type Network struct {
+	ID    string
+	Token string
+	// Nodes is the path of node enrollment store of the network, enables identity login when set
+	Nodes string
+	// CIDR, Leases and Pool enable address allocation of the network like Net
+	CIDR   string
+	Leases string
+	Pool   string
+	// Routes are the networks which nodes of the network may advertise like Net
+	Routes []string
+	ACL    ACL `toml:"ACL"`
+}
+
+// ACL limits which nodes of a network reach each other, it is disabled when Rules is empty.
+type ACL struct {
+	// Tags map a tag to the names of its nodes
+	Tags map[string][]string
+	// Rules are like "tag:dev -> tag:db:5432/tcp"
+	Rules []string
+}
+
+// Policy gives the parsed acl, nil when it is disabled.
+func (a *ACL) Policy() (*acl.Policy, error) {
+	if len(a.Rules) == 0 {
+		return nil, nil
+	}
+	return acl.NewPolicy(a.Tags, a.Rules)
 }
 
 var s server
 
 var (
 	errCannotUseSameStunPorts = errors.New("cannot use same stun ports")
+	errCannotUseSameStunIPs   = errors.New("standard stun server needs two different ips")
+	errInvalidNetCIDR         = errors.New("invalid net cidr")
+	errAdminTokenEmpty        = errors.New("admin api needs a token")
+	errNoHubListener          = errors.New("needs one of ServerPort, TLS.Port and WebSocket.Port")
+	errCannotUseSameHubPorts  = errors.New("cannot use same ports for ServerPort, TLS.Port, WebSocket.Port and Federation.Port")
+	errTLSCertEmpty           = errors.New("tls listener needs a certificate and key")
+	errFederationTokenEmpty   = errors.New("federation needs a token")
+	errFederationNoLink       = errors.New("federation needs Port or Peers")
+	errNetworkIDEmpty         = errors.New("network needs an id")
+	errNetworkTokenEmpty      = errors.New("network needs a token")
+	errCannotUseSameNetworkID = errors.New("cannot use same network id")
+	errInvalidNetworkID       = errors.New("network id cannot contain /")
+	errRelayTokenEmpty        = errors.New("relay needs the token of relay server")
+	errInvalidNetPool         = errors.New("pool needs to be inside cidr")
 )
 
 func checkServerConfig() (err error) {
@@ -44,5 +166,113 @@ func checkServerConfig() (err error) {
 	if s.Stun.PrimaryPort == s.Stun.SecondaryPort {
 		return errCannotUseSameStunPorts
 	}
+	if s.Stun.Type == Standard && (s.Stun.PrimaryIP == "" || s.Stun.PrimaryIP == s.Stun.SecondaryIP) {
+		return errCannotUseSameStunIPs
+	}
+	if s.Net.CIDR != "" {
+		if _, _, err = net.ParseCIDR(s.Net.CIDR); err != nil {
+			return errInvalidNetCIDR
+		}
+	}
+	if err = checkPool(s.Net.CIDR, s.Net.Pool); err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(s.Networks))
+	for _, n := range s.Networks {
+		if n.ID == "" {
+			return errNetworkIDEmpty
+		}
+		if strings.Contains(n.ID, "/") {
+			return fmt.Errorf("%w, %s", errInvalidNetworkID, n.ID)
+		}
+		if n.Token == "" {
+			return fmt.Errorf("%w, %s", errNetworkTokenEmpty, n.ID)
+		}
+		if slices.Contains(ids, n.ID) {
+			return fmt.Errorf("%w, %s", errCannotUseSameNetworkID, n.ID)
+		}
+		ids = append(ids, n.ID)
+		if n.CIDR != "" {
+			if _, _, err = net.ParseCIDR(n.CIDR); err != nil {
+				return fmt.Errorf("%w, %s", errInvalidNetCIDR, n.ID)
+			}
+		}
+		if err = checkPool(n.CIDR, n.Pool); err != nil {
+			return fmt.Errorf("network %s, %w", n.ID, err)
+		}
+		if err = checkCIDRs(n.Routes); err != nil {
+			return fmt.Errorf("network %s, %w", n.ID, err)
+		}
+		if _, err = n.ACL.Policy(); err != nil {
+			return fmt.Errorf("network %s, %w", n.ID, err)
+		}
+	}
+	if err = checkCIDRs(s.Net.Routes); err != nil {
+		return err
+	}
+	if _, err = s.ACL.Policy(); err != nil {
+		return err
+	}
+	if s.Relay.Host != "" && s.Relay.Token == "" {
+		return errRelayTokenEmpty
+	}
+	ports := []int{s.ServerPort, s.TLS.Port, s.WebSocket.Port}
+	ports = slices.DeleteFunc(ports, func(p int) bool { return p == 0 })
+	if len(ports) == 0 {
+		return errNoHubListener
+	}
+	if s.Federation.Name != "" {
+		if s.Federation.Token == "" {
+			return errFederationTokenEmpty
+		}
+		if s.Federation.Port == 0 && len(s.Federation.Peers) == 0 {
+			return errFederationNoLink
+		}
+		if s.Federation.Port != 0 {
+			ports = append(ports, s.Federation.Port)
+		}
+	}
+	slices.Sort(ports)
+	if len(slices.Compact(ports)) != len(ports) {
+		return errCannotUseSameHubPorts
+	}
+	useCert := s.TLS.Port != 0 || s.WebSocket.TLS || (s.Federation.Name != "" && s.Federation.TLS) || (s.Admin.Listen != "" && s.Admin.TLS)
+	if useCert && (s.TLS.Cert == "" || s.TLS.Key == "") {
+		return errTLSCertEmpty
+	}
+	if s.Admin.Listen != "" && s.Admin.Token == "" {
+		return errAdminTokenEmpty
+	}
+	return nil
+}
+
+// checkCIDRs checks the networks like Net.Routes.
+func checkCIDRs(cidrs []string) error {
+	for _, c := range cidrs {
+		if _, _, err := net.ParseCIDR(c); err != nil {
+			return fmt.Errorf("%w, %s", errInvalidNetCIDR, c)
+		}
+	}
+	return nil
+}
+
+// checkPool checks pool is inside cidr, pool is optional.
+func checkPool(cidr string, pool string) error {
+	if pool == "" {
+		return nil
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("%w, %s", errInvalidNetPool, pool)
+	}
+	_, p, err := net.ParseCIDR(pool)
+	if err != nil {
+		return fmt.Errorf("%w, %s", errInvalidNetPool, pool)
+	}
+	ones, _ := network.Mask.Size()
+	poolOnes, _ := p.Mask.Size()
+	if poolOnes < ones || !network.Contains(p.IP) {
+		return fmt.Errorf("%w, %s", errInvalidNetPool, pool)
+	}
 	return nil
 }
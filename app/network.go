@@ -1,19 +1,30 @@
 package app
 
 import (
-	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/pkg/acl"
 	"github.com/withz/ptun/pkg/bridge"
 	"github.com/withz/ptun/pkg/device"
+	"github.com/withz/ptun/pkg/firewall"
+	"github.com/withz/ptun/pkg/hub"
 	"github.com/withz/ptun/pkg/nat"
 	"github.com/withz/ptun/pkg/network"
 	"github.com/withz/ptun/pkg/proto"
 )
 
+var (
+	errDefaultRoute  = errors.New("default route")
+	errUnderlayRoute = errors.New("route overlaps underlay address")
+)
+
 type Route struct {
 	Next    net.IP
 	Network *net.IPNet
@@ -22,25 +33,41 @@ type Route struct {
 type P2PNetworkConfig struct {
 	Tun       string
 	IP        string
+	Encrypt   bool
+	Transport network.TransportOptions
 	AllowNets []string
 	Routers   []struct {
 		Next     string
 		Networks []string
 	}
+	// Firewall denies inbound packets from peers unless they reply to connections of this node
+	// or FirewallRules allow them
+	Firewall      bool
+	FirewallRules []string
+	// Underlay are the hosts of hub and stun server, routes of peers covering them are refused
+	Underlay []string
+	// Identity is the node identity key, it signs the secure handshakes with peers
+	Identity ed25519.PrivateKey
 }
 
 type P2PNetwork struct {
-	bridge    *bridge.Bridge
-	rules     *device.RuleManager
-	routes    []*Route
-	peerMutex sync.Mutex
+	bridge        *bridge.Bridge
+	veth          *device.Tun
+	rules         *device.RuleManager
+	routes        []*Route
+	allowNets     []*net.IPNet
+	advertised    map[string][]*net.IPNet
+	underlay      []net.IP
+	identity      ed25519.PrivateKey
+	ip            string
+	encrypt       bool
+	transportOpts network.TransportOptions
+	peerMutex     sync.Mutex
 }
 
+// CreateNet creates the tun device and bridge. IP may be empty when the address is
+// leased by hub, then it is applied by SetIP after login.
 func CreateNet(cfg *P2PNetworkConfig) (*P2PNetwork, error) {
-	_, ipnet, err := net.ParseCIDR(cfg.IP)
-	if err != nil {
-		return nil, fmt.Errorf("create p2p network err, %w", err)
-	}
 	peerRoutes := make([]*Route, 0)
 	vethRoutes := make([]string, 0)
 	for _, r := range cfg.Routers {
@@ -55,12 +82,6 @@ func CreateNet(cfg *P2PNetworkConfig) (*P2PNetwork, error) {
 		vethRoutes = append(vethRoutes, r.Networks...)
 	}
 
-	veth, err := device.NewTun(cfg.Tun, []string{cfg.IP}, vethRoutes)
-	if err != nil {
-		return nil, fmt.Errorf("p2p network create veth err, %w", err)
-	}
-	bdg := bridge.NewBridge(veth)
-
 	routes := make([]*net.IPNet, 0)
 	for _, r := range cfg.AllowNets {
 		_, ipnet, err := net.ParseCIDR(r)
@@ -69,20 +90,220 @@ func CreateNet(cfg *P2PNetworkConfig) (*P2PNetwork, error) {
 		}
 		routes = append(routes, ipnet)
 	}
+
+	veth, err := device.NewTun(cfg.Tun, []string{}, vethRoutes)
+	if err != nil {
+		return nil, fmt.Errorf("p2p network create veth err, %w", err)
+	}
+	bdg := bridge.NewBridge(veth)
+	if cfg.Firewall {
+		fw, err := firewall.New(cfg.FirewallRules)
+		if err != nil {
+			return nil, fmt.Errorf("create p2p network err, %w", err)
+		}
+		bdg.SetFirewall(fw)
+	}
+
 	ipt, err := device.NewRuleManager()
 	if err != nil {
 		return nil, fmt.Errorf("create p2p network err, %w", err)
 	}
+	nw := &P2PNetwork{
+		bridge:        bdg,
+		veth:          veth,
+		rules:         ipt,
+		routes:        peerRoutes,
+		allowNets:     routes,
+		advertised:    make(map[string][]*net.IPNet),
+		underlay:      resolveHosts(cfg.Underlay),
+		identity:      cfg.Identity,
+		encrypt:       cfg.Encrypt,
+		transportOpts: cfg.Transport,
+	}
+	if cfg.IP != "" {
+		err = nw.SetIP(cfg.IP)
+		if err != nil {
+			return nil, fmt.Errorf("create p2p network err, %w", err)
+		}
+	}
+	return nw, nil
+}
+
+// SetIP changes the address of tun device, and the iptables rules of allowed nets.
+func (nw *P2PNetwork) SetIP(ip string) error {
+	nw.peerMutex.Lock()
+	defer nw.peerMutex.Unlock()
+	if ip == nw.ip {
+		return nil
+	}
+	_, ipnet, err := net.ParseCIDR(ip)
+	if err != nil {
+		return err
+	}
+	err = nw.veth.UpdateAddrs([]string{ip})
+	if err != nil {
+		return err
+	}
 	// clear iptables on exit
-	err = ipt.UpdateIptables(ipnet.String(), routes)
+	err = nw.rules.UpdateIptables(ipnet.String(), nw.allowNets)
 	if err != nil {
-		return nil, fmt.Errorf("create p2p network err, %w", err)
+		return err
+	}
+	logrus.Infof("network ip set to %s", ip)
+	nw.ip = ip
+	return nil
+}
+
+func (nw *P2PNetwork) IP() string {
+	nw.peerMutex.Lock()
+	defer nw.peerMutex.Unlock()
+	return nw.ip
+}
+
+// AllowNets gives the networks reachable through this node, which are advertised to peers.
+func (nw *P2PNetwork) AllowNets() []*net.IPNet {
+	return nw.allowNets
+}
+
+// UpdatePeerRoutes replaces the networks advertised by peer. Kernel routes through tun are
+// added for them, and removed when no peer or static router uses them any more.
+func (nw *P2PNetwork) UpdatePeerRoutes(name string, routes []*net.IPNet) error {
+	nw.peerMutex.Lock()
+	defer nw.peerMutex.Unlock()
+	accepted := make([]*net.IPNet, 0)
+	for _, r := range routes {
+		// networks attached to this node are not routed to peers
+		if containsNet(nw.allowNets, r) {
+			continue
+		}
+		if err := nw.checkRoute(r); err != nil {
+			logrus.Warnf("refuse route %s of peer %s, %s", r, name, err.Error())
+			continue
+		}
+		accepted = append(accepted, r)
+	}
+	old := nw.advertised[name]
+	nw.advertised[name] = accepted
+
+	added := make([]string, 0)
+	for _, r := range accepted {
+		added = append(added, r.String())
+	}
+	deleted := make([]string, 0)
+	for _, r := range old {
+		if !nw.routeInUse(r) {
+			deleted = append(deleted, r.String())
+		}
+	}
+	if len(accepted) == 0 {
+		delete(nw.advertised, name)
+	}
+	err := nw.veth.DelRoutes(deleted)
+	if err != nil {
+		return err
+	}
+	err = nw.veth.AddRoutes(added)
+	if err != nil {
+		return err
+	}
+	if p, ok := nw.bridge.GetPeer(name); ok {
+		nw.bridge.SetPeerRoutes(name, nw.peerRoutes(name, p.IP()))
+	}
+	logrus.Infof("peer %s routes updated, %v", name, added)
+	return nil
+}
+
+// checkRoute refuses default routes, and routes which take the traffic of underlay like the
+// networks of local interfaces and the addresses of hub.
+func (nw *P2PNetwork) checkRoute(r *net.IPNet) error {
+	if ones, _ := r.Mask.Size(); ones == 0 {
+		return errDefaultRoute
+	}
+	for _, ip := range nw.underlay {
+		if r.Contains(ip) {
+			return fmt.Errorf("%w %s", errUnderlayRoute, ip)
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if a, ok := addr.(*net.IPNet); ok && (a.Contains(r.IP) || r.Contains(a.IP)) {
+			return fmt.Errorf("%w %s", errUnderlayRoute, a)
+		}
 	}
-	return &P2PNetwork{
-		bridge: bdg,
-		rules:  ipt,
-		routes: peerRoutes,
-	}, nil
+	return nil
+}
+
+// resolveHosts gives the addresses of hosts, hosts which cannot be resolved are skipped.
+func resolveHosts(hosts []string) []net.IP {
+	ips := make([]net.IP, 0, len(hosts))
+	for _, h := range hosts {
+		if h == "" {
+			continue
+		}
+		addrs, err := net.LookupIP(h)
+		if err != nil {
+			logrus.Warnf("resolve %s err, %s", h, err.Error())
+			continue
+		}
+		ips = append(ips, addrs...)
+	}
+	return ips
+}
+
+// routeInUse tells if the network is still routed by a static router or a peer.
+func (nw *P2PNetwork) routeInUse(n *net.IPNet) bool {
+	for _, r := range nw.routes {
+		if r.Network.String() == n.String() {
+			return true
+		}
+	}
+	for _, routes := range nw.advertised {
+		if containsNet(routes, n) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsNet(nets []*net.IPNet, n *net.IPNet) bool {
+	for _, i := range nets {
+		if i.String() == n.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// PreferredTransports gives the transports advertised to hub, raw udp is always the fallback.
+// Kcp carries its fec shards, so hub only picks it for peers with the same ones.
+func (nw *P2PNetwork) PreferredTransports(preferred string) []string {
+	if preferred == "" || preferred == string(network.UDP) {
+		return []string{string(network.UDP)}
+	}
+	if preferred == string(network.KCP) {
+		preferred = network.KcpTransportName(&nw.transportOpts.Kcp)
+	}
+	return []string{preferred, string(network.UDP)}
+}
+
+// Encryption gives the encryption this node requires on peer conns, hub refuses peers with another one.
+func (nw *P2PNetwork) Encryption() string {
+	if nw.encrypt {
+		return network.EncryptionAEAD
+	}
+	return network.EncryptionNone
+}
+
+// SetACL filters the packets from peers by the policy of node self, nil lets all of them through.
+func (nw *P2PNetwork) SetACL(policy *acl.Policy, self string) {
+	if policy == nil {
+		nw.bridge.SetFilter(nil)
+		return
+	}
+	nw.bridge.SetFilter(acl.NewFilter(policy, self))
 }
 
 func (nw *P2PNetwork) HasPeer(name string) bool {
@@ -91,7 +312,27 @@ func (nw *P2PNetwork) HasPeer(name string) bool {
 	return nw.bridge.HasPeer(name)
 }
 
-func (nw *P2PNetwork) NewNatPeer(name string, remoteIp string, token string, m *nat.Nat) error {
+// PeerStats gives the connected peers with their traffic counters, ordered by name.
+func (nw *P2PNetwork) PeerStats() []*bridge.PeerStats {
+	stats := make([]*bridge.PeerStats, 0)
+	for _, p := range nw.bridge.Peers() {
+		stats = append(stats, p.Stats())
+	}
+	slices.SortFunc(stats, func(a, b *bridge.PeerStats) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return stats
+}
+
+func (nw *P2PNetwork) RemovePeer(name string) {
+	nw.peerMutex.Lock()
+	defer nw.peerMutex.Unlock()
+	nw.bridge.RemovePeer(name)
+}
+
+// NewNatPeer connects peer through the hole made by m. The secure conn with peer is authenticated
+// by token, and by peerKey which is the identity key of peer verified by hub.
+func (nw *P2PNetwork) NewNatPeer(name string, remoteIp string, token string, peerKey string, transport string, m *nat.Nat) error {
 	nw.peerMutex.Lock()
 	defer nw.peerMutex.Unlock()
 	remoteIP, remoteIPNet, err := net.ParseCIDR(remoteIp)
@@ -105,36 +346,105 @@ func (nw *P2PNetwork) NewNatPeer(name string, remoteIp string, token string, m *
 		return fmt.Errorf("make hole err, %w", err)
 	}
 
-	var econn net.Conn
-	if true {
-		econn, err = network.NewRawConn(conn, raddr)
+	opts := nw.transportOpts
+	opts.Role = string(m.Role)
+	t := network.ParseTransport(transport, &opts)
+	if !network.HasTransport(t) {
+		t = network.UDP
+	}
+	econn, err := network.NewTransportConn(t, conn, raddr, &opts)
+	if err != nil {
+		return fmt.Errorf("%s conn err, %w", t, err)
+	}
+
+	if nw.encrypt {
+		cfg, err := nw.secureConfig(name, []byte(token), peerKey)
 		if err != nil {
-			return fmt.Errorf("raw conn err, %w", err)
+			return err
 		}
-	} else {
-		econn, err = network.NewQuicConn(context.TODO(), conn, raddr, string(m.Role))
+		cfg.Initiator = m.Role == nat.ClientSide
+		cfg.Stream = network.IsStreamTransport(t)
+		econn, err = network.NewSecureConn(econn, cfg)
 		if err != nil {
-			return fmt.Errorf("init quic err, %w", err)
+			return fmt.Errorf("secure conn err, %w", err)
 		}
-		econn, err = network.NewEncyptedConn(econn, []byte(token))
+	}
+
+	logrus.Infof("make hole success, wait connect. %v -> %v, transport %s", conn.LocalAddr(), raddr, t)
+
+	pt := proto.NewDatagramTransport(econn)
+	if network.IsStreamTransport(t) {
+		pt = proto.NewTransport(econn)
+	}
+	peer := bridge.NewPeer(name, []*net.IPNet{remoteIPNet}, nw.peerRoutes(name, remoteIP), pt)
+	peer.SetVia(string(t))
+	return nw.bridge.ConnectPeer(peer)
+}
+
+// NewRelayPeer connects peer through relay, peerKey is like the one of NewNatPeer.
+func (nw *P2PNetwork) NewRelayPeer(name string, remoteIp string, peerKey string, cfg *bridge.RelayClientConfig) error {
+	remoteIP, remoteIPNet, err := net.ParseCIDR(remoteIp)
+	if err != nil {
+		return fmt.Errorf("parse ip err, %w", err)
+	}
+	remoteIPNet.IP = remoteIP
+
+	t, err := bridge.DialRelay(cfg)
+	if err != nil {
+		return fmt.Errorf("dial relay err, %w", err)
+	}
+	logrus.Infof("relay connected, %s via %s", name, t.RemoteAddr())
+	if nw.encrypt {
+		// relay only sees raw frames, the inner transport is protected end to end
+		sc, err := nw.secureConfig(name, []byte(cfg.Key), peerKey)
+		if err != nil {
+			t.Close()
+			return err
+		}
+		sc.Initiator = cfg.Name < name
+		econn, err := network.NewSecureConn(t, sc)
 		if err != nil {
-			return fmt.Errorf("encypted err, %w", err)
+			t.Close()
+			return fmt.Errorf("secure conn err, %w", err)
 		}
+		t = proto.NewDatagramTransport(econn)
 	}
 
-	logrus.Infof("make hole success, wait connect. %v -> %v", conn.LocalAddr(), raddr)
+	nw.peerMutex.Lock()
+	defer nw.peerMutex.Unlock()
+	peer := bridge.NewPeer(name, []*net.IPNet{remoteIPNet}, nw.peerRoutes(name, remoteIP), t)
+	peer.SetVia("relay")
+	return nw.bridge.ConnectPeer(peer)
+}
+
+// secureConfig authenticates the secure conn with peer by key and the identity keys of both sides.
+// Without peerKey, any node knowing key can pose as peer.
+func (nw *P2PNetwork) secureConfig(name string, key []byte, peerKey string) (*network.SecureConfig, error) {
+	cfg := &network.SecureConfig{Key: key, Identity: nw.identity}
+	if peerKey == "" {
+		logrus.Warnf("peer %s is authenticated by shared key only, hub does not verify its identity", name)
+		return cfg, nil
+	}
+	k, err := hub.DecodePublicKey(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("identity of peer %s err, %w", name, err)
+	}
+	cfg.PeerKey = k
+	return cfg, nil
+}
 
+// peerRoutes gives the networks reachable through peer, from static routers and peer advertisement.
+func (nw *P2PNetwork) peerRoutes(name string, remoteIP net.IP) []*net.IPNet {
 	routes := make([]*net.IPNet, 0)
 	for _, r := range nw.routes {
 		if r.Next.Equal(remoteIP) {
 			routes = append(routes, r.Network)
 		}
 	}
-
-	peer := bridge.NewPeer(name, []*net.IPNet{remoteIPNet}, routes, proto.NewTransport(econn))
-	return nw.bridge.ConnectPeer(peer)
+	return append(routes, nw.advertised[name]...)
 }
 
 func (nw *P2PNetwork) OnShutdown() {
 	nw.rules.ClearAllRules()
+	nw.bridge.Close()
 }
@@ -1,14 +1,20 @@
 package app
 
 import (
+	"crypto/tls"
+	"errors"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/pkg/acl"
+	"github.com/withz/ptun/pkg/bridge"
 	"github.com/withz/ptun/pkg/hub"
 	"github.com/withz/ptun/pkg/nat"
 )
 
 type NodeConfig struct {
+	// StunType is the type of stun server at StunHost, simple when empty
+	StunType    string
 	StunHost    string
 	StunPriPort int
 	StunSecPort int
@@ -16,6 +22,9 @@ type NodeConfig struct {
 	HubPort     int
 	HubToken    string
 	NodeIP      string
+	Transport   string
+	// HubTLS logins hub over tls when set
+	HubTLS *hub.TLSClientOptions
 }
 
 type Node struct {
@@ -30,40 +39,103 @@ func CreateNode(cfg *NodeConfig) *Node {
 }
 
 func (n *Node) Run(nw *P2PNetwork) error {
-	detector := nat.NewDetector(n.cfg.StunHost, n.cfg.StunPriPort, n.cfg.StunSecPort)
+	detector, err := nat.NewDetector(n.cfg.StunType, n.cfg.StunHost, n.cfg.StunPriPort, n.cfg.StunSecPort)
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if n.cfg.HubTLS != nil {
+		tlsConfig, err = hub.NewTLSClientConfig(n.cfg.HubTLS)
+		if err != nil {
+			return err
+		}
+	}
 	for {
 		ex, err := hub.NewExchanger(hub.NewTcpHubClient(&hub.TcpHubClientConfig{
 			Host:       n.cfg.HubHost,
 			Port:       n.cfg.HubPort,
 			ClientName: n.name,
 			Token:      n.cfg.HubToken,
-		}), detector, n.cfg.NodeIP)
+			TLS:        tlsConfig,
+		}), detector, n.cfg.NodeIP, nw.PreferredTransports(n.cfg.Transport), nw.Encryption())
 		if err != nil {
 			time.Sleep(5 * time.Second)
 			continue
 		}
 		n.name = ex.GetName()
+		if ex.Supports(hub.FeatureACL) {
+			// peers are denied until hub pushes the acl
+			nw.SetACL(&acl.Policy{}, ex.GetName())
+		}
+		events := ex.Subscribe()
+		if len(nw.AllowNets()) > 0 {
+			ex.AdvertiseRoutes(nw.AllowNets())
+		}
+		go func() {
+			for {
+				select {
+				case r := <-ex.RouteUpdates():
+					err := nw.UpdatePeerRoutes(r.PeerName, r.Routes)
+					if err != nil {
+						logrus.Errorf("update routes of peer %s err, %s", r.PeerName, err.Error())
+					}
+				case policy := <-ex.ACLUpdates():
+					nw.SetACL(policy, ex.GetName())
+				case <-ex.Done():
+					return
+				}
+			}
+		}()
 		go func() {
 			for m := range ex.Accept() {
 				logrus.Debugf("peer %s, ip = %s come", m.PeerName, m.PeerIP)
-				err := nw.NewNatPeer(m.PeerName, m.PeerIP, n.cfg.HubToken, m.NatMessage)
+				if m.Err != nil {
+					logrus.Infof("give up connecting peer %s, %s", m.PeerName, m.Err.Error())
+					continue
+				}
+				if m.Relay != nil {
+					go n.relayPeer(nw, m)
+					continue
+				}
+				err := nw.NewNatPeer(m.PeerName, m.PeerIP, n.cfg.HubToken, m.PeerKey, m.Transport, m.NatMessage)
 				if err != nil {
 					logrus.Infof("new nat peer err, %s", err.Error())
 				}
-			}
-		}()
-		for {
-			peers, err := ex.GetPeers()
-			if err != nil {
-				break
-			}
-			for _, p := range peers {
-				if p == n.name || nw.HasPeer(p) {
-					continue
+				if errors.Is(err, nat.ErrMakeHole) && m.NatMessage.Role == nat.ClientSide {
+					ex.RelayPeer(m.PeerName, ex.GetIP(), m.PeerIP)
 				}
-				ex.PunchPeer(p, n.cfg.NodeIP)
 			}
-			time.Sleep(5 * time.Second)
+		}()
+		ex.WatchPeers(nw, events)
+		ex.Close()
+	}
+}
+
+func (n *Node) relayPeer(nw *P2PNetwork, m *hub.ExchangeInfo) {
+	cfg := &bridge.RelayClientConfig{
+		Host:    m.Relay.Host,
+		Port:    m.Relay.Port,
+		Name:    n.name,
+		Session: m.Relay.Session,
+		Ticket:  m.Relay.Ticket,
+		Key:     m.Relay.Key,
+	}
+	if m.Relay.TLS {
+		// relay is verified like hub, by its own host
+		opts := &hub.TLSClientOptions{ServerName: m.Relay.Host}
+		if n.cfg.HubTLS != nil {
+			opts.CA = n.cfg.HubTLS.CA
+			opts.Pins = n.cfg.HubTLS.Pins
 		}
+		tlsConfig, err := hub.NewTLSClientConfig(opts)
+		if err != nil {
+			logrus.Infof("new relay peer err, %s", err.Error())
+			return
+		}
+		cfg.TLS = tlsConfig
+	}
+	err := nw.NewRelayPeer(m.PeerName, m.PeerIP, m.PeerKey, cfg)
+	if err != nil {
+		logrus.Infof("new relay peer err, %s", err.Error())
 	}
 }
@@ -7,7 +7,9 @@ import (
 	"sync"
 
 	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/pkg/acl"
 	"github.com/withz/ptun/pkg/bridge"
+	"github.com/withz/ptun/pkg/firewall"
 	"github.com/withz/ptun/pkg/nat"
 	"github.com/withz/ptun/pkg/network"
 	"github.com/withz/ptun/pkg/proto"
@@ -20,6 +22,10 @@ type route struct {
 
 type P2PNetworkConfig struct {
 	Routers []*route
+	// Firewall denies inbound packets from peers unless they reply to connections of this node
+	// or the rules added by AddFirewallRule allow them
+	Firewall      bool
+	firewallRules []string
 }
 
 func (c *P2PNetworkConfig) AddRoute(next string, dest string) bool {
@@ -38,6 +44,15 @@ func (c *P2PNetworkConfig) AddRoute(next string, dest string) bool {
 	return true
 }
 
+// AddFirewallRule allows inbound packets like "node1:22/tcp", it is false when the rule is invalid.
+func (c *P2PNetworkConfig) AddFirewallRule(rule string) bool {
+	if _, err := firewall.ParseRule(rule); err != nil {
+		return false
+	}
+	c.firewallRules = append(c.firewallRules, rule)
+	return true
+}
+
 type P2PNetwork struct {
 	cfg       *P2PNetworkConfig
 	bridge    *bridge.Bridge
@@ -51,18 +66,33 @@ func CreateNet(cfg *P2PNetworkConfig) *P2PNetwork {
 
 	veth := newAndroidVeth()
 	bdg := bridge.NewBridge(veth)
+	if cfg.Firewall {
+		// rules are checked when they are added
+		fw, err := firewall.New(cfg.firewallRules)
+		if err != nil {
+			logrus.Errorf("create firewall err, %s", err.Error())
+			return nil
+		}
+		bdg.SetFirewall(fw)
+	}
 	return &P2PNetwork{
 		cfg:    cfg,
 		bridge: bdg,
 	}
 }
 
-func (nw *P2PNetwork) hasPeer(name string) bool {
+func (nw *P2PNetwork) HasPeer(name string) bool {
 	nw.peerMutex.Lock()
 	defer nw.peerMutex.Unlock()
 	return nw.bridge.HasPeer(name)
 }
 
+func (nw *P2PNetwork) RemovePeer(name string) {
+	nw.peerMutex.Lock()
+	defer nw.peerMutex.Unlock()
+	nw.bridge.RemovePeer(name)
+}
+
 func (nw *P2PNetwork) newNatPeer(name string, remoteIp string, token string, m *nat.Nat) error {
 	nw.peerMutex.Lock()
 	defer nw.peerMutex.Unlock()
@@ -78,12 +108,14 @@ func (nw *P2PNetwork) newNatPeer(name string, remoteIp string, token string, m *
 	}
 
 	var econn net.Conn
+	stream := false
 	if true {
 		econn, err = network.NewRawConn(conn, raddr)
 		if err != nil {
 			return fmt.Errorf("raw conn err, %w", err)
 		}
 	} else {
+		stream = true
 		econn, err = network.NewQuicConn(context.TODO(), conn, raddr, string(m.Role))
 		if err != nil {
 			return fmt.Errorf("init quic err, %w", err)
@@ -103,10 +135,23 @@ func (nw *P2PNetwork) newNatPeer(name string, remoteIp string, token string, m *
 		}
 	}
 
-	peer := bridge.NewPeer(name, []*net.IPNet{remoteIPNet}, routes, proto.NewTransport(econn))
+	t := proto.NewDatagramTransport(econn)
+	if stream {
+		t = proto.NewTransport(econn)
+	}
+	peer := bridge.NewPeer(name, []*net.IPNet{remoteIPNet}, routes, t)
 	return nw.bridge.ConnectPeer(peer)
 }
 
+// setACL filters the packets from peers by the policy of node self, nil lets all of them through.
+func (nw *P2PNetwork) setACL(policy *acl.Policy, self string) {
+	if policy == nil {
+		nw.bridge.SetFilter(nil)
+		return
+	}
+	nw.bridge.SetFilter(acl.NewFilter(policy, self))
+}
+
 func (nw *P2PNetwork) Shutdown() {
 	nw.peerMutex.Lock()
 	defer nw.peerMutex.Unlock()
@@ -114,4 +159,5 @@ func (nw *P2PNetwork) Shutdown() {
 	for _, peer := range peers {
 		nw.bridge.DisconnectPeer(peer)
 	}
+	nw.bridge.Close()
 }
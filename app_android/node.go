@@ -4,11 +4,15 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/pkg/acl"
 	"github.com/withz/ptun/pkg/hub"
 	"github.com/withz/ptun/pkg/nat"
+	"github.com/withz/ptun/pkg/network"
 )
 
 type NodeConfig struct {
+	// StunType is the type of stun server at StunHost, simple when empty
+	StunType    string
 	StunHost    string
 	StunPriPort int
 	StunSecPort int
@@ -30,39 +34,52 @@ func CreateNode(cfg *NodeConfig) *Node {
 }
 
 func (n *Node) Run(nw *P2PNetwork) error {
-	detector := nat.NewDetector(n.cfg.StunHost, n.cfg.StunPriPort, n.cfg.StunSecPort)
+	detector, err := nat.NewDetector(n.cfg.StunType, n.cfg.StunHost, n.cfg.StunPriPort, n.cfg.StunSecPort)
+	if err != nil {
+		return err
+	}
 	for {
 		ex, err := hub.NewExchanger(hub.NewTcpHubClient(&hub.TcpHubClientConfig{
 			Host:       n.cfg.HubHost,
 			Port:       n.cfg.HubPort,
 			ClientName: n.name,
 			Token:      n.cfg.HubToken,
-		}), detector, n.cfg.NodeIP)
+			// routes are not offered, the vpn of android cannot add routes once it is established
+			Features: []string{hub.FeaturePeerEvents, hub.FeatureACL},
+		}), detector, n.cfg.NodeIP, []string{"udp"}, network.EncryptionNone)
 		if err != nil {
 			time.Sleep(5 * time.Second)
 			continue
 		}
 		n.name = ex.GetName()
+		if ex.Supports(hub.FeatureACL) {
+			// peers are denied until hub pushes the acl
+			nw.setACL(&acl.Policy{}, ex.GetName())
+		}
+		events := ex.Subscribe()
+		go func() {
+			for {
+				select {
+				case policy := <-ex.ACLUpdates():
+					nw.setACL(policy, ex.GetName())
+				case <-ex.Done():
+					return
+				}
+			}
+		}()
 		go func() {
 			for m := range ex.Accept() {
+				if m.Err != nil {
+					logrus.Infof("give up connecting peer %s, %s", m.PeerName, m.Err.Error())
+					continue
+				}
 				err := nw.newNatPeer(m.PeerName, m.PeerIP, n.cfg.HubToken, m.NatMessage)
 				if err != nil {
 					logrus.Infof("new nat peer err, %s", err.Error())
 				}
 			}
 		}()
-		for {
-			peers, err := ex.GetPeers()
-			if err != nil {
-				break
-			}
-			for _, p := range peers {
-				if p == n.name || nw.hasPeer(p) {
-					continue
-				}
-				ex.PunchPeer(p, n.cfg.NodeIP)
-			}
-			time.Sleep(5 * time.Second)
-		}
+		ex.WatchPeers(nw, events)
+		ex.Close()
 	}
 }
@@ -2,17 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"fmt"
+	"slices"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/withz/ptun/app/config"
 	"github.com/withz/ptun/cmd/hub/service"
+	"github.com/withz/ptun/pkg/hub"
 	"github.com/withz/ptun/pkg/tools"
 )
 
 var (
 	ConfigFile string
+	Network    string
 
 	rootCmd = &cobra.Command{
 		Use:   "",
@@ -31,20 +36,62 @@ var (
 		Short: "Config",
 		Run:   Config,
 	}
+
+	nodeCmd = &cobra.Command{
+		Use:   "node",
+		Short: "Manage enrolled nodes",
+	}
+
+	nodeListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List enrolled nodes",
+		Run:   NodeList,
+	}
+
+	nodeApproveCmd = &cobra.Command{
+		Use:   "approve <name>",
+		Short: "Approve an enrolled node",
+		Args:  cobra.ExactArgs(1),
+		Run:   NodeApprove,
+	}
+
+	nodeAddCmd = &cobra.Command{
+		Use:   "add <name> <public key>",
+		Short: "Add and approve a node with its public key",
+		Args:  cobra.ExactArgs(2),
+		Run:   NodeAdd,
+	}
+
+	nodeRemoveCmd = &cobra.Command{
+		Use:   "remove <name>",
+		Short: "Remove a node",
+		Args:  cobra.ExactArgs(1),
+		Run:   NodeRemove,
+	}
+
+	pinCmd = &cobra.Command{
+		Use:   "pin",
+		Short: "Print the public key pin of tls certificate",
+		Run:   Pin,
+	}
 )
 
 func init() {
-	rootCmd.AddCommand(runCmd, confCmd)
-	rootCmd.PersistentFlags().StringVarP(&ConfigFile, "config", "c", "", "verbose output")
+	nodeCmd.AddCommand(nodeListCmd, nodeApproveCmd, nodeAddCmd, nodeRemoveCmd)
+	rootCmd.AddCommand(runCmd, confCmd, nodeCmd, pinCmd)
+	rootCmd.PersistentFlags().StringVarP(&ConfigFile, "config", "c", "", "config file")
+	nodeCmd.PersistentFlags().StringVarP(&Network, "network", "n", "", "network id, the default network when empty")
 }
 
-func Run(cmd *cobra.Command, args []string) {
-	var err error
+func initConfig() error {
 	if ConfigFile == "" {
-		err = config.InitServer()
-	} else {
-		err = config.InitServerPath(ConfigFile)
+		return config.InitServer()
 	}
+	return config.InitServerPath(ConfigFile)
+}
+
+func Run(cmd *cobra.Command, args []string) {
+	err := initConfig()
 	if err != nil {
 		panic(err)
 	}
@@ -67,7 +114,7 @@ func Run(cmd *cobra.Command, args []string) {
 }
 
 func Config(cmd *cobra.Command, args []string) {
-	err := config.InitServer()
+	err := initConfig()
 	if err != nil {
 		panic(err)
 	}
@@ -75,6 +122,94 @@ func Config(cmd *cobra.Command, args []string) {
 	logrus.Infof(string(p))
 }
 
+func nodeStore() *hub.FileNodeStore {
+	err := initConfig()
+	if err != nil {
+		panic(err)
+	}
+	path := config.Server().Auth.Nodes
+	if Network != "" {
+		i := slices.IndexFunc(config.Server().Networks, func(n config.Network) bool {
+			return n.ID == Network
+		})
+		if i < 0 {
+			logrus.Fatalf("network %s is not found in hub config", Network)
+		}
+		path = config.Server().Networks[i].Nodes
+	}
+	if path == "" {
+		logrus.Fatal("identity login is not enabled, set Auth.Nodes or Nodes of the network in hub config")
+	}
+	return hub.NewFileNodeStore(path)
+}
+
+func NodeList(cmd *cobra.Command, args []string) {
+	nodes, err := nodeStore().List()
+	if err != nil {
+		logrus.Errorf("list nodes failed, %s", err.Error())
+		return
+	}
+	for _, n := range nodes {
+		fmt.Printf("%s\t%t\t%s\n", n.Name, n.Approved, n.PublicKey)
+	}
+}
+
+func NodeApprove(cmd *cobra.Command, args []string) {
+	err := nodeStore().Approve(args[0])
+	if err != nil {
+		logrus.Errorf("approve node failed, %s", err.Error())
+		return
+	}
+	logrus.Infof("node %s approved", args[0])
+}
+
+func NodeAdd(cmd *cobra.Command, args []string) {
+	store := nodeStore()
+	err := store.Remove(args[0])
+	if err == nil {
+		err = store.Enroll(args[0], args[1])
+	}
+	if err == nil {
+		err = store.Approve(args[0])
+	}
+	if err != nil {
+		logrus.Errorf("add node failed, %s", err.Error())
+		return
+	}
+	logrus.Infof("node %s added", args[0])
+}
+
+func NodeRemove(cmd *cobra.Command, args []string) {
+	err := nodeStore().Remove(args[0])
+	if err != nil {
+		logrus.Errorf("remove node failed, %s", err.Error())
+		return
+	}
+	logrus.Infof("node %s removed", args[0])
+}
+
+func Pin(cmd *cobra.Command, args []string) {
+	err := initConfig()
+	if err != nil {
+		panic(err)
+	}
+	cfg := config.Server().TLS
+	if cfg.Port == 0 {
+		logrus.Fatal("tls is not enabled, set TLS in hub config")
+	}
+	tlsConfig, err := hub.NewTLSServerConfig(cfg.Cert, cfg.Key)
+	if err != nil {
+		logrus.Errorf("load certificate failed, %s", err.Error())
+		return
+	}
+	leaf, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		logrus.Errorf("parse certificate failed, %s", err.Error())
+		return
+	}
+	fmt.Println(hub.PublicKeyPin(leaf))
+}
+
 func main() {
 	logrus.SetLevel(logrus.DebugLevel)
 	// logrus.SetReportCaller(true)
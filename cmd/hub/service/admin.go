@@ -0,0 +1,69 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/withz/ptun/pkg/control"
+	"github.com/withz/ptun/pkg/hub"
+)
+
+const (
+	nodesAPI      = "/nodes"
+	knownNodesAPI = "/nodes/known"
+	punchAPI      = "/punch"
+	punchesAPI    = "/punches"
+)
+
+// adminNodes is reported by the nodes api of hub.
+type adminNodes struct {
+	Nodes []*hub.SessionInfo
+}
+
+// adminKnownNodes is reported by the known nodes api of hub, including the nodes offline.
+type adminKnownNodes struct {
+	Nodes []*hub.KnownNode
+}
+
+// adminPunchRequest asks hub to punch between two online nodes of network.
+type adminPunchRequest struct {
+	From    string
+	To      string
+	Network string `json:",omitempty"`
+}
+
+// adminPunches is reported by the punches api of hub, from the latest punch.
+type adminPunches struct {
+	Punches []*hub.PunchRecord
+}
+
+// newAdminServer gives the admin api of hub, requests must carry the token.
+func newAdminServer(h *hub.Hub, addr string, token string) *control.Server {
+	s := control.NewServer("tcp", addr)
+	s.UseToken(token)
+	s.HandleFunc("GET "+nodesAPI, func(r *http.Request) (any, error) {
+		return &adminNodes{Nodes: h.Sessions()}, nil
+	})
+	s.HandleFunc("GET "+knownNodesAPI, func(r *http.Request) (any, error) {
+		nodes, err := h.KnownNodes()
+		if err != nil {
+			return nil, err
+		}
+		return &adminKnownNodes{Nodes: nodes}, nil
+	})
+	s.HandleFunc("DELETE "+nodesAPI+"/{name}", func(r *http.Request) (any, error) {
+		return struct{}{}, h.Kick(r.URL.Query().Get("network"), r.PathValue("name"))
+	})
+	s.HandleFunc("POST "+punchAPI, func(r *http.Request) (any, error) {
+		req := &adminPunchRequest{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			return nil, err
+		}
+		return h.Punch(req.Network, req.From, req.To)
+	})
+	s.HandleFunc("GET "+punchesAPI, func(r *http.Request) (any, error) {
+		return &adminPunches{Punches: h.PunchHistory()}, nil
+	})
+	return s
+}
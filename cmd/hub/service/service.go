@@ -2,10 +2,15 @@ package service
 
 import (
 	"context"
+	"crypto/tls"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/withz/ptun/app/config"
+	"github.com/withz/ptun/pkg/control"
 	"github.com/withz/ptun/pkg/hub"
 	"github.com/withz/ptun/pkg/nat"
+	"github.com/withz/ptun/pkg/network"
 )
 
 type Service struct {
@@ -25,22 +30,183 @@ func (s *Service) Start(ctx context.Context) error {
 func (s *Service) Run(ctx context.Context) error {
 	s.ctx, s.cancel = context.WithCancel(ctx)
 
-	natServer := nat.NewSimpleServer(config.Server().Stun.PrimaryPort, config.Server().Stun.SecondaryPort)
+	var natServer nat.NatServer
+	stun := config.Server().Stun
+	if stun.Type == config.Standard {
+		natServer = nat.NewStandardServer(stun.PrimaryIP, stun.SecondaryIP, stun.PrimaryPort, stun.SecondaryPort)
+	} else {
+		natServer = nat.NewSimpleServer(stun.PrimaryPort, stun.SecondaryPort)
+	}
 	err := natServer.Start()
 	if err != nil {
 		return err
 	}
 
-	h := hub.NewHub(
-		hub.NewTcpHubServer(&hub.TcpHubServerConfig{
-			Port:  config.Server().ServerPort,
-			Token: config.Server().Token,
-		}),
-	)
+	var nodes hub.NodeStore
+	if config.Server().Auth.Nodes != "" {
+		nodes = hub.NewFileNodeStore(config.Server().Auth.Nodes)
+	}
+	var ipam *hub.IPAM
+	if config.Server().Net.CIDR != "" {
+		ipam, err = hub.NewIPAM(config.Server().Net.CIDR, config.Server().Net.Leases)
+		if err != nil {
+			return err
+		}
+		if config.Server().Net.Pool != "" {
+			if err = ipam.SetPool(config.Server().Net.Pool); err != nil {
+				return err
+			}
+		}
+	}
+	networks := make([]*hub.NetworkConfig, 0, len(config.Server().Networks))
+	for _, n := range config.Server().Networks {
+		network := &hub.NetworkConfig{
+			ID:    n.ID,
+			Token: n.Token,
+		}
+		if n.Nodes != "" {
+			network.Nodes = hub.NewFileNodeStore(n.Nodes)
+		}
+		if n.CIDR != "" {
+			network.IPAM, err = hub.NewIPAM(n.CIDR, n.Leases)
+			if err != nil {
+				return err
+			}
+			if n.Pool != "" {
+				if err = network.IPAM.SetPool(n.Pool); err != nil {
+					return err
+				}
+			}
+		}
+		networks = append(networks, network)
+	}
+	var tlsConfig *tls.Config
+	federation := config.Server().Federation
+	admin := config.Server().Admin
+	if cfg := config.Server().TLS; cfg.Port != 0 || config.Server().WebSocket.TLS || (federation.Name != "" && federation.TLS) || (admin.Listen != "" && admin.TLS) {
+		tlsConfig, err = hub.NewTLSServerConfig(cfg.Cert, cfg.Key)
+		if err != nil {
+			return err
+		}
+	}
+	login := hub.TcpHubServerConfig{
+		Token:    config.Server().Token,
+		Nodes:    nodes,
+		IPAM:     ipam,
+		Networks: networks,
+	}
+	servers := make([]hub.HubServer, 0)
+	if port := config.Server().ServerPort; port != 0 {
+		cfg := login
+		cfg.Port = port
+		servers = append(servers, hub.NewTcpHubServer(&cfg))
+	}
+	if port := config.Server().TLS.Port; port != 0 {
+		cfg := login
+		cfg.Port = port
+		cfg.TLS = tlsConfig
+		servers = append(servers, hub.NewTcpHubServer(&cfg))
+	}
+	if ws := config.Server().WebSocket; ws.Port != 0 {
+		cfg := &hub.WsHubServerConfig{
+			TcpHubServerConfig: login,
+			Path:               ws.Path,
+		}
+		cfg.Port = ws.Port
+		if ws.TLS {
+			cfg.TLS = tlsConfig
+		}
+		servers = append(servers, hub.NewWsHubServer(cfg))
+	}
+	h := hub.NewHub(servers...)
+	if ipam != nil {
+		h.UseIPAM(hub.DefaultNetwork, ipam)
+	}
+	for _, n := range networks {
+		if n.IPAM != nil {
+			h.UseIPAM(n.ID, n.IPAM)
+		}
+	}
+	routes := map[string][]string{hub.DefaultNetwork: config.Server().Net.Routes}
+	for _, n := range config.Server().Networks {
+		routes[n.ID] = n.Routes
+	}
+	for id, cidrs := range routes {
+		_, allowed, err := network.ParseIPNets(cidrs)
+		if err != nil {
+			return err
+		}
+		h.UseRoutes(id, allowed)
+	}
+	acls := map[string]config.ACL{hub.DefaultNetwork: config.Server().ACL}
+	for _, n := range config.Server().Networks {
+		acls[n.ID] = n.ACL
+	}
+	for id, a := range acls {
+		policy, err := a.Policy()
+		if err != nil {
+			return err
+		}
+		if policy != nil {
+			h.UseACL(id, policy)
+		}
+	}
+	if relay := config.Server().Relay; relay.Host != "" {
+		h.UseRelay(&hub.RelayConfig{
+			Host:   relay.Host,
+			Port:   relay.Port,
+			Secret: relay.Token,
+			TLS:    relay.TLS,
+		})
+	}
+	if config.Server().State != "" {
+		store, err := hub.OpenFileStateStore(config.Server().State)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		h.UseStore(store)
+	}
+	if federation.Name != "" {
+		cfg := &hub.FederationConfig{
+			Name:  federation.Name,
+			Token: federation.Token,
+			Port:  federation.Port,
+			Peers: federation.Peers,
+		}
+		if federation.TLS {
+			cfg.TLS = tlsConfig
+			cfg.PeerTLS = &hub.TLSClientOptions{
+				CA:   federation.CA,
+				Pins: federation.Pins,
+			}
+		}
+		h.UseFederation(cfg)
+	}
 	err = h.Start()
 	if err != nil {
 		return err
 	}
+	if config.Server().Metrics != "" {
+		m := control.NewServer("tcp", config.Server().Metrics)
+		m.Handle("/metrics", promhttp.Handler())
+		err = m.Start()
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+	}
+	if admin.Listen != "" {
+		a := newAdminServer(h, admin.Listen, admin.Token)
+		if admin.TLS {
+			a.UseTLS(tlsConfig)
+		}
+		err = a.Start()
+		if err != nil {
+			return err
+		}
+		defer a.Close()
+	}
 
 	<-s.ctx.Done()
 	h.Close()
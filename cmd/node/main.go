@@ -3,11 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/withz/ptun/app/config"
 	"github.com/withz/ptun/cmd/node/service"
+	"github.com/withz/ptun/pkg/control"
+	"github.com/withz/ptun/pkg/hub"
 	"github.com/withz/ptun/pkg/tools"
 )
 
@@ -32,25 +38,41 @@ var (
 		Short: "Config",
 		Run:   Config,
 	}
+
+	statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show status of running node",
+		Run:   Status,
+	}
+
+	peersCmd = &cobra.Command{
+		Use:   "peers",
+		Short: "Show connected peers of running node",
+		Run:   Peers,
+	}
+
+	keygenCmd = &cobra.Command{
+		Use:   "keygen [path]",
+		Short: "Generate node identity key",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   Keygen,
+	}
 )
 
 func init() {
-	rootCmd.AddCommand(runCmd, confCmd)
-	rootCmd.PersistentFlags().StringVarP(&ClientName, "name", "n", "", "verbose output")
+	rootCmd.AddCommand(runCmd, confCmd, statusCmd, peersCmd, keygenCmd)
+	rootCmd.PersistentFlags().StringVarP(&ClientName, "name", "n", "", "node name")
 	rootCmd.PersistentFlags().StringVarP(&ConfigFile, "config", "c", "", "verbose output")
 }
 
 func Run(cmd *cobra.Command, args []string) {
-	var err error
-	if ConfigFile == "" {
-		err = config.InitClient()
-	} else {
-		err = config.InitClientPath(ConfigFile)
-	}
-
+	err := initConfig()
 	if err != nil {
 		panic(err)
 	}
+	if ClientName != "" {
+		config.Client().Name = ClientName
+	}
 
 	c := service.NewService()
 
@@ -70,12 +92,7 @@ func Run(cmd *cobra.Command, args []string) {
 }
 
 func Config(cmd *cobra.Command, args []string) {
-	var err error
-	if ConfigFile == "" {
-		err = config.InitClient()
-	} else {
-		err = config.InitClientPath(ConfigFile)
-	}
+	err := initConfig()
 	if err != nil {
 		panic(err)
 	}
@@ -84,6 +101,77 @@ func Config(cmd *cobra.Command, args []string) {
 	logrus.Infof(string(p))
 }
 
+func initConfig() error {
+	if ConfigFile == "" {
+		return config.InitClient()
+	}
+	return config.InitClientPath(ConfigFile)
+}
+
+func Status(cmd *cobra.Command, args []string) {
+	err := initConfig()
+	if err != nil {
+		panic(err)
+	}
+	status := &control.NodeStatus{}
+	err = control.Get(config.Client().Control, control.NodeStatusAPI, status)
+	if err != nil {
+		logrus.Errorf("query node status failed, %s", err.Error())
+		return
+	}
+	fmt.Printf("name:\t%s\n", status.Name)
+	fmt.Printf("ip:\t%s\n", status.IP)
+	fmt.Printf("hub:\t%s, connected %t\n", status.Hub, status.HubConnected)
+	if status.Nat != nil {
+		fmt.Printf("nat:\tlocal %s, mapped %s %s", status.Nat.LocalAddr, status.Nat.PrimaryMappedAddr, status.Nat.SecondaryMappedAddr)
+		if status.Nat.MappingBehavior != "" {
+			fmt.Printf(", mapping %s, filter %s", status.Nat.MappingBehavior, status.Nat.FilterBehavior)
+		}
+		fmt.Println()
+	} else {
+		fmt.Println("nat:\tnot detected yet")
+	}
+	fmt.Printf("peers:\t%d\n", status.Peers)
+}
+
+func Peers(cmd *cobra.Command, args []string) {
+	err := initConfig()
+	if err != nil {
+		panic(err)
+	}
+	peers := &control.NodePeers{}
+	err = control.Get(config.Client().Control, control.NodePeersAPI, peers)
+	if err != nil {
+		logrus.Errorf("query node peers failed, %s", err.Error())
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tIP\tENDPOINT\tTRANSPORT\tRX\tTX\tLAST SEEN")
+	for _, p := range peers.Peers {
+		seen := "-"
+		if !p.LastSeen.IsZero() {
+			seen = time.Since(p.LastSeen).Truncate(time.Second).String() + " ago"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d pkts/%d B\t%d pkts/%d B\t%s\n",
+			p.Name, p.IP, p.Endpoint, p.Transport, p.RxPackets, p.RxBytes, p.TxPackets, p.TxBytes, seen)
+	}
+	w.Flush()
+}
+
+func Keygen(cmd *cobra.Command, args []string) {
+	path := "ptun-node.key"
+	if len(args) > 0 {
+		path = args[0]
+	}
+	key, err := hub.GenerateIdentity(path)
+	if err != nil {
+		logrus.Errorf("generate key failed, %s", err.Error())
+		return
+	}
+	logrus.Infof("key saved to %s, set Key = \"%s\" in node config", path, path)
+	logrus.Infof("public key: %s", hub.EncodePublicKey(key))
+}
+
 func main() {
 	logrus.SetLevel(logrus.DebugLevel)
 	// logrus.SetReportCaller(true)
@@ -2,22 +2,43 @@ package service
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
 	"github.com/withz/ptun/app"
 	"github.com/withz/ptun/app/config"
+	"github.com/withz/ptun/pkg/acl"
+	"github.com/withz/ptun/pkg/bridge"
+	"github.com/withz/ptun/pkg/control"
 	"github.com/withz/ptun/pkg/hub"
 	"github.com/withz/ptun/pkg/nat"
+	"github.com/withz/ptun/pkg/network"
+	"github.com/withz/ptun/pkg/proto"
 )
 
 type Service struct {
 	clientName string
+	// identity is the node identity key, nil when Key is not configured
+	identity ed25519.PrivateKey
 
-	network *app.P2PNetwork
-	ctx     context.Context
-	cancel  context.CancelFunc
+	network  *app.P2PNetwork
+	detector *natDetector
+	control  *control.Server
+	metrics  *control.Server
+	ex       *hub.Exchanger
+	exMutex  sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
 const (
@@ -31,12 +52,25 @@ func NewService() *Service {
 }
 
 func (s *Service) Start(ctx context.Context) (err error) {
+	if config.Client().Key != "" {
+		s.identity, err = hub.LoadIdentity(config.Client().Key)
+		if err != nil {
+			logrus.Errorf("load identity key failed, %s", err.Error())
+			return err
+		}
+	}
 	cfg := config.Client().Net
 	s.network, err = app.CreateNet(&app.P2PNetworkConfig{
-		Tun:       cfg.Tun,
-		IP:        cfg.IP,
-		AllowNets: cfg.AllowNets,
-		Routers:   cfg.Routers,
+		Tun:           cfg.Tun,
+		IP:            cfg.IP,
+		Encrypt:       cfg.Encryption == config.AEADEncryption,
+		Transport:     transportOptions(),
+		AllowNets:     cfg.AllowNets,
+		Routers:       cfg.Routers,
+		Firewall:      config.Client().Firewall.Enable,
+		FirewallRules: config.Client().Firewall.Rules,
+		Underlay:      underlayHosts(),
+		Identity:      s.identity,
 	})
 	if err != nil {
 		return err
@@ -49,48 +83,316 @@ func (s *Service) Run(ctx context.Context) error {
 	s.ctx, s.cancel = context.WithCancel(ctx)
 
 	stun := config.Client().Stun
-	detector := nat.NewDetector(stun.Host, stun.PrimaryPort, stun.SecondaryPort)
+	detector, err := nat.NewDetector(string(stun.Type), stun.Host, stun.PrimaryPort, stun.SecondaryPort)
+	if err != nil {
+		return err
+	}
+	s.detector = &natDetector{Detector: detector}
+
+	s.control = control.NewServer("unix", config.Client().Control)
+	s.control.HandleFunc(control.NodeStatusAPI, s.handleStatus)
+	s.control.HandleFunc(control.NodePeersAPI, s.handlePeers)
+	err = s.control.Start()
+	if err != nil {
+		logrus.Errorf("start control server failed, %s", err.Error())
+	}
+	if config.Client().Metrics != "" {
+		s.metrics = control.NewServer("tcp", config.Client().Metrics)
+		s.metrics.Handle("/metrics", promhttp.Handler())
+		err = s.metrics.Start()
+		if err != nil {
+			logrus.Errorf("start metrics server failed, %s", err.Error())
+		}
+	}
+
+	s.clientName = config.Client().Name
+	hubs, err := s.hubClient(s.identity)
+	if err != nil {
+		logrus.Errorf("load hub config failed, %s", err.Error())
+		return err
+	}
 
 	for {
-		ex, err := hub.NewExchanger(hub.NewTcpHubClient(&hub.TcpHubClientConfig{
-			Host:       config.Client().ServerHost,
-			Port:       config.Client().ServerPort,
-			ClientName: s.clientName,
-			Token:      config.Client().Token,
-		}), detector, config.Client().Net.IP)
+		ex, err := hub.NewExchanger(hubs, s.detector, config.Client().Net.IP, s.network.PreferredTransports(string(config.Client().Net.Transport)), s.network.Encryption())
 		if err != nil {
 			time.Sleep(5 * time.Second)
 			continue
 		}
-		s.clientName = ex.GetName()
+		if ex.GetName() != s.clientName {
+			// keep the name given by hub for later logins
+			s.clientName = ex.GetName()
+			hubs, _ = s.hubClient(s.identity)
+		}
+		s.setExchanger(ex)
+		s.applyIP(ex.GetIP())
+		if ex.Supports(hub.FeatureACL) {
+			// peers are denied until hub pushes the acl
+			s.network.SetACL(&acl.Policy{}, ex.GetName())
+		}
+		if len(s.network.AllowNets()) > 0 {
+			err = ex.AdvertiseRoutes(s.network.AllowNets())
+			if err != nil {
+				logrus.Infof("advertise routes err, %s", err.Error())
+			}
+		}
+		go func() {
+			for {
+				select {
+				case ip := <-ex.IPUpdates():
+					s.applyIP(ip)
+				case r := <-ex.RouteUpdates():
+					err := s.network.UpdatePeerRoutes(r.PeerName, r.Routes)
+					if err != nil {
+						logrus.Errorf("update routes of peer %s err, %s", r.PeerName, err.Error())
+					}
+				case policy := <-ex.ACLUpdates():
+					s.network.SetACL(policy, ex.GetName())
+				case <-ex.Done():
+					return
+				}
+			}
+		}()
+		events := ex.Subscribe()
 		go func() {
 			for m := range ex.Accept() {
 				logrus.Debugf("peer %s, ip = %s come", m.PeerName, m.PeerIP)
-				err := s.network.NewNatPeer(m.PeerName, m.PeerIP, config.Client().Token, m.NatMessage)
+				if m.Err != nil {
+					logrus.Infof("give up connecting peer %s, %s", m.PeerName, m.Err.Error())
+					continue
+				}
+				if m.Relay != nil {
+					go s.relayPeer(m)
+					continue
+				}
+				err := s.network.NewNatPeer(m.PeerName, m.PeerIP, config.Client().Token, m.PeerKey, m.Transport, m.NatMessage)
 				if err != nil {
 					logrus.Infof("new nat peer err, %s", err.Error())
 				}
-			}
-		}()
-		for {
-			peers, err := ex.GetPeers()
-			if err != nil {
-				break
-			}
-			for _, p := range peers {
-				if p == s.clientName || s.network.HasPeer(p) {
-					continue
+				if errors.Is(err, nat.ErrMakeHole) && m.NatMessage.Role == nat.ClientSide {
+					logrus.Infof("fallback to relay for peer %s", m.PeerName)
+					ex.RelayPeer(m.PeerName, ex.GetIP(), m.PeerIP)
 				}
-				ex.PunchPeer(p, config.Client().Net.IP)
 			}
-			time.Sleep(5 * time.Second)
+		}()
+		ex.WatchPeers(s.network, events)
+		ex.Close()
+	}
+}
+
+// transportOptions fills the tuning parameters not given in config with defaults
+func transportOptions() network.TransportOptions {
+	cfg := config.Client().Net
+	opts := network.TransportOptions{
+		Kcp:  network.DefaultKcpOptions,
+		Quic: network.DefaultQuicOptions,
+	}
+	set := func(dst *int, v *int) {
+		if v != nil {
+			*dst = *v
+		}
+	}
+	set(&opts.Kcp.NoDelay, cfg.Kcp.NoDelay)
+	set(&opts.Kcp.Interval, cfg.Kcp.Interval)
+	set(&opts.Kcp.Resend, cfg.Kcp.Resend)
+	set(&opts.Kcp.NoCongestion, cfg.Kcp.NoCongestion)
+	set(&opts.Kcp.SndWnd, cfg.Kcp.SndWnd)
+	set(&opts.Kcp.RcvWnd, cfg.Kcp.RcvWnd)
+	set(&opts.Kcp.Mtu, cfg.Kcp.Mtu)
+	set(&opts.Kcp.DataShards, cfg.Kcp.DataShards)
+	set(&opts.Kcp.ParityShards, cfg.Kcp.ParityShards)
+	if cfg.Quic.IdleTimeout > 0 {
+		opts.Quic.IdleTimeout = time.Duration(cfg.Quic.IdleTimeout) * time.Second
+	}
+	if cfg.Quic.KeepAlivePeriod > 0 {
+		opts.Quic.KeepAlivePeriod = time.Duration(cfg.Quic.KeepAlivePeriod) * time.Second
+	}
+	return opts
+}
+
+// applyIP sets the address leased by hub to network
+func (s *Service) applyIP(ip string) {
+	if ip == "" {
+		return
+	}
+	err := s.network.SetIP(ip)
+	if err != nil {
+		logrus.Errorf("set network ip %s err, %s", ip, err.Error())
+	}
+}
+
+func (s *Service) relayPeer(m *hub.ExchangeInfo) {
+	cfg := &bridge.RelayClientConfig{
+		Host:    m.Relay.Host,
+		Port:    m.Relay.Port,
+		Name:    s.clientName,
+		Session: m.Relay.Session,
+		Ticket:  m.Relay.Ticket,
+		Key:     m.Relay.Key,
+	}
+	if m.Relay.TLS {
+		tlsConfig, err := hub.NewTLSClientConfig(tlsOptions(m.Relay.Host))
+		if err != nil {
+			logrus.Infof("new relay peer err, %s", err.Error())
+			return
+		}
+		cfg.TLS = tlsConfig
+	}
+	err := s.network.NewRelayPeer(m.PeerName, m.PeerIP, m.PeerKey, cfg)
+	if err != nil {
+		logrus.Infof("new relay peer err, %s", err.Error())
+	}
+}
+
+func (s *Service) setExchanger(ex *hub.Exchanger) {
+	s.exMutex.Lock()
+	defer s.exMutex.Unlock()
+	s.ex = ex
+}
+
+func (s *Service) exchanger() *hub.Exchanger {
+	s.exMutex.Lock()
+	defer s.exMutex.Unlock()
+	return s.ex
+}
+
+func (s *Service) handleStatus(r *http.Request) (any, error) {
+	status := &control.NodeStatus{
+		Name:  config.Client().Name,
+		IP:    s.network.IP(),
+		Hub:   net.JoinHostPort(config.Client().ServerHost, fmt.Sprint(config.Client().ServerPort)),
+		Peers: len(s.network.PeerStats()),
+	}
+	if ex := s.exchanger(); ex != nil {
+		status.Name = ex.GetName()
+		select {
+		case <-ex.Done():
+		default:
+			status.HubConnected = true
 		}
 	}
+	// status never waits for stun, the nat is unknown until hub asks the node to detect it
+	status.Nat = s.detector.Last()
+	return status, nil
+}
+
+func (s *Service) handlePeers(r *http.Request) (any, error) {
+	return &control.NodePeers{Peers: s.network.PeerStats()}, nil
+}
+
+// natDetector keeps the last detect result for status report.
+type natDetector struct {
+	nat.Detector
+	last  *nat.DetectResult
+	mutex sync.Mutex
+}
+
+func (d *natDetector) Detect() (*nat.DetectResult, error) {
+	result, err := d.Detector.Detect()
+	if err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.last = result
+	return result, nil
+}
+
+func (d *natDetector) Last() *nat.DetectResult {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.last
 }
 
 func (s *Service) Close() {
 	s.cancel()
+	if s.control != nil {
+		s.control.Close()
+	}
+	if s.metrics != nil {
+		s.metrics.Close()
+	}
 	if s.network != nil {
 		s.network.OnShutdown()
 	}
 }
+
+// underlayHosts gives the hosts of hubs and stun server.
+func underlayHosts() []string {
+	hosts := []string{config.Client().ServerHost, config.Client().Stun.Host}
+	for _, addr := range config.Client().Hubs {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// hubClient logins ServerHost, or the other hubs in order when it fails.
+func (s *Service) hubClient(key ed25519.PrivateKey) (hub.HubClient, error) {
+	addrs := []string{net.JoinHostPort(config.Client().ServerHost, strconv.Itoa(config.Client().ServerPort))}
+	addrs = append(addrs, config.Client().Hubs...)
+	clients := make([]hub.HubClient, 0, len(addrs))
+	for _, addr := range addrs {
+		host, port, _ := net.SplitHostPort(addr)
+		p, _ := strconv.Atoi(port)
+		tlsConfig, err := hubTLS(host)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, newHubClient(&hub.TcpHubClientConfig{
+			Host:       host,
+			Port:       p,
+			ClientName: s.clientName,
+			Token:      config.Client().Token,
+			Network:    config.Client().Network,
+			Key:        key,
+			IP:         config.Client().Net.IP,
+			Codecs:     hubCodecs(),
+			TLS:        tlsConfig,
+		}))
+	}
+	return hub.NewFailoverHubClient(clients...), nil
+}
+
+// newHubClient logins hub over websocket when enabled, or over tcp.
+func newHubClient(cfg *hub.TcpHubClientConfig) hub.HubClient {
+	ws := config.Client().WebSocket
+	if !ws.Enable {
+		return hub.NewTcpHubClient(cfg)
+	}
+	return hub.NewWsHubClient(&hub.WsHubClientConfig{
+		TcpHubClientConfig: *cfg,
+		Path:               ws.Path,
+		Proxy:              ws.Proxy,
+	})
+}
+
+// hubTLS gives the tls config of login to hub at host, nil when tls is not enabled.
+func hubTLS(host string) (*tls.Config, error) {
+	if !config.Client().TLS.Enable {
+		return nil, nil
+	}
+	return hub.NewTLSClientConfig(tlsOptions(host))
+}
+
+// tlsOptions verifies the hub or relay at host with the TLS settings.
+func tlsOptions(host string) *hub.TLSClientOptions {
+	cfg := config.Client().TLS
+	serverName := cfg.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	return &hub.TLSClientOptions{
+		ServerName: serverName,
+		CA:         cfg.CA,
+		Pins:       cfg.Pins,
+	}
+}
+
+// hubCodecs offers the configured codec first, and json for hubs which do not know it.
+func hubCodecs() []string {
+	if config.Client().Codec == "" {
+		return nil
+	}
+	return []string{string(config.Client().Codec), proto.CodecJSON}
+}
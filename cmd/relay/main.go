@@ -1,11 +1,89 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"encoding/json"
 
-var list []*string
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/withz/ptun/app/config"
+	"github.com/withz/ptun/cmd/relay/service"
+	"github.com/withz/ptun/pkg/tools"
+)
+
+var (
+	ConfigFile string
+
+	rootCmd = &cobra.Command{
+		Use:   "",
+		Short: "Ptun",
+		Run:   Run,
+	}
+
+	runCmd = &cobra.Command{
+		Use:   "run",
+		Short: "Ptun",
+		Run:   Run,
+	}
+
+	confCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Config",
+		Run:   Config,
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(runCmd, confCmd)
+	rootCmd.PersistentFlags().StringVarP(&ConfigFile, "config", "c", "", "config file")
+}
+
+func Run(cmd *cobra.Command, args []string) {
+	var err error
+	if ConfigFile == "" {
+		err = config.InitRelay()
+	} else {
+		err = config.InitRelayPath(ConfigFile)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	s := service.NewService()
+
+	logrus.Info("relay starting")
+	err = s.Start(context.Background())
+	if err != nil {
+		logrus.Errorf("relay start failed, %s", err.Error())
+		return
+	}
+	logrus.Info("relay started")
+
+	tools.QuitSignalWait()
+
+	logrus.Info("relay shutdowning")
+	s.Close()
+	logrus.Info("relay stopped")
+}
+
+func Config(cmd *cobra.Command, args []string) {
+	var err error
+	if ConfigFile == "" {
+		err = config.InitRelay()
+	} else {
+		err = config.InitRelayPath(ConfigFile)
+	}
+	if err != nil {
+		panic(err)
+	}
+	p, _ := json.Marshal(config.Relay())
+	logrus.Infof(string(p))
+}
 
 func main() {
-	for _, item := range list {
-		fmt.Print(item)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	if err := rootCmd.Execute(); err != nil {
+		logrus.Error(err.Error())
 	}
 }
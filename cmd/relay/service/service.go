@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+
+	"github.com/withz/ptun/app/config"
+	"github.com/withz/ptun/pkg/bridge"
+	"github.com/withz/ptun/pkg/hub"
+)
+
+type Service struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewService() *Service {
+	return &Service{}
+}
+
+func (s *Service) Start(ctx context.Context) error {
+	go s.Run(ctx)
+	return nil
+}
+
+func (s *Service) Run(ctx context.Context) error {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+
+	cfg := &bridge.RelayServerConfig{
+		Port:   config.Relay().ServerPort,
+		Secret: config.Relay().Token,
+	}
+	if c := config.Relay().TLS; c.Cert != "" {
+		tlsConfig, err := hub.NewTLSServerConfig(c.Cert, c.Key)
+		if err != nil {
+			return err
+		}
+		cfg.TLS = tlsConfig
+	}
+	r := bridge.NewRelayServer(cfg)
+	err := r.Start()
+	if err != nil {
+		return err
+	}
+
+	<-s.ctx.Done()
+	r.Close()
+	return nil
+}
+
+func (s *Service) Close() {
+	s.cancel()
+}
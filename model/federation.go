@@ -0,0 +1,60 @@
+package model
+
+import "net"
+
+// HubHelloRequest opens a link between federated hubs, it is sent by the dialing hub.
+type HubHelloRequest struct {
+	Hub     string
+	Token   string
+	Version int
+	// Pools are the address pools of hub keyed by network id, federated hubs need disjoint pools
+	Pools map[string]string `json:"Pools,omitempty"`
+}
+
+type HubHelloResponse struct {
+	Hub   string
+	Pools map[string]string `json:"Pools,omitempty"`
+}
+
+// NodePresence is a node online on a federated hub.
+type NodePresence struct {
+	Name    string
+	Network string       `json:"Network,omitempty"`
+	IP      string       `json:"IP,omitempty"`
+	Routes  []*net.IPNet `json:"Routes,omitempty"`
+	// PublicKey is the identity key of node verified by its hub
+	PublicKey string `json:"PublicKey,omitempty"`
+}
+
+// PresenceUpdate is pushed by hub to federated hubs when its nodes change. Full replaces all
+// the nodes of hub, it is sent once a link is made.
+//
+//ptun:message
+type PresenceUpdate struct {
+	Hub    string
+	Full   bool           `json:"Full,omitempty"`
+	Joined []NodePresence `json:"Joined,omitempty"`
+	// Left only has the names and networks of nodes
+	Left []NodePresence `json:"Left,omitempty"`
+}
+
+// RemoteDetectNatRequest asks a federated hub to detect the nat of its node.
+type RemoteDetectNatRequest struct {
+	Peer    string
+	Network string `json:"Network,omitempty"`
+}
+
+type RemoteDetectNatResponse struct {
+	Info *DetectNatResponse `json:"Info,omitempty"`
+}
+
+// RemotePushRequest asks a federated hub to push the punch or relay plan to its node.
+type RemotePushRequest struct {
+	Peer    string
+	Network string         `json:"Network,omitempty"`
+	Punch   *PunchResponse `json:"Punch,omitempty"`
+	Relay   *RelayResponse `json:"Relay,omitempty"`
+}
+
+type RemotePushResponse struct {
+}
@@ -8,6 +8,34 @@ import (
 	"github.com/withz/ptun/pkg/proto"
 )
 
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[HubHelloRequest]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[HubHelloResponse]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[PresenceUpdate]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[RemoteDetectNatRequest]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[RemoteDetectNatResponse]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[RemotePushRequest]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[RemotePushResponse]())
+}
+
 func init() {
 	proto.RegisterMessage(reflect.TypeFor[LoginRequest]())
 }
@@ -17,15 +45,19 @@ func init() {
 }
 
 func init() {
-	proto.RegisterMessage(reflect.TypeFor[PeerListRequest]())
+	proto.RegisterMessage(reflect.TypeFor[LoginProofRequest]())
 }
 
 func init() {
-	proto.RegisterMessage(reflect.TypeFor[PeerListResponse]())
+	proto.RegisterMessage(reflect.TypeFor[LoginProofResponse]())
 }
 
 func init() {
-	proto.RegisterMessage(reflect.TypeFor[PeerNatInfo]())
+	proto.RegisterMessage(reflect.TypeFor[PeerListRequest]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[PeerListResponse]())
 }
 
 func init() {
@@ -52,6 +84,22 @@ func init() {
 	proto.RegisterMessage(reflect.TypeFor[PunchResponse]())
 }
 
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[RelayRequest]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[RelayResponse]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[RelayBindRequest]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[RelayBindResponse]())
+}
+
 func init() {
 	proto.RegisterMessage(reflect.TypeFor[UpdateIP]())
 }
@@ -59,3 +107,11 @@ func init() {
 func init() {
 	proto.RegisterMessage(reflect.TypeFor[UpdateRoute]())
 }
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[PeerEvent]())
+}
+
+func init() {
+	proto.RegisterMessage(reflect.TypeFor[UpdateACL]())
+}
@@ -5,11 +5,37 @@ import "github.com/withz/ptun/pkg/nat"
 type LoginRequest struct {
 	Name  string
 	Token string
+	// Network is the id of virtual network on hub, the default network when empty
+	Network   string `json:"Network,omitempty"`
+	PublicKey string `json:"PublicKey,omitempty"`
+	// IP is the address node wants, hub with ipam may give another one
+	IP string `json:"IP,omitempty"`
+	// Version, Codecs and Features are absent from nodes older than negotiation,
+	// Codecs are in preference order
+	Version  int      `json:"Version,omitempty"`
+	Codecs   []string `json:"Codecs,omitempty"`
+	Features []string `json:"Features,omitempty"`
 }
 
 type LoginResponse struct {
 	Name         string
 	ConnectionId string
+	IP           string `json:"IP,omitempty"`
+	// Codec is used by messages after this one, Features are the ones both sides support
+	Version  int      `json:"Version,omitempty"`
+	Codec    string   `json:"Codec,omitempty"`
+	Features []string `json:"Features,omitempty"`
+	// Challenge is set alone when hub verifies node identity, node signs it by LoginProofRequest
+	// and gets the other fields by LoginProofResponse
+	Challenge string `json:"Challenge,omitempty"`
+}
+
+type LoginProofRequest struct {
+	Signature string
+}
+
+type LoginProofResponse struct {
+	LoginResponse
 }
 
 type PeerListRequest struct {
@@ -38,14 +64,19 @@ type DetectNatRequest struct {
 }
 
 type DetectNatResponse struct {
-	Ip    string
-	Local PeerNatInfo
+	Ip         string
+	Local      PeerNatInfo
+	Transports []string `json:"Transports,omitempty"`
+	// Encryption is the one this node requires on peer conns, empty for nodes which do not tell it
+	Encryption string `json:"Encryption,omitempty"`
 }
 
 type PunchRequest struct {
-	Local    PeerNatInfo
-	LocalIp  string
-	PeerName string
+	Local      PeerNatInfo
+	LocalIp    string
+	PeerName   string
+	Transports []string `json:"Transports,omitempty"`
+	Encryption string   `json:"Encryption,omitempty"`
 }
 
 type PunchResponse struct {
@@ -54,4 +85,46 @@ type PunchResponse struct {
 	LocalNat       nat.AnalyzeResult
 	RemoteNat      nat.AnalyzeResult
 	RemotePeerName string
+	Transport      string
+	// Encryption is agreed by hub for both sides, empty when neither tells it
+	Encryption string `json:"Encryption,omitempty"`
+	// RemoteKey is the identity key of remote peer verified by hub, it authenticates the secure
+	// conn with peer, empty when hub does not verify node identities
+	RemoteKey string `json:"RemoteKey,omitempty"`
+}
+
+type RelayRequest struct {
+	LocalIp    string
+	RemoteIp   string
+	PeerName   string
+	Encryption string `json:"Encryption,omitempty"`
+}
+
+type RelayResponse struct {
+	LocalIp   string
+	RemoteIp  string
+	RelayHost string
+	RelayPort int
+	// RelayTLS tells the relay serves binds over tls
+	RelayTLS       bool `json:"RelayTLS,omitempty"`
+	Session        string
+	RemotePeerName string
+	// Ticket lets this node bind Session on relay, it is issued to each side by hub
+	Ticket string
+	// Key protects the relayed conn end to end, both sides get the same one
+	Key string
+	// Encryption is the one of the node which asked for relay, the other side refuses a different one
+	Encryption string `json:"Encryption,omitempty"`
+	// RemoteKey is like the one of PunchResponse
+	RemoteKey string `json:"RemoteKey,omitempty"`
+}
+
+type RelayBindRequest struct {
+	Name    string
+	Ticket  string
+	Session string
+}
+
+type RelayBindResponse struct {
+	RemotePeerName string
 }
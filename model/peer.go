@@ -2,10 +2,35 @@ package model
 
 import "net"
 
+//ptun:message
 type UpdateIP struct {
 	IPs []*net.IPNet
 }
 
+// UpdateRoute advertises the networks reachable through a node, it is sent by node
+// without PeerName and pushed by hub with the name of advertising node.
+//
+//ptun:message
 type UpdateRoute struct {
-	Routes []*net.IPNet
+	PeerName string `json:"PeerName,omitempty"`
+	Routes   []*net.IPNet
+}
+
+// PeerEvent is pushed by hub when a peer joins, leaves or changes its address.
+//
+//ptun:message
+type PeerEvent struct {
+	Event    string
+	PeerName string
+	PeerIP   string `json:"PeerIP,omitempty"`
+}
+
+// UpdateACL is pushed by hub at login, nodes allow all peers when it is not Enabled. Tags map
+// a tag to the names of its nodes, Rules are like `tag:dev -> tag:db:5432/tcp`.
+//
+//ptun:message
+type UpdateACL struct {
+	Enabled bool
+	Tags    map[string][]string `json:"Tags,omitempty"`
+	Rules   []string            `json:"Rules,omitempty"`
 }
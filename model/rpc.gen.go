@@ -0,0 +1,746 @@
+// Code generated .* DO NOT EDIT
+
+package model
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/withz/ptun/pkg/proto"
+)
+
+// Client calls the rpc of remote through transport.
+type Client struct {
+	t *proto.Transport
+}
+
+func NewClient(t *proto.Transport) *Client {
+	return &Client{t: t}
+}
+
+// HubHello calls the HubHelloRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) HubHello(ctx context.Context, req *HubHelloRequest) (*HubHelloResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[HubHelloResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandleHubHello registers h for the HubHelloRequest of remote, the result of h replies the request.
+func HandleHubHello(t *proto.Transport, h func(req *HubHelloRequest) (*HubHelloResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("HubHelloRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[HubHelloRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &HubHelloResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &HubHelloResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakeHubHello sends the HubHelloRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakeHubHello(req *HubHelloRequest, d time.Duration) (*HubHelloResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[HubHelloResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptHubHello reads the HubHelloRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptHubHello(t *proto.Transport, d time.Duration) (*proto.Request, *HubHelloRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[HubHelloRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &HubHelloResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
+
+// RemoteDetectNat calls the RemoteDetectNatRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) RemoteDetectNat(ctx context.Context, req *RemoteDetectNatRequest) (*RemoteDetectNatResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[RemoteDetectNatResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandleRemoteDetectNat registers h for the RemoteDetectNatRequest of remote, the result of h replies the request.
+func HandleRemoteDetectNat(t *proto.Transport, h func(req *RemoteDetectNatRequest) (*RemoteDetectNatResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("RemoteDetectNatRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[RemoteDetectNatRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &RemoteDetectNatResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &RemoteDetectNatResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakeRemoteDetectNat sends the RemoteDetectNatRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakeRemoteDetectNat(req *RemoteDetectNatRequest, d time.Duration) (*RemoteDetectNatResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[RemoteDetectNatResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptRemoteDetectNat reads the RemoteDetectNatRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptRemoteDetectNat(t *proto.Transport, d time.Duration) (*proto.Request, *RemoteDetectNatRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[RemoteDetectNatRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &RemoteDetectNatResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
+
+// RemotePush calls the RemotePushRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) RemotePush(ctx context.Context, req *RemotePushRequest) (*RemotePushResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[RemotePushResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandleRemotePush registers h for the RemotePushRequest of remote, the result of h replies the request.
+func HandleRemotePush(t *proto.Transport, h func(req *RemotePushRequest) (*RemotePushResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("RemotePushRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[RemotePushRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &RemotePushResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &RemotePushResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakeRemotePush sends the RemotePushRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakeRemotePush(req *RemotePushRequest, d time.Duration) (*RemotePushResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[RemotePushResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptRemotePush reads the RemotePushRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptRemotePush(t *proto.Transport, d time.Duration) (*proto.Request, *RemotePushRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[RemotePushRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &RemotePushResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
+
+// Login calls the LoginRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) Login(ctx context.Context, req *LoginRequest) (*LoginResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[LoginResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandleLogin registers h for the LoginRequest of remote, the result of h replies the request.
+func HandleLogin(t *proto.Transport, h func(req *LoginRequest) (*LoginResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("LoginRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[LoginRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &LoginResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &LoginResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakeLogin sends the LoginRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakeLogin(req *LoginRequest, d time.Duration) (*LoginResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[LoginResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptLogin reads the LoginRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptLogin(t *proto.Transport, d time.Duration) (*proto.Request, *LoginRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[LoginRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &LoginResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
+
+// LoginProof calls the LoginProofRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) LoginProof(ctx context.Context, req *LoginProofRequest) (*LoginProofResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[LoginProofResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandleLoginProof registers h for the LoginProofRequest of remote, the result of h replies the request.
+func HandleLoginProof(t *proto.Transport, h func(req *LoginProofRequest) (*LoginProofResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("LoginProofRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[LoginProofRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &LoginProofResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &LoginProofResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakeLoginProof sends the LoginProofRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakeLoginProof(req *LoginProofRequest, d time.Duration) (*LoginProofResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[LoginProofResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptLoginProof reads the LoginProofRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptLoginProof(t *proto.Transport, d time.Duration) (*proto.Request, *LoginProofRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[LoginProofRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &LoginProofResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
+
+// PeerList calls the PeerListRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) PeerList(ctx context.Context, req *PeerListRequest) (*PeerListResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[PeerListResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandlePeerList registers h for the PeerListRequest of remote, the result of h replies the request.
+func HandlePeerList(t *proto.Transport, h func(req *PeerListRequest) (*PeerListResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("PeerListRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[PeerListRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &PeerListResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &PeerListResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakePeerList sends the PeerListRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakePeerList(req *PeerListRequest, d time.Duration) (*PeerListResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[PeerListResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptPeerList reads the PeerListRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptPeerList(t *proto.Transport, d time.Duration) (*proto.Request, *PeerListRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[PeerListRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &PeerListResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
+
+// ExchangeNat calls the ExchangeNatRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) ExchangeNat(ctx context.Context, req *ExchangeNatRequest) (*ExchangeNatResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[ExchangeNatResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandleExchangeNat registers h for the ExchangeNatRequest of remote, the result of h replies the request.
+func HandleExchangeNat(t *proto.Transport, h func(req *ExchangeNatRequest) (*ExchangeNatResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("ExchangeNatRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[ExchangeNatRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &ExchangeNatResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &ExchangeNatResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakeExchangeNat sends the ExchangeNatRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakeExchangeNat(req *ExchangeNatRequest, d time.Duration) (*ExchangeNatResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[ExchangeNatResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptExchangeNat reads the ExchangeNatRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptExchangeNat(t *proto.Transport, d time.Duration) (*proto.Request, *ExchangeNatRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[ExchangeNatRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &ExchangeNatResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
+
+// DetectNat calls the DetectNatRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) DetectNat(ctx context.Context, req *DetectNatRequest) (*DetectNatResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[DetectNatResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandleDetectNat registers h for the DetectNatRequest of remote, the result of h replies the request.
+func HandleDetectNat(t *proto.Transport, h func(req *DetectNatRequest) (*DetectNatResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("DetectNatRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[DetectNatRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &DetectNatResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &DetectNatResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakeDetectNat sends the DetectNatRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakeDetectNat(req *DetectNatRequest, d time.Duration) (*DetectNatResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[DetectNatResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptDetectNat reads the DetectNatRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptDetectNat(t *proto.Transport, d time.Duration) (*proto.Request, *DetectNatRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[DetectNatRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &DetectNatResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
+
+// Punch calls the PunchRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) Punch(ctx context.Context, req *PunchRequest) (*PunchResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[PunchResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandlePunch registers h for the PunchRequest of remote, the result of h replies the request.
+func HandlePunch(t *proto.Transport, h func(req *PunchRequest) (*PunchResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("PunchRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[PunchRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &PunchResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &PunchResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakePunch sends the PunchRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakePunch(req *PunchRequest, d time.Duration) (*PunchResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[PunchResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptPunch reads the PunchRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptPunch(t *proto.Transport, d time.Duration) (*proto.Request, *PunchRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[PunchRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &PunchResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
+
+// Relay calls the RelayRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) Relay(ctx context.Context, req *RelayRequest) (*RelayResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[RelayResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandleRelay registers h for the RelayRequest of remote, the result of h replies the request.
+func HandleRelay(t *proto.Transport, h func(req *RelayRequest) (*RelayResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("RelayRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[RelayRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &RelayResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &RelayResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakeRelay sends the RelayRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakeRelay(req *RelayRequest, d time.Duration) (*RelayResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[RelayResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptRelay reads the RelayRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptRelay(t *proto.Transport, d time.Duration) (*proto.Request, *RelayRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[RelayRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &RelayResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
+
+// RelayBind calls the RelayBindRequest of remote. A reply with error code gives both the response and the error.
+func (c *Client) RelayBind(ctx context.Context, req *RelayBindRequest) (*RelayBindResponse, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[RelayBindResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// HandleRelayBind registers h for the RelayBindRequest of remote, the result of h replies the request.
+func HandleRelayBind(t *proto.Transport, h func(req *RelayBindRequest) (*RelayBindResponse, error)) {
+	t.Requester.Dispatcher().AddHandler("RelayBindRequest", func(r *proto.Request) {
+		req, err := proto.GetPayload[RelayBindRequest](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &RelayBindResponse{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &RelayBindResponse{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// HandshakeRelayBind sends the RelayBindRequest and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) HandshakeRelayBind(req *RelayBindRequest, d time.Duration) (*RelayBindResponse, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[RelayBindResponse](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// AcceptRelayBind reads the RelayBindRequest of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func AcceptRelayBind(t *proto.Transport, d time.Duration) (*proto.Request, *RelayBindRequest, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[RelayBindRequest](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &RelayBindResponse{})
+		return nil, nil, err
+	}
+	return r, req, nil
+}
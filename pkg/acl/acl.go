@@ -0,0 +1,227 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Any matches all nodes, ports or protocols
+const Any = "*"
+
+const (
+	tagPrefix = "tag:"
+	arrow     = "->"
+)
+
+// Protocols which rules can name, icmp matches icmpv6 as well
+const (
+	TCP  = "tcp"
+	UDP  = "udp"
+	ICMP = "icmp"
+)
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+var (
+	errInvalidRule  = errors.New("invalid acl rule")
+	errInvalidPort  = errors.New("invalid acl port")
+	errInvalidProto = errors.New("invalid acl protocol")
+)
+
+// PortRange is the ports from From to To, both included.
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+// Rule lets the nodes matched by Src send to the nodes matched by Dst. A selector is a node
+// name, tag:<name> or *. Ports and Proto limit the traffic, empty means any.
+type Rule struct {
+	Src   string
+	Dst   string
+	Ports []PortRange
+	Proto string
+}
+
+// ParseRule parses a rule like `tag:dev -> tag:db:5432/tcp`. The destination takes optional
+// ports like :80,443,8000-8080 and a protocol like /udp.
+func ParseRule(s string) (*Rule, error) {
+	src, dst, ok := strings.Cut(s, arrow)
+	if !ok {
+		return nil, fmt.Errorf("%w, %s", errInvalidRule, s)
+	}
+	r := &Rule{
+		Src: strings.TrimSpace(src),
+		Dst: strings.TrimSpace(dst),
+	}
+	if dst, proto, ok := strings.Cut(r.Dst, "/"); ok {
+		r.Dst, r.Proto = dst, strings.ToLower(proto)
+		if !slices.Contains([]string{TCP, UDP, ICMP, Any}, r.Proto) {
+			return nil, fmt.Errorf("%w, %s", errInvalidProto, s)
+		}
+		if r.Proto == Any {
+			r.Proto = ""
+		}
+	}
+	// the colon of tag: is part of the selector
+	offset := 0
+	if strings.HasPrefix(r.Dst, tagPrefix) {
+		offset = len(tagPrefix)
+	}
+	if i := strings.Index(r.Dst[offset:], ":"); i >= 0 {
+		ports := r.Dst[offset+i+1:]
+		r.Dst = r.Dst[:offset+i]
+		if ports != Any {
+			for _, p := range strings.Split(ports, ",") {
+				pr, err := parsePortRange(p)
+				if err != nil {
+					return nil, fmt.Errorf("%w, %s", err, s)
+				}
+				r.Ports = append(r.Ports, pr)
+			}
+		}
+	}
+	if r.Src == "" || r.Dst == "" || r.Src == tagPrefix || r.Dst == tagPrefix {
+		return nil, fmt.Errorf("%w, %s", errInvalidRule, s)
+	}
+	if len(r.Ports) > 0 && r.Proto == ICMP {
+		return nil, fmt.Errorf("%w, icmp has no ports, %s", errInvalidRule, s)
+	}
+	return r, nil
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	from, to, ranged := strings.Cut(strings.TrimSpace(s), "-")
+	f, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return PortRange{}, errInvalidPort
+	}
+	t := f
+	if ranged {
+		t, err = strconv.ParseUint(to, 10, 16)
+		if err != nil || t < f {
+			return PortRange{}, errInvalidPort
+		}
+	}
+	return PortRange{From: uint16(f), To: uint16(t)}, nil
+}
+
+func (r *Rule) String() string {
+	var b strings.Builder
+	b.WriteString(r.Src)
+	b.WriteString(" " + arrow + " ")
+	b.WriteString(r.Dst)
+	if len(r.Ports) > 0 {
+		ports := make([]string, 0, len(r.Ports))
+		for _, p := range r.Ports {
+			if p.From == p.To {
+				ports = append(ports, strconv.Itoa(int(p.From)))
+			} else {
+				ports = append(ports, fmt.Sprintf("%d-%d", p.From, p.To))
+			}
+		}
+		b.WriteString(":" + strings.Join(ports, ","))
+	}
+	if r.Proto != "" {
+		b.WriteString("/" + r.Proto)
+	}
+	return b.String()
+}
+
+// allows tells if the rule lets the protocol and port through, port is zero for protocols without ports.
+func (r *Rule) allows(proto int, port uint16) bool {
+	switch r.Proto {
+	case TCP:
+		if proto != protoTCP {
+			return false
+		}
+	case UDP:
+		if proto != protoUDP {
+			return false
+		}
+	case ICMP:
+		return proto == protoICMP || proto == protoICMPv6
+	}
+	if len(r.Ports) == 0 {
+		return true
+	}
+	if proto != protoTCP && proto != protoUDP {
+		return false
+	}
+	return slices.ContainsFunc(r.Ports, func(p PortRange) bool {
+		return port >= p.From && port <= p.To
+	})
+}
+
+// Policy is the acl of a network. Nodes are denied unless a rule allows them.
+type Policy struct {
+	// Tags maps a tag to the names of its nodes
+	Tags  map[string][]string
+	Rules []*Rule
+}
+
+// NewPolicy parses the rules, tags map a tag to the names of its nodes.
+func NewPolicy(tags map[string][]string, rules []string) (*Policy, error) {
+	p := &Policy{
+		Tags:  tags,
+		Rules: make([]*Rule, 0, len(rules)),
+	}
+	if p.Tags == nil {
+		p.Tags = make(map[string][]string)
+	}
+	for _, s := range rules {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		p.Rules = append(p.Rules, r)
+	}
+	return p, nil
+}
+
+// RuleStrings gives the rules in the form ParseRule reads.
+func (p *Policy) RuleStrings() []string {
+	rules := make([]string, 0, len(p.Rules))
+	for _, r := range p.Rules {
+		rules = append(rules, r.String())
+	}
+	return rules
+}
+
+func (p *Policy) match(selector string, node string) bool {
+	if selector == Any {
+		return true
+	}
+	if tag, ok := strings.CutPrefix(selector, tagPrefix); ok {
+		return slices.Contains(p.Tags[tag], node)
+	}
+	return selector == node
+}
+
+// Connected tells if either node may send to the other, hub only coordinates punches of connected nodes.
+func (p *Policy) Connected(a string, b string) bool {
+	for _, r := range p.Rules {
+		if (p.match(r.Src, a) && p.match(r.Dst, b)) || (p.match(r.Src, b) && p.match(r.Dst, a)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow tells if node src may send to node dst by the protocol and port.
+func (p *Policy) Allow(src string, dst string, proto int, port uint16) bool {
+	for _, r := range p.Rules {
+		if p.match(r.Src, src) && p.match(r.Dst, dst) && r.allows(proto, port) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package acl
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	cases := []struct {
+		rule   string
+		expect string
+	}{
+		{"tag:dev -> tag:db:5432/tcp", "tag:dev -> tag:db:5432/tcp"},
+		{"node1->node2", "node1 -> node2"},
+		{"* -> tag:web:80,443,8000-8080", "* -> tag:web:80,443,8000-8080"},
+		{"tag:ops -> *:*/*", "tag:ops -> *"},
+		{"tag:ops -> tag:dev/ICMP", "tag:ops -> tag:dev/icmp"},
+	}
+	for _, c := range cases {
+		r, err := ParseRule(c.rule)
+		if err != nil {
+			t.Errorf("parse %s err, %s", c.rule, err.Error())
+			continue
+		}
+		if r.String() != c.expect {
+			t.Errorf("expect %s, get %s", c.expect, r.String())
+		}
+	}
+	for _, rule := range []string{"tag:dev", "-> node2", "node1 -> tag:", "node1 -> node2:80/sctp", "node1 -> node2:90-80", "node1 -> node2:22/icmp"} {
+		if _, err := ParseRule(rule); err == nil {
+			t.Errorf("expect %s invalid", rule)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p, err := NewPolicy(map[string][]string{
+		"dev": {"dev1", "dev2"},
+		"db":  {"db1"},
+	}, []string{"tag:dev -> tag:db:5432/tcp", "* -> db1/icmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Connected("dev1", "db1") || !p.Connected("db1", "dev2") || p.Connected("dev1", "dev2") {
+		t.Errorf("unexpected connections")
+	}
+	if !p.Allow("dev1", "db1", protoTCP, 5432) || p.Allow("dev1", "db1", protoTCP, 22) || p.Allow("dev1", "db1", protoUDP, 5432) {
+		t.Errorf("unexpected access of dev1 to db1")
+	}
+	if p.Allow("db1", "dev1", protoTCP, 5432) {
+		t.Errorf("expect db1 denied to dev1")
+	}
+	if !p.Allow("other", "db1", protoICMP, 0) || !p.Allow("other", "db1", protoICMPv6, 0) {
+		t.Errorf("expect ping to db1 allowed")
+	}
+}
+
+func ipv4Packet(proto byte, src string, dst string, payload []byte) []byte {
+	p := make([]byte, 20+len(payload))
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[9] = proto
+	copy(p[12:], net.ParseIP(src).To4())
+	copy(p[16:], net.ParseIP(dst).To4())
+	copy(p[20:], payload)
+	return p
+}
+
+func tcpSegment(src uint16, dst uint16) []byte {
+	p := make([]byte, 20)
+	binary.BigEndian.PutUint16(p[0:], src)
+	binary.BigEndian.PutUint16(p[2:], dst)
+	return p
+}
+
+func TestFilter(t *testing.T) {
+	p, err := NewPolicy(map[string][]string{"dev": {"dev1"}}, []string{"tag:dev -> db1:5432/tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewFilter(p, "db1")
+	dev := NewFilter(p, "dev1")
+
+	request := ipv4Packet(protoTCP, "10.8.0.1", "10.8.0.2", tcpSegment(40000, 5432))
+	if !db.AllowPacket("dev1", request) {
+		t.Errorf("expect request of dev1 allowed")
+	}
+	if db.AllowPacket("dev1", ipv4Packet(protoTCP, "10.8.0.1", "10.8.0.2", tcpSegment(40000, 22))) {
+		t.Errorf("expect ssh of dev1 denied")
+	}
+	if db.AllowPacket("web1", request) {
+		t.Errorf("expect request of web1 denied")
+	}
+	// replies are let through by the connections which bridge tracks
+	if dev.AllowPacket("db1", ipv4Packet(protoTCP, "10.8.0.2", "10.8.0.1", tcpSegment(5432, 40000))) {
+		t.Errorf("expect connection from source port 5432 of db1 denied")
+	}
+	if dev.AllowPacket("db1", ipv4Packet(protoTCP, "10.8.0.2", "10.8.0.1", tcpSegment(40000, 22))) {
+		t.Errorf("expect connection from db1 denied")
+	}
+	// a later fragment whose payload looks like the allowed port
+	fragment := ipv4Packet(protoTCP, "10.8.0.1", "10.8.0.2", tcpSegment(40000, 5432))
+	binary.BigEndian.PutUint16(fragment[6:], 185)
+	if db.AllowPacket("dev1", fragment) {
+		t.Errorf("expect later fragment denied")
+	}
+	if db.AllowPacket("dev1", request[:10]) {
+		t.Errorf("expect truncated packet denied")
+	}
+}
@@ -0,0 +1,44 @@
+package acl
+
+import (
+	"encoding/binary"
+
+	"github.com/withz/ptun/pkg/network"
+)
+
+// Filter checks the packets which peers send to this node by policy. It is stateless, bridge
+// tracks the connections of this node to let their replies through.
+type Filter struct {
+	policy *Policy
+	self   string
+}
+
+// NewFilter gives the filter of node self.
+func NewFilter(policy *Policy, self string) *Filter {
+	return &Filter{
+		policy: policy,
+		self:   self,
+	}
+}
+
+// AllowPacket tells if the ip packet from peer may be delivered. Fragments after the first one
+// have no ports, they are denied here and bridge lets them follow the first fragment.
+func (f *Filter) AllowPacket(peer string, packet []byte) bool {
+	if _, offset, _ := network.PacketFragment(packet); offset > 0 {
+		return false
+	}
+	proto, payload := network.PacketGetPayload(packet)
+	if payload == nil {
+		return false
+	}
+	_, dstPort := packetPorts(proto, payload)
+	return f.policy.Allow(peer, f.self, proto, dstPort)
+}
+
+// packetPorts gives the ports of tcp and udp, they are zero for other protocols.
+func packetPorts(proto int, payload []byte) (src uint16, dst uint16) {
+	if (proto != protoTCP && proto != protoUDP) || len(payload) < 4 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4])
+}
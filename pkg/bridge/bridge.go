@@ -5,9 +5,12 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/pkg/firewall"
+	"github.com/withz/ptun/pkg/metrics"
 	"github.com/withz/ptun/pkg/network"
 )
 
@@ -15,15 +18,32 @@ type Veth interface {
 	io.ReadWriter
 }
 
+// PacketFilter decides whether a packet which peer sends is written to veth.
+type PacketFilter interface {
+	AllowPacket(peer string, packet []byte) bool
+}
+
+type filterBox struct {
+	PacketFilter
+}
+
 type Bridge struct {
-	peers sync.Map
-	veth  Veth
-	pool  *sync.Pool
+	peers  sync.Map
+	routes *RouteTable
+	veth   Veth
+	pool   *sync.Pool
+	// filter is the acl pushed by hub, firewall is of node config
+	filter   atomic.Pointer[filterBox]
+	firewall atomic.Pointer[filterBox]
+	// conns lets the replies of connections which this node opens through filters
+	conns *firewall.Conntrack
 }
 
 func NewBridge(veth Veth) *Bridge {
 	bdg := &Bridge{
-		veth: veth,
+		veth:   veth,
+		routes: NewRouteTable(),
+		conns:  firewall.NewConntrack(firewall.DefaultMaxConns),
 		pool: &sync.Pool{
 			New: func() any {
 				p := make([]byte, 8192)
@@ -40,14 +60,110 @@ func (b *Bridge) ConnectPeer(p *Peer) error {
 	if ok {
 		b.DisconnectPeer(old)
 	}
+	p.bindMetrics()
 	err := b.addPeer(p)
+	for _, ip := range p.ips {
+		b.routes.Add(hostNet(ip.IP), p.name)
+	}
+	for _, r := range p.getRoutes() {
+		b.routes.Add(r, p.name)
+	}
 	go b.handlePeer(p)
 	return err
 }
 
+// DisconnectPeer closes peer, routes of peer are removed unless it has been replaced.
 func (b *Bridge) DisconnectPeer(p *Peer) {
 	p.Close()
-	b.delPeer(p.name)
+	if b.peers.CompareAndDelete(p.name, p) {
+		b.routes.RemovePeer(p.name)
+		metrics.DeletePeer(p.name)
+	}
+}
+
+// SetFilter filters the packets from peers by acl, nil lets all of them through.
+func (b *Bridge) SetFilter(f PacketFilter) {
+	storeFilter(&b.filter, f)
+}
+
+// SetFirewall filters the packets from peers by firewall rules, nil lets all of them through.
+func (b *Bridge) SetFirewall(f PacketFilter) {
+	storeFilter(&b.firewall, f)
+}
+
+func storeFilter(p *atomic.Pointer[filterBox], f PacketFilter) {
+	if f == nil {
+		p.Store(nil)
+		return
+	}
+	p.Store(&filterBox{f})
+}
+
+// filtering tells if any filter is set, connections are only tracked then.
+func (b *Bridge) filtering() bool {
+	return b.filter.Load() != nil || b.firewall.Load() != nil
+}
+
+// allow tells if the packet from peer is written to veth, reason is the drop label when it is not.
+// Replies of tracked connections pass, other packets need both filters to allow them. Fragments
+// after the first one have no ports, they follow the first fragment of their packet.
+func (b *Bridge) allow(peer string, packet []byte) (reason string, ok bool) {
+	acl, fw := b.filter.Load(), b.firewall.Load()
+	if acl == nil && fw == nil {
+		return "", true
+	}
+	if following, pass := b.conns.FollowFragment(peer, packet); following {
+		if !pass {
+			return metrics.DropFragment, false
+		}
+		return "", true
+	}
+	if !b.conns.Reply(peer, packet) {
+		if acl != nil && !acl.AllowPacket(peer, packet) {
+			return metrics.DropFiltered, false
+		}
+		if fw != nil && !fw.AllowPacket(peer, packet) {
+			return metrics.DropFirewall, false
+		}
+	}
+	b.conns.PassFragments(peer, packet)
+	return "", true
+}
+
+// SetPeerRoutes replaces the networks reachable through peer.
+func (b *Bridge) SetPeerRoutes(name string, routes []*net.IPNet) {
+	p, ok := b.getPeer(name)
+	if !ok {
+		return
+	}
+	for _, r := range p.getRoutes() {
+		b.routes.Remove(r, name)
+	}
+	p.SetRoutes(routes)
+	for _, r := range routes {
+		b.routes.Add(r, name)
+	}
+}
+
+// AddRoute routes the network to peer, the longest prefix wins when networks overlap.
+func (b *Bridge) AddRoute(n *net.IPNet, name string) {
+	b.routes.Add(n, name)
+}
+
+func (b *Bridge) RemoveRoute(n *net.IPNet, name string) {
+	b.routes.Remove(n, name)
+}
+
+// Close stops tracking connections, peers are disconnected by their owner.
+func (b *Bridge) Close() {
+	b.conns.Close()
+}
+
+func (b *Bridge) RemovePeer(name string) {
+	p, ok := b.getPeer(name)
+	if ok {
+		b.DisconnectPeer(p)
+	}
 }
 
 func (b *Bridge) handlePeer(p *Peer) {
@@ -61,12 +177,21 @@ func (b *Bridge) handlePeer(p *Peer) {
 			return
 		}
 
+		p.countRx(n)
+		if reason, ok := b.allow(p.name, (*v)[:n]); !ok {
+			metrics.DroppedPackets.WithLabelValues(reason).Inc()
+			b.pool.Put(v)
+			continue
+		}
 		_, s, d := network.ParsePacket(*v)
 		src := net.IP(s)
 		dst := net.IP(d)
 		logrus.Tracef("Peer: %s -> %s", src.String(), dst.String())
 
-		b.veth.Write((*v)[:n])
+		_, err = b.veth.Write((*v)[:n])
+		if err != nil {
+			metrics.DroppedPackets.WithLabelValues(metrics.DropWriteError).Inc()
+		}
 		b.pool.Put(v)
 	}
 }
@@ -89,26 +214,41 @@ func (b *Bridge) handleVeth() {
 			if network.IsBroadcast(dst) {
 				b.peers.Range(func(key, value any) bool {
 					p := value.(*Peer)
-					p.Write(data)
+					b.writePeer(p, data)
 					logrus.Tracef("Veth: %s -> %s", src.String(), dst.String())
 					return true
 				})
+			} else if peer, ok := b.lookup(dst); ok {
+				b.writePeer(peer, data)
+				logrus.Tracef("Veth: %s -> %s", src.String(), dst.String())
 			} else {
-				b.peers.Range(func(key, value any) bool {
-					p := value.(*Peer)
-					if p.HasIP(dst.String()) {
-						p.Write(data)
-						logrus.Tracef("Veth: %s -> %s", src.String(), dst.String())
-						return true
-					}
-					return true
-				})
+				metrics.DroppedPackets.WithLabelValues(metrics.DropNoRoute).Inc()
 			}
 			b.pool.Put(p)
 		}
 	}()
 }
 
+func (b *Bridge) lookup(dst net.IP) (*Peer, bool) {
+	name, ok := b.routes.Lookup(dst)
+	if !ok {
+		return nil, false
+	}
+	return b.getPeer(name)
+}
+
+func (b *Bridge) writePeer(p *Peer, data []byte) {
+	if b.filtering() {
+		b.conns.Track(p.name, data)
+	}
+	_, err := p.Write(data)
+	if err != nil {
+		metrics.DroppedPackets.WithLabelValues(metrics.DropWriteError).Inc()
+		return
+	}
+	p.countTx(len(data))
+}
+
 func (b *Bridge) Peers() []*Peer {
 	peers := []*Peer{}
 	b.peers.Range(func(key, value any) bool {
@@ -118,6 +258,10 @@ func (b *Bridge) Peers() []*Peer {
 	return peers
 }
 
+func (b *Bridge) GetPeer(name string) (*Peer, bool) {
+	return b.getPeer(name)
+}
+
 func (b *Bridge) HasPeer(name string) bool {
 	_, ok := b.getPeer(name)
 	return ok
@@ -139,12 +283,3 @@ func (b *Bridge) addPeer(p *Peer) error {
 	b.peers.Store(p.name, p)
 	return nil
 }
-
-func (b *Bridge) delPeer(name string) (*Peer, error) {
-	p, ok := b.getPeer(name)
-	if !ok {
-		return nil, fmt.Errorf("peer not exist")
-	}
-	b.peers.Delete(name)
-	return p, nil
-}
@@ -0,0 +1,72 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/withz/ptun/pkg/acl"
+	"github.com/withz/ptun/pkg/firewall"
+	"github.com/withz/ptun/pkg/metrics"
+)
+
+func tcpPacket(src string, dst string, srcPort uint16, dstPort uint16) []byte {
+	p := make([]byte, 40)
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[9] = 6
+	copy(p[12:], net.ParseIP(src).To4())
+	copy(p[16:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(p[20:], srcPort)
+	binary.BigEndian.PutUint16(p[22:], dstPort)
+	return p
+}
+
+func TestBridgeFilter(t *testing.T) {
+	b := &Bridge{conns: firewall.NewConntrack(firewall.DefaultMaxConns)}
+	defer b.Close()
+	policy, err := acl.NewPolicy(map[string][]string{"dev": {"dev1"}}, []string{"tag:dev -> db1:5432/tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetFilter(acl.NewFilter(policy, "dev1"))
+
+	reply := tcpPacket("10.8.0.2", "10.8.0.1", 5432, 40000)
+	if reason, ok := b.allow("db1", reply); ok || reason != metrics.DropFiltered {
+		t.Errorf("expect packet from source port 5432 of db1 filtered")
+	}
+	b.conns.Track("db1", tcpPacket("10.8.0.1", "10.8.0.2", 40000, 5432))
+	if _, ok := b.allow("db1", reply); !ok {
+		t.Errorf("expect reply of tracked connection allowed")
+	}
+
+	fw, err := firewall.New([]string{"db1:22/tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetFilter(nil)
+	b.SetFirewall(fw)
+	if reason, ok := b.allow("db1", tcpPacket("10.8.0.2", "10.8.0.1", 40001, 80)); ok || reason != metrics.DropFirewall {
+		t.Errorf("expect http of db1 denied by firewall")
+	}
+	if _, ok := b.allow("db1", tcpPacket("10.8.0.2", "10.8.0.1", 40001, 22)); !ok {
+		t.Errorf("expect ssh of db1 allowed by firewall")
+	}
+
+	// fragments of a long reply follow the first one
+	first := tcpPacket("10.8.0.2", "10.8.0.1", 5432, 40000)
+	binary.BigEndian.PutUint16(first[4:], 42)
+	binary.BigEndian.PutUint16(first[6:], 0x2000)
+	last := tcpPacket("10.8.0.2", "10.8.0.1", 0, 0)
+	binary.BigEndian.PutUint16(last[4:], 42)
+	binary.BigEndian.PutUint16(last[6:], 185)
+	if reason, ok := b.allow("db1", last); ok || reason != metrics.DropFragment {
+		t.Errorf("expect fragment without first one dropped")
+	}
+	if _, ok := b.allow("db1", first); !ok {
+		t.Errorf("expect first fragment of reply allowed")
+	}
+	if _, ok := b.allow("db1", last); !ok {
+		t.Errorf("expect last fragment of reply allowed")
+	}
+}
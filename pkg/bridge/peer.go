@@ -2,7 +2,12 @@ package bridge
 
 import (
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/withz/ptun/pkg/metrics"
 	"github.com/withz/ptun/pkg/proto"
 )
 
@@ -11,6 +16,36 @@ type Peer struct {
 	name   string
 	ips    []*net.IPNet
 	routes []*net.IPNet
+	mutex  sync.RWMutex
+
+	// via is the transport type of peer connection, like udp, kcp, quic or relay
+	via       string
+	rxPackets atomic.Uint64
+	rxBytes   atomic.Uint64
+	txPackets atomic.Uint64
+	txBytes   atomic.Uint64
+	lastSeen  atomic.Int64
+	metrics   peerMetrics
+}
+
+type peerMetrics struct {
+	rxPackets prometheus.Counter
+	rxBytes   prometheus.Counter
+	txPackets prometheus.Counter
+	txBytes   prometheus.Counter
+}
+
+// PeerStats is the traffic counters of peer, rx is from peer and tx is to peer.
+type PeerStats struct {
+	Name      string
+	IP        string
+	Endpoint  string
+	Transport string
+	RxPackets uint64
+	RxBytes   uint64
+	TxPackets uint64
+	TxBytes   uint64
+	LastSeen  time.Time
 }
 
 func NewPeer(name string, ips []*net.IPNet, routes []*net.IPNet, conn *proto.Transport) *Peer {
@@ -29,6 +64,8 @@ func (p *Peer) HasIP(ip string) bool {
 			return true
 		}
 	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
 	for _, route := range p.routes {
 		if route.Contains(dst) {
 			return true
@@ -36,3 +73,84 @@ func (p *Peer) HasIP(ip string) bool {
 	}
 	return false
 }
+
+func (p *Peer) Name() string {
+	return p.name
+}
+
+// IP gives the tun address of peer.
+func (p *Peer) IP() net.IP {
+	if len(p.ips) == 0 {
+		return nil
+	}
+	return p.ips[0].IP
+}
+
+// SetRoutes replaces the networks reachable through peer, use Bridge.SetPeerRoutes
+// for a connected peer so the routing table is updated too.
+func (p *Peer) SetRoutes(routes []*net.IPNet) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.routes = routes
+}
+
+// SetVia records the transport type of peer connection, it is only used for stats.
+func (p *Peer) SetVia(via string) {
+	p.via = via
+}
+
+func (p *Peer) Stats() *PeerStats {
+	stats := &PeerStats{
+		Name:      p.name,
+		Transport: p.via,
+		RxPackets: p.rxPackets.Load(),
+		RxBytes:   p.rxBytes.Load(),
+		TxPackets: p.txPackets.Load(),
+		TxBytes:   p.txBytes.Load(),
+	}
+	if ip := p.IP(); ip != nil {
+		stats.IP = ip.String()
+	}
+	if addr := p.RemoteAddr(); addr != nil {
+		stats.Endpoint = addr.String()
+	}
+	if seen := p.lastSeen.Load(); seen != 0 {
+		stats.LastSeen = time.Unix(0, seen)
+	}
+	return stats
+}
+
+// bindMetrics resolves the metrics series of peer, so counting a packet needs no label lookup.
+func (p *Peer) bindMetrics() {
+	p.metrics = peerMetrics{
+		rxPackets: metrics.PeerPackets.WithLabelValues(p.name, metrics.Rx),
+		rxBytes:   metrics.PeerBytes.WithLabelValues(p.name, metrics.Rx),
+		txPackets: metrics.PeerPackets.WithLabelValues(p.name, metrics.Tx),
+		txBytes:   metrics.PeerBytes.WithLabelValues(p.name, metrics.Tx),
+	}
+}
+
+func (p *Peer) countRx(n int) {
+	p.rxPackets.Add(1)
+	p.rxBytes.Add(uint64(n))
+	p.lastSeen.Store(time.Now().UnixNano())
+	if p.metrics.rxPackets != nil {
+		p.metrics.rxPackets.Inc()
+		p.metrics.rxBytes.Add(float64(n))
+	}
+}
+
+func (p *Peer) countTx(n int) {
+	p.txPackets.Add(1)
+	p.txBytes.Add(uint64(n))
+	if p.metrics.txPackets != nil {
+		p.metrics.txPackets.Inc()
+		p.metrics.txBytes.Add(float64(n))
+	}
+}
+
+func (p *Peer) getRoutes() []*net.IPNet {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.routes
+}
@@ -1,13 +1,254 @@
 package bridge
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/model"
 	"github.com/withz/ptun/pkg/proto"
 )
 
+const (
+	RelayBindTimeout  = 30 * time.Second
+	RelayLoginTimeout = 5 * time.Second
+	RelayKeepalive    = 10 * time.Second
+	// relayForwardBufSize holds a raw packet reassembled by transport, such as a secure record
+	relayForwardBufSize = 64 << 10
+)
+
+// Relay pairs two transports of the same session and forwards raw packets between them.
 type Relay struct {
+	session string
+	left    *relayEnd
+	right   *relayEnd
+	done    chan struct{}
+	once    sync.Once
+}
+
+type relayEnd struct {
 	*proto.Transport
-	name   string
-	routes []*net.IPNet
+	name string
+	req  *proto.Request
+}
+
+func (r *Relay) run() {
+	forward := func(from, to *relayEnd) {
+		defer r.Close()
+		buf := make([]byte, relayForwardBufSize)
+		for {
+			n, err := from.Read(buf)
+			if err != nil {
+				logrus.Debugf("relay %s read from %s err, %s", r.session, from.name, err.Error())
+				return
+			}
+			_, err = to.Write(buf[:n])
+			if err != nil {
+				logrus.Debugf("relay %s write to %s err, %s", r.session, to.name, err.Error())
+				return
+			}
+		}
+	}
+	go forward(r.left, r.right)
+	go forward(r.right, r.left)
+}
+
+func (r *Relay) Close() error {
+	r.once.Do(func() {
+		r.left.Close()
+		r.right.Close()
+		close(r.done)
+	})
+	return nil
+}
+
+type RelayServerConfig struct {
+	Port int
+	// Secret verifies the tickets which hub issues to nodes, it is shared with hub only
+	Secret string
+	// TLS serves binds over tls when set, tickets are sent in cleartext without it
+	TLS *tls.Config
+}
+
+type RelayServer struct {
+	cfg      *RelayServerConfig
+	listener net.Listener
+	pending  map[string]*relayEnd
+	relays   map[string]*Relay
+	mutex    sync.Mutex
+}
+
+func NewRelayServer(cfg *RelayServerConfig) *RelayServer {
+	if cfg == nil {
+		panic("config cannot be nil")
+	}
+	return &RelayServer{
+		cfg:     cfg,
+		pending: make(map[string]*relayEnd),
+		relays:  make(map[string]*Relay),
+	}
+}
+
+func (s *RelayServer) Start() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.cfg.Port))
+	if err != nil {
+		return err
+	}
+	if s.cfg.TLS != nil {
+		listener = tls.NewListener(listener, s.cfg.TLS)
+	} else {
+		logrus.Warnf("relay listens on %d without tls, tickets are sent in cleartext", s.cfg.Port)
+	}
+	s.listener = listener
+	go func() {
+		defer func() {
+			logrus.Debugf("relay server accept loop exit")
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleBind(conn)
+		}
+	}()
+	return nil
+}
+
+func (s *RelayServer) Close() error {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, p := range s.pending {
+		p.Close()
+	}
+	for _, r := range s.relays {
+		r.Close()
+	}
+	return nil
+}
+
+func (s *RelayServer) handleBind(conn net.Conn) {
+	t := proto.NewTransport(conn)
+	req, bind, err := model.AcceptRelayBind(t, RelayLoginTimeout)
+	if err != nil {
+		logrus.Infof("wait for relay bind failed, %s", err.Error())
+		t.Close()
+		return
+	}
+	if bind.Session == "" {
+		logrus.Infof("relay bind failed, empty session")
+		t.Close()
+		return
+	}
+	if err = verifyRelayTicket(s.cfg.Secret, bind.Ticket, bind.Session, bind.Name, time.Now()); err != nil {
+		logrus.Infof("relay bind failed, %s %s, %s", bind.Session, bind.Name, err.Error())
+		t.Close()
+		return
+	}
+	end := &relayEnd{
+		Transport: t,
+		name:      bind.Name,
+		req:       req,
+	}
+
+	s.mutex.Lock()
+	other, ok := s.pending[bind.Session]
+	if !ok {
+		s.pending[bind.Session] = end
+		s.mutex.Unlock()
+		logrus.Debugf("relay %s wait for peer of %s", bind.Session, bind.Name)
+		go s.expire(bind.Session, end)
+		return
+	}
+	delete(s.pending, bind.Session)
+	relay := &Relay{
+		session: bind.Session,
+		left:    other,
+		right:   end,
+		done:    make(chan struct{}),
+	}
+	s.relays[bind.Session] = relay
+	s.mutex.Unlock()
+
+	err = other.Responser.ReplySuccess(other.req, &model.RelayBindResponse{RemotePeerName: end.name})
+	if err == nil {
+		err = end.Responser.ReplySuccess(end.req, &model.RelayBindResponse{RemotePeerName: other.name})
+	}
+	if err != nil {
+		logrus.Infof("relay %s bind reply failed, %s", bind.Session, err.Error())
+		relay.Close()
+	}
+	logrus.Infof("relay %s established, %s <-> %s", bind.Session, other.name, end.name)
+	other.SetKeepalive(RelayKeepalive)
+	end.SetKeepalive(RelayKeepalive)
+	relay.run()
+
+	<-relay.done
+	s.mutex.Lock()
+	delete(s.relays, bind.Session)
+	s.mutex.Unlock()
+	logrus.Infof("relay %s closed", bind.Session)
+}
+
+func (s *RelayServer) expire(session string, end *relayEnd) {
+	select {
+	case <-end.Done():
+	case <-time.After(RelayBindTimeout):
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.pending[session] != end {
+		return
+	}
+	delete(s.pending, session)
+	end.Close()
+	logrus.Debugf("relay %s expired, no peer come", session)
+}
+
+type RelayClientConfig struct {
+	Host    string
+	Port    int
+	Name    string
+	Session string
+	// Ticket and Key are given by hub with the session, Key protects the relayed conn end to end
+	Ticket string
+	Key    string
+	// TLS dials relay over tls when set
+	TLS *tls.Config
+}
+
+// DialRelay binds to a relay session and returns the transport once the other side has joined.
+func DialRelay(cfg *RelayClientConfig) (*proto.Transport, error) {
+	addr := net.JoinHostPort(cfg.Host, fmt.Sprint(cfg.Port))
+	var conn net.Conn
+	var err error
+	if cfg.TLS == nil {
+		conn, err = net.Dial("tcp", addr)
+	} else {
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: RelayLoginTimeout},
+			Config:    cfg.TLS,
+		}
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := proto.NewTransport(conn)
+	_, err = model.NewClient(t).HandshakeRelayBind(&model.RelayBindRequest{
+		Name:    cfg.Name,
+		Ticket:  cfg.Ticket,
+		Session: cfg.Session,
+	}, RelayBindTimeout)
+	if err != nil {
+		t.Close()
+		return nil, fmt.Errorf("relay bind failed, %w", err)
+	}
+	return t, nil
 }
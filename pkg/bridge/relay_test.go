@@ -0,0 +1,166 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/withz/ptun/pkg/proto"
+)
+
+func TestRelay(t *testing.T) {
+	s := NewRelayServer(&RelayServerConfig{Port: 21011, Secret: "abab"})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dial := func(name string, ch chan *proto.Transport) {
+		c, err := DialRelay(&RelayClientConfig{
+			Host:    "127.0.0.1",
+			Port:    21011,
+			Name:    name,
+			Session: "session",
+			Ticket:  NewRelayTicket("abab", "session", name, time.Now().Add(RelayTicketTTL)),
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- c
+	}
+	ch1 := make(chan *proto.Transport)
+	ch2 := make(chan *proto.Transport)
+	go dial("node1", ch1)
+	go dial("node2", ch2)
+	c1, c2 := <-ch1, <-ch2
+	if c1 == nil || c2 == nil {
+		return
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	payload := []byte("hello through relay")
+	if _, err := c1.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	done := make(chan int)
+	go func() {
+		n, err := c2.Read(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if !bytes.Equal(buf[:n], payload) {
+			t.Errorf("relay payload mismatch, got %q", buf[:n])
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("relay read timeout")
+	}
+}
+
+func TestRelayInvalidTicket(t *testing.T) {
+	s := NewRelayServer(&RelayServerConfig{Port: 21012, Secret: "abab"})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tickets := []string{
+		NewRelayTicket("wrong", "session", "node1", time.Now().Add(RelayTicketTTL)),
+		NewRelayTicket("abab", "session", "node2", time.Now().Add(RelayTicketTTL)),
+		NewRelayTicket("abab", "other", "node1", time.Now().Add(RelayTicketTTL)),
+		NewRelayTicket("abab", "session", "node1", time.Now().Add(-time.Second)),
+	}
+	for _, ticket := range tickets {
+		_, err := DialRelay(&RelayClientConfig{
+			Host:    "127.0.0.1",
+			Port:    21012,
+			Name:    "node1",
+			Session: "session",
+			Ticket:  ticket,
+		})
+		if err == nil {
+			t.Errorf("relay bind should fail with invalid ticket %s", ticket)
+		}
+	}
+}
+
+func TestRelayTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "relay"},
+		DNSNames:              []string{"relay"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	s := NewRelayServer(&RelayServerConfig{
+		Port:   21059,
+		Secret: "abab",
+		TLS: &tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		},
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	dial := func(name string, cfg *tls.Config) (*proto.Transport, error) {
+		return DialRelay(&RelayClientConfig{
+			Host:    "127.0.0.1",
+			Port:    21059,
+			Name:    name,
+			Session: "session",
+			Ticket:  NewRelayTicket("abab", "session", name, time.Now().Add(RelayTicketTTL)),
+			TLS:     cfg,
+		})
+	}
+	if _, err = dial("node1", nil); err == nil {
+		t.Errorf("relay bind without tls should fail")
+	}
+	ch := make(chan *proto.Transport, 2)
+	for _, name := range []string{"node1", "node2"} {
+		go func() {
+			c, err := dial(name, &tls.Config{ServerName: "relay", RootCAs: roots})
+			if err != nil {
+				t.Error(err)
+			}
+			ch <- c
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if c := <-ch; c != nil {
+			c.Close()
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package bridge
+
+import (
+	"net"
+	"slices"
+	"sync"
+)
+
+// RouteTable maps prefixes to peers with a binary trie, lookup gives the peer of the
+// longest matched prefix. Peers sharing the same prefix are ordered by name and the
+// first one is selected, so overlapping routes always go to one peer.
+type RouteTable struct {
+	v4    *routeNode
+	v6    *routeNode
+	mutex sync.RWMutex
+}
+
+type routeNode struct {
+	children [2]*routeNode
+	// peers are sorted by name
+	peers []string
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{
+		v4: &routeNode{},
+		v6: &routeNode{},
+	}
+}
+
+// Add routes the prefix to peer.
+func (t *RouteTable) Add(n *net.IPNet, peer string) {
+	root, key, ones := t.prefix(n)
+	if root == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	node := root
+	for i := 0; i < ones; i++ {
+		b := bitAt(key, i)
+		if node.children[b] == nil {
+			node.children[b] = &routeNode{}
+		}
+		node = node.children[b]
+	}
+	i, found := slices.BinarySearch(node.peers, peer)
+	if !found {
+		node.peers = slices.Insert(node.peers, i, peer)
+	}
+}
+
+// Remove deletes the route of prefix to peer.
+func (t *RouteTable) Remove(n *net.IPNet, peer string) {
+	root, key, ones := t.prefix(n)
+	if root == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	root.remove(key, 0, ones, peer)
+}
+
+// RemovePeer deletes all the routes to peer.
+func (t *RouteTable) RemovePeer(peer string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.v4.removePeer(peer)
+	t.v6.removePeer(peer)
+}
+
+// Lookup gives the peer of the longest prefix containing ip.
+func (t *RouteTable) Lookup(ip net.IP) (string, bool) {
+	root, key := t.v6, ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		root, key = t.v4, ip4
+	}
+	if key == nil {
+		return "", false
+	}
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	peer, ok := "", false
+	node := root
+	for i := 0; node != nil; i++ {
+		if len(node.peers) > 0 {
+			peer, ok = node.peers[0], true
+		}
+		if i >= len(key)*8 {
+			break
+		}
+		node = node.children[bitAt(key, i)]
+	}
+	return peer, ok
+}
+
+func (t *RouteTable) prefix(n *net.IPNet) (*routeNode, []byte, int) {
+	ones, bits := n.Mask.Size()
+	if bits == 8*net.IPv4len {
+		if ip4 := n.IP.To4(); ip4 != nil {
+			return t.v4, ip4, ones
+		}
+	}
+	if bits == 8*net.IPv6len && n.IP.To4() == nil {
+		return t.v6, n.IP.To16(), ones
+	}
+	return nil, nil, 0
+}
+
+// remove deletes peer from the node of prefix, and gives if this node can be pruned.
+func (n *routeNode) remove(key []byte, depth int, ones int, peer string) bool {
+	if depth == ones {
+		n.peers = slices.DeleteFunc(n.peers, func(p string) bool { return p == peer })
+	} else {
+		b := bitAt(key, depth)
+		child := n.children[b]
+		if child != nil && child.remove(key, depth+1, ones, peer) {
+			n.children[b] = nil
+		}
+	}
+	return n.empty()
+}
+
+func (n *routeNode) removePeer(peer string) bool {
+	n.peers = slices.DeleteFunc(n.peers, func(p string) bool { return p == peer })
+	for b, child := range n.children {
+		if child != nil && child.removePeer(peer) {
+			n.children[b] = nil
+		}
+	}
+	return n.empty()
+}
+
+func (n *routeNode) empty() bool {
+	return len(n.peers) == 0 && n.children[0] == nil && n.children[1] == nil
+}
+
+func bitAt(key []byte, i int) int {
+	return int(key[i/8]>>(7-i%8)) & 1
+}
+
+// hostNet gives the single address network of ip.
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}
+}
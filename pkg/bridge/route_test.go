@@ -0,0 +1,49 @@
+package bridge
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRouteTable(t *testing.T) {
+	parse := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	table := NewRouteTable()
+	table.Add(parse("192.168.0.0/16"), "node1")
+	table.Add(parse("192.168.56.0/24"), "node3")
+	table.Add(parse("192.168.56.0/24"), "node2")
+	table.Add(hostNet(net.ParseIP("192.168.58.12")), "node4")
+	table.Add(parse("fd00::/64"), "node5")
+
+	cases := []struct {
+		ip   string
+		peer string
+	}{
+		{"192.168.1.1", "node1"},
+		{"192.168.56.100", "node2"},
+		{"192.168.58.12", "node4"},
+		{"192.168.58.13", "node1"},
+		{"10.0.0.1", ""},
+		{"fd00::1", "node5"},
+	}
+	for _, c := range cases {
+		peer, _ := table.Lookup(net.ParseIP(c.ip))
+		if peer != c.peer {
+			t.Errorf("lookup %s expect %q, get %q", c.ip, c.peer, peer)
+		}
+	}
+
+	table.Remove(parse("192.168.56.0/24"), "node2")
+	if peer, _ := table.Lookup(net.ParseIP("192.168.56.100")); peer != "node3" {
+		t.Errorf("lookup after remove expect node3, get %q", peer)
+	}
+	table.RemovePeer("node3")
+	if peer, _ := table.Lookup(net.ParseIP("192.168.56.100")); peer != "node1" {
+		t.Errorf("lookup after remove peer expect node1, get %q", peer)
+	}
+}
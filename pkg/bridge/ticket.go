@@ -0,0 +1,53 @@
+package bridge
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RelayTicketTTL is how long a ticket issued by hub can bind its relay session
+const RelayTicketTTL = 2 * RelayBindTimeout
+
+var (
+	errInvalidTicket = errors.New("invalid relay ticket")
+	errTicketExpired = errors.New("relay ticket expired")
+)
+
+// NewRelayTicket lets node name bind the relay session until expire. It is signed by the secret
+// which hub shares with relay, nodes never know the secret.
+func NewRelayTicket(secret string, session string, name string, expire time.Time) string {
+	e := strconv.FormatInt(expire.Unix(), 10)
+	return e + "." + base64.RawURLEncoding.EncodeToString(signTicket(secret, session, name, e))
+}
+
+func signTicket(secret string, session string, name string, expire string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{session, name, expire}, "\x00")))
+	return mac.Sum(nil)
+}
+
+// verifyRelayTicket checks the ticket is issued to name for session and not expired.
+func verifyRelayTicket(secret string, ticket string, session string, name string, now time.Time) error {
+	e, sig, ok := strings.Cut(ticket, ".")
+	if !ok {
+		return errInvalidTicket
+	}
+	expire, err := strconv.ParseInt(e, 10, 64)
+	if err != nil {
+		return errInvalidTicket
+	}
+	p, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(p, signTicket(secret, session, name, e)) {
+		return errInvalidTicket
+	}
+	if now.Unix() > expire {
+		return fmt.Errorf("%w at %s", errTicketExpired, time.Unix(expire, 0).Format(time.RFC3339))
+	}
+	return nil
+}
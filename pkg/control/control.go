@@ -0,0 +1,171 @@
+package control
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const requestTimeout = 5 * time.Second
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errSocketInUse  = errors.New("control socket is in use by another process")
+)
+
+// Server serves JSON apis over http, it listens on a unix socket for local control,
+// or on tcp with a token for remote admin.
+type Server struct {
+	network string
+	addr    string
+	token   string
+	tls     *tls.Config
+	mux     *http.ServeMux
+	server  *http.Server
+}
+
+func NewServer(network string, addr string) *Server {
+	return &Server{
+		network: network,
+		addr:    addr,
+		mux:     http.NewServeMux(),
+	}
+}
+
+// HandleFunc registers an api, the returned value is written as json.
+func (s *Server) HandleFunc(pattern string, f func(r *http.Request) (any, error)) {
+	s.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		v, err := f(r)
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+}
+
+// Handle registers a raw handler, used to wrap apis with middleware.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// UseToken requires requests to carry the token as bearer authorization.
+func (s *Server) UseToken(token string) {
+	s.token = token
+}
+
+// UseTLS serves https with cfg, the token is sent in cleartext without it.
+func (s *Server) UseTLS(cfg *tls.Config) {
+	s.tls = cfg
+}
+
+func (s *Server) Handler() http.Handler {
+	if s.token == "" {
+		return s.mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			WriteError(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		s.mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) Start() error {
+	if s.network == "unix" {
+		// a socket file which nobody listens on is left by last run
+		if conn, err := net.DialTimeout("unix", s.addr, time.Second); err == nil {
+			conn.Close()
+			return fmt.Errorf("%w, %s", errSocketInUse, s.addr)
+		}
+		if err := os.Remove(s.addr); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	listener, err := net.Listen(s.network, s.addr)
+	if err != nil {
+		return err
+	}
+	if s.network == "unix" {
+		os.Chmod(s.addr, 0600)
+	}
+	if s.tls != nil {
+		listener = tls.NewListener(listener, s.tls)
+	} else if s.token != "" {
+		logrus.Warnf("control server listens on %s without tls, the token is sent in cleartext", s.addr)
+	}
+	s.server = &http.Server{Handler: s.Handler()}
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("control server %s exit, %s", s.addr, err.Error())
+		}
+	}()
+	logrus.Infof("control server listen on %s", s.addr)
+	return nil
+}
+
+func (s *Server) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	err := s.server.Close()
+	if s.network == "unix" {
+		os.Remove(s.addr)
+	}
+	return err
+}
+
+type errorResponse struct {
+	Error string
+}
+
+func WriteError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&errorResponse{Error: err.Error()})
+}
+
+// Get requests the api of server listening on unix socket, and decodes the json result into v.
+func Get(socket string, api string, v any) error {
+	c := &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := c.Get("http://unix" + api)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	p, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &errorResponse{}
+		if json.Unmarshal(p, e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("request %s failed, %s", api, resp.Status)
+	}
+	return json.Unmarshal(p, v)
+}
@@ -0,0 +1,58 @@
+package control
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestControl(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ptun.sock")
+	s := NewServer("unix", socket)
+	s.HandleFunc(NodeStatusAPI, func(r *http.Request) (any, error) {
+		return &NodeStatus{Name: "node1", HubConnected: true}, nil
+	})
+	s.HandleFunc(NodePeersAPI, func(r *http.Request) (any, error) {
+		return nil, errors.New("not ready")
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := NewServer("unix", socket).Start(); !errors.Is(err, errSocketInUse) {
+		t.Errorf("expect socket in use, get %v", err)
+	}
+
+	status := &NodeStatus{}
+	if err := Get(socket, NodeStatusAPI, status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Name != "node1" || !status.HubConnected {
+		t.Errorf("unexpected status %+v", status)
+	}
+	err := Get(socket, NodePeersAPI, &NodePeers{})
+	if err == nil || err.Error() != "not ready" {
+		t.Errorf("expect error not ready, get %v", err)
+	}
+}
+
+func TestToken(t *testing.T) {
+	s := NewServer("tcp", "127.0.0.1:0")
+	s.UseToken("abab")
+	s.HandleFunc(NodeStatusAPI, func(r *http.Request) (any, error) {
+		return &NodeStatus{Name: "node1"}, nil
+	})
+	for token, code := range map[string]int{"": http.StatusUnauthorized, "abcd": http.StatusUnauthorized, "abab": http.StatusOK} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, NodeStatusAPI, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		s.Handler().ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("token %q expect %d, get %d", token, code, w.Code)
+		}
+	}
+}
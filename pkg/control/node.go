@@ -0,0 +1,27 @@
+package control
+
+import (
+	"github.com/withz/ptun/pkg/bridge"
+	"github.com/withz/ptun/pkg/nat"
+)
+
+const (
+	NodeStatusAPI = "/status"
+	NodePeersAPI  = "/peers"
+)
+
+// NodeStatus is reported by the status api of node.
+type NodeStatus struct {
+	Name         string
+	IP           string
+	Hub          string
+	HubConnected bool
+	// Nat is the last detect result, empty before the first detect
+	Nat   *nat.DetectResult `json:",omitempty"`
+	Peers int
+}
+
+// NodePeers is reported by the peers api of node.
+type NodePeers struct {
+	Peers []*bridge.PeerStats
+}
@@ -3,6 +3,7 @@ package device
 import (
 	"fmt"
 	"net"
+	"slices"
 	"sync"
 
 	"github.com/sirupsen/logrus"
@@ -95,6 +96,78 @@ func NewTun(name string, addrs []string, routes []string) (*Tun, error) {
 	return t, nil
 }
 
+// UpdateAddrs replaces the addresses of tun device.
+func (t *Tun) UpdateAddrs(addrs []string) error {
+	oldIps, oldNets, err := network.ParseIPNets(t.addrs)
+	if err != nil {
+		return err
+	}
+	ips, ipnets, err := network.ParseIPNets(addrs)
+	if err != nil {
+		return err
+	}
+	for i := range oldIps {
+		oldNets[i].IP = oldIps[i]
+	}
+	for i := range ips {
+		ipnets[i].IP = ips[i]
+	}
+	if len(oldNets) > 0 {
+		err = t.iface.DelAddr(oldNets...)
+		if err != nil {
+			return err
+		}
+	}
+	err = t.iface.AddAddr(ipnets...)
+	if err != nil {
+		return err
+	}
+	t.addrs = addrs
+	return nil
+}
+
+// AddRoutes adds routes through tun device, routes already added are skipped.
+func (t *Tun) AddRoutes(routes []string) error {
+	added := make([]string, 0)
+	for _, r := range routes {
+		if !slices.Contains(t.routes, r) && !slices.Contains(added, r) {
+			added = append(added, r)
+		}
+	}
+	_, routeNets, err := network.ParseIPNets(added)
+	if err != nil {
+		return err
+	}
+	err = t.iface.AddRoute(routeNets...)
+	if err != nil {
+		return err
+	}
+	t.routes = append(t.routes, added...)
+	return nil
+}
+
+// DelRoutes deletes routes through tun device, routes not added are skipped.
+func (t *Tun) DelRoutes(routes []string) error {
+	deleted := make([]string, 0)
+	for _, r := range routes {
+		if slices.Contains(t.routes, r) && !slices.Contains(deleted, r) {
+			deleted = append(deleted, r)
+		}
+	}
+	_, routeNets, err := network.ParseIPNets(deleted)
+	if err != nil {
+		return err
+	}
+	err = t.iface.DelRoute(routeNets...)
+	if err != nil {
+		return err
+	}
+	t.routes = slices.DeleteFunc(t.routes, func(r string) bool {
+		return slices.Contains(deleted, r)
+	})
+	return nil
+}
+
 func (t *Tun) Close() (err error) {
 	t.closeOnce.Do(func() {
 		t.iface.Down()
@@ -0,0 +1,261 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"hash/maphash"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/withz/ptun/pkg/network"
+)
+
+// Timeouts of idle connections, a tcp connection is closing once fin or rst is seen
+const (
+	TCPTimeout        = 3 * time.Hour
+	TCPClosingTimeout = 10 * time.Second
+	UDPTimeout        = 3 * time.Minute
+	ICMPTimeout       = 30 * time.Second
+	// FragmentTimeout is how long the fragments follow the first one of their packet
+	FragmentTimeout = 30 * time.Second
+)
+
+// DefaultMaxConns is the capacity of conntrack, new connections are not tracked when it is full
+const DefaultMaxConns = 65536
+
+const (
+	// sweepInterval is the interval to remove expired connections
+	sweepInterval = 30 * time.Second
+	// conntrackShards splits the connections, so packets of different connections rarely wait for each other
+	conntrackShards = 16
+)
+
+type conn struct {
+	expire  time.Time
+	closing bool
+}
+
+// fragKey is the fragmented packet which the fragments after the first one belong to.
+type fragKey struct {
+	peer string
+	src  netip.Addr
+	dst  netip.Addr
+	id   uint32
+}
+
+type conntrackShard struct {
+	conns map[connKey]*conn
+	// frags are the packets whose first fragment has passed, valued by expire time
+	frags map[fragKey]time.Time
+	mutex sync.Mutex
+}
+
+// Conntrack tracks the tcp, udp and icmp connections which this node opens to peers, so the
+// packets from peers which reply to them are let through by filters.
+type Conntrack struct {
+	shards [conntrackShards]*conntrackShard
+	// shardConns is the capacity of each shard
+	shardConns int
+	seed       maphash.Seed
+	now        func() time.Time
+	done       chan struct{}
+	once       sync.Once
+}
+
+// NewConntrack tracks up to maxConns connections, expired ones are removed in background until Close.
+func NewConntrack(maxConns int) *Conntrack {
+	c := &Conntrack{
+		shardConns: max(maxConns/conntrackShards, 1),
+		seed:       maphash.MakeSeed(),
+		now:        time.Now,
+		done:       make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = &conntrackShard{
+			conns: make(map[connKey]*conn),
+			frags: make(map[fragKey]time.Time),
+		}
+	}
+	go c.sweepLoop()
+	return c
+}
+
+func (c *Conntrack) Close() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// Track records the connection of the packet which is sent to peer.
+func (c *Conntrack) Track(peer string, packet []byte) {
+	fl, ok := parseFlow(packet)
+	if !ok || fl.related != nil || !fl.tracked() {
+		return
+	}
+	fl.key.peer = peer
+	c.refresh(fl.key, fl.tcpFlags, true)
+}
+
+// Reply tells if the packet from peer replies a tracked connection, or is an icmp error about it.
+func (c *Conntrack) Reply(peer string, packet []byte) bool {
+	fl, ok := parseFlow(packet)
+	if !ok {
+		return false
+	}
+	if fl.related != nil {
+		k := *fl.related
+		k.peer = peer
+		return c.refresh(k, 0, false)
+	}
+	return fl.replyable() && c.refresh(fl.key.reply(peer), fl.tcpFlags, false)
+}
+
+// Len gives the number of tracked connections.
+func (c *Conntrack) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		n += len(s.conns)
+		s.mutex.Unlock()
+	}
+	return n
+}
+
+func (c *Conntrack) shard(k connKey) *conntrackShard {
+	var p [6]byte
+	binary.BigEndian.PutUint16(p[0:], uint16(k.proto))
+	binary.BigEndian.PutUint16(p[2:], k.srcPort)
+	binary.BigEndian.PutUint16(p[4:], k.dstPort)
+	return c.shardOf(k.peer, k.src, k.dst, p[:])
+}
+
+func (c *Conntrack) shardOf(peer string, src netip.Addr, dst netip.Addr, p []byte) *conntrackShard {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	h.WriteString(peer)
+	s, d := src.As16(), dst.As16()
+	h.Write(s[:])
+	h.Write(d[:])
+	h.Write(p)
+	return c.shards[h.Sum64()%conntrackShards]
+}
+
+// fragment gives the key of fragmented packet, ok is false for whole packets.
+func fragment(peer string, packet []byte) (k fragKey, first bool, ok bool) {
+	id, offset, more := network.PacketFragment(packet)
+	if offset == 0 && !more {
+		return k, false, false
+	}
+	_, s, d := network.ParsePacket(packet)
+	k.peer = peer
+	k.src, _ = netip.AddrFromSlice(s)
+	k.dst, _ = netip.AddrFromSlice(d)
+	k.id = id
+	return k, offset == 0, true
+}
+
+func (c *Conntrack) fragShard(k fragKey) *conntrackShard {
+	var p [4]byte
+	binary.BigEndian.PutUint32(p[:], k.id)
+	return c.shardOf(k.peer, k.src, k.dst, p[:])
+}
+
+// FollowFragment tells if the packet from peer is a fragment after the first one, which only
+// passes when PassFragments has been called with the first fragment of its packet.
+func (c *Conntrack) FollowFragment(peer string, packet []byte) (following bool, pass bool) {
+	k, first, ok := fragment(peer, packet)
+	if !ok || first {
+		return false, false
+	}
+	s := c.fragShard(k)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	expire, ok := s.frags[k]
+	return true, ok && !c.now().After(expire)
+}
+
+// PassFragments lets the following fragments pass when packet from peer is the first fragment.
+func (c *Conntrack) PassFragments(peer string, packet []byte) {
+	k, first, ok := fragment(peer, packet)
+	if !ok || !first {
+		return
+	}
+	s := c.fragShard(k)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.frags[k]; !ok && len(s.frags) >= c.shardConns {
+		return
+	}
+	s.frags[k] = c.now().Add(FragmentTimeout)
+}
+
+// refresh extends the connection of key, which is created when it is not tracked and create is set.
+// A full shard does not track new connections, their replies are left to filters.
+func (c *Conntrack) refresh(k connKey, tcpFlags byte, create bool) bool {
+	s := c.shard(k)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := c.now()
+	cn, ok := s.conns[k]
+	if ok && now.After(cn.expire) {
+		delete(s.conns, k)
+		ok = false
+	}
+	if !ok {
+		if !create || len(s.conns) >= c.shardConns {
+			return false
+		}
+		cn = &conn{}
+		s.conns[k] = cn
+	}
+	if tcpFlags&(tcpFIN|tcpRST) != 0 {
+		cn.closing = true
+	}
+	cn.expire = now.Add(timeout(k.proto, cn.closing))
+	return true
+}
+
+func (c *Conntrack) sweepLoop() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// sweep removes expired connections, shards are locked one by one so packets only wait for one of them.
+func (c *Conntrack) sweep() {
+	now := c.now()
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		for k, cn := range s.conns {
+			if now.After(cn.expire) {
+				delete(s.conns, k)
+			}
+		}
+		for k, expire := range s.frags {
+			if now.After(expire) {
+				delete(s.frags, k)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+func timeout(proto int, closing bool) time.Duration {
+	switch proto {
+	case protoTCP:
+		if closing {
+			return TCPClosingTimeout
+		}
+		return TCPTimeout
+	case protoICMP, protoICMPv6:
+		return ICMPTimeout
+	}
+	return UDPTimeout
+}
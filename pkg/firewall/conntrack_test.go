@@ -0,0 +1,142 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestConntrack(t *testing.T) {
+	c := NewConntrack(DefaultMaxConns)
+	defer c.Close()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	reply := ipv4Packet(protoUDP, "10.8.0.3", "10.8.0.2", tcpSegment(53, 50000, 0)[:8])
+	if c.Reply("node2", reply) {
+		t.Errorf("expect udp of node2 denied before request")
+	}
+	c.Track("node2", ipv4Packet(protoUDP, "10.8.0.2", "10.8.0.3", tcpSegment(50000, 53, 0)[:8]))
+	if !c.Reply("node2", reply) {
+		t.Errorf("expect udp reply of node2 allowed")
+	}
+	if c.Reply("node1", reply) {
+		t.Errorf("expect udp reply from node1 denied")
+	}
+	now = now.Add(UDPTimeout + time.Second)
+	if c.Reply("node2", reply) {
+		t.Errorf("expect udp reply denied after timeout")
+	}
+	c.Track("node2", ipv4Packet(protoUDP, "10.8.0.2", "10.8.0.3", tcpSegment(50001, 53, 0)[:8]))
+	now = now.Add(UDPTimeout + time.Second)
+	c.sweep()
+	if c.Len() != 0 {
+		t.Errorf("expect expired connections removed, get %d", c.Len())
+	}
+	if c.Reply("node2", reply[:22]) {
+		t.Errorf("expect truncated packet denied")
+	}
+}
+
+func TestConntrackTCP(t *testing.T) {
+	c := NewConntrack(DefaultMaxConns)
+	defer c.Close()
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	c.Track("node2", ipv4Packet(protoTCP, "10.8.0.2", "10.8.0.3", tcpSegment(40000, 443, 0x02)))
+	reply := ipv4Packet(protoTCP, "10.8.0.3", "10.8.0.2", tcpSegment(443, 40000, 0x12))
+	if !c.Reply("node2", reply) {
+		t.Errorf("expect tcp reply allowed")
+	}
+	if c.Reply("node2", ipv4Packet(protoTCP, "10.8.0.3", "10.8.0.2", tcpSegment(443, 40001, 0x12))) {
+		t.Errorf("expect tcp of other port denied")
+	}
+	now = now.Add(UDPTimeout + time.Second)
+	if !c.Reply("node2", reply) {
+		t.Errorf("expect idle tcp kept")
+	}
+	if !c.Reply("node2", ipv4Packet(protoTCP, "10.8.0.3", "10.8.0.2", tcpSegment(443, 40000, 0x11))) {
+		t.Errorf("expect tcp fin allowed")
+	}
+	now = now.Add(TCPClosingTimeout + time.Second)
+	if c.Reply("node2", reply) {
+		t.Errorf("expect closed tcp denied")
+	}
+}
+
+func TestConntrackICMP(t *testing.T) {
+	c := NewConntrack(DefaultMaxConns)
+	defer c.Close()
+	if c.Reply("node2", ipv4Packet(protoICMP, "10.8.0.3", "10.8.0.2", icmpMessage(8, 7, nil))) {
+		t.Errorf("expect ping denied")
+	}
+	c.Track("node2", ipv4Packet(protoICMP, "10.8.0.2", "10.8.0.3", icmpMessage(8, 7, nil)))
+	if !c.Reply("node2", ipv4Packet(protoICMP, "10.8.0.3", "10.8.0.2", icmpMessage(0, 7, nil))) {
+		t.Errorf("expect echo reply allowed")
+	}
+	if c.Reply("node2", ipv4Packet(protoICMP, "10.8.0.3", "10.8.0.2", icmpMessage(0, 8, nil))) {
+		t.Errorf("expect echo reply of other id denied")
+	}
+	if c.Reply("node2", ipv4Packet(protoICMP, "10.8.0.3", "10.8.0.2", icmpMessage(8, 7, nil))) {
+		t.Errorf("expect echo request of tracked id denied")
+	}
+	c.Track("node3", ipv4Packet(protoICMP, "10.8.0.2", "10.8.0.4", icmpMessage(0, 9, nil)))
+	if c.Reply("node3", ipv4Packet(protoICMP, "10.8.0.4", "10.8.0.2", icmpMessage(8, 9, nil))) {
+		t.Errorf("expect echo request after echo reply denied")
+	}
+
+	request := ipv4Packet(protoUDP, "10.8.0.2", "192.168.56.100", tcpSegment(50000, 53, 0)[:8])
+	unreachable := ipv4Packet(protoICMP, "10.8.0.3", "10.8.0.2", icmpMessage(3, 0, request))
+	if c.Reply("node2", unreachable) {
+		t.Errorf("expect unreachable of unknown connection denied")
+	}
+	c.Track("node2", request)
+	if !c.Reply("node2", unreachable) {
+		t.Errorf("expect unreachable of connection allowed")
+	}
+}
+
+func TestConntrackLimit(t *testing.T) {
+	c := NewConntrack(conntrackShards)
+	defer c.Close()
+	for port := uint16(1); port <= 100; port++ {
+		c.Track("node2", ipv4Packet(protoUDP, "10.8.0.2", "10.8.0.3", tcpSegment(port, 53, 0)[:8]))
+	}
+	if c.Len() > conntrackShards {
+		t.Errorf("expect at most %d connections, get %d", conntrackShards, c.Len())
+	}
+}
+
+func TestConntrackFragment(t *testing.T) {
+	c := NewConntrack(DefaultMaxConns)
+	defer c.Close()
+	fragment := func(p []byte, offset int, more bool) []byte {
+		v := uint16(offset / 8)
+		if more {
+			v |= 0x2000
+		}
+		binary.BigEndian.PutUint16(p[4:], 42)
+		binary.BigEndian.PutUint16(p[6:], v)
+		return p
+	}
+	first := fragment(ipv4Packet(protoUDP, "10.8.0.3", "10.8.0.2", tcpSegment(53, 50000, 0)), 0, true)
+	last := fragment(ipv4Packet(protoUDP, "10.8.0.3", "10.8.0.2", tcpSegment(40000, 22, 0)), 1480, false)
+
+	if following, _ := c.FollowFragment("node2", first); following {
+		t.Errorf("expect first fragment not following")
+	}
+	if following, pass := c.FollowFragment("node2", last); !following || pass {
+		t.Errorf("expect last fragment denied before first one")
+	}
+	if c.Reply("node2", last) {
+		t.Errorf("expect ports of last fragment ignored")
+	}
+	c.PassFragments("node2", first)
+	if _, pass := c.FollowFragment("node2", last); !pass {
+		t.Errorf("expect last fragment pass after first one")
+	}
+	if _, pass := c.FollowFragment("node1", last); pass {
+		t.Errorf("expect fragment from other peer denied")
+	}
+}
@@ -0,0 +1,60 @@
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/withz/ptun/pkg/acl"
+)
+
+var errInvalidRule = errors.New("invalid firewall rule")
+
+// ParseRule parses an inbound rule like `node1:22/tcp`, `*:80,443` or `*/icmp`. The peer is a
+// node name or *, the ports and protocol are the same as acl rules.
+func ParseRule(s string) (*acl.Rule, error) {
+	s = strings.TrimSpace(s)
+	peer, rest := s, ""
+	if i := strings.IndexAny(s, ":/"); i >= 0 {
+		peer, rest = s[:i], s[i:]
+	}
+	if peer == "" || strings.Contains(peer, "->") {
+		return nil, fmt.Errorf("%w, %s", errInvalidRule, s)
+	}
+	r, err := acl.ParseRule(peer + " -> " + acl.Any + rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %s", errInvalidRule, err.Error())
+	}
+	return r, nil
+}
+
+// Firewall lets through the packets from peers which the inbound rules allow. It is stateless,
+// bridge tracks the connections of this node to let their replies through.
+type Firewall struct {
+	policy *acl.Policy
+}
+
+// New gives the firewall with inbound rules in the form of ParseRule.
+func New(rules []string) (*Firewall, error) {
+	policy := &acl.Policy{
+		Tags:  make(map[string][]string),
+		Rules: make([]*acl.Rule, 0, len(rules)),
+	}
+	for _, s := range rules {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		policy.Rules = append(policy.Rules, r)
+	}
+	return &Firewall{policy: policy}, nil
+}
+
+// AllowPacket tells if the inbound rules allow the packet from peer.
+func (f *Firewall) AllowPacket(peer string, packet []byte) bool {
+	fl, ok := parseFlow(packet)
+	if !ok {
+		return false
+	}
+	return f.policy.Allow(peer, "", fl.key.proto, fl.port())
+}
@@ -0,0 +1,83 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func ipv4Packet(proto byte, src string, dst string, payload []byte) []byte {
+	p := make([]byte, 20+len(payload))
+	p[0] = 0x45
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[9] = proto
+	copy(p[12:], net.ParseIP(src).To4())
+	copy(p[16:], net.ParseIP(dst).To4())
+	copy(p[20:], payload)
+	return p
+}
+
+func tcpSegment(src uint16, dst uint16, flags byte) []byte {
+	p := make([]byte, 20)
+	binary.BigEndian.PutUint16(p[0:], src)
+	binary.BigEndian.PutUint16(p[2:], dst)
+	p[13] = flags
+	return p
+}
+
+func icmpMessage(typ byte, id uint16, body []byte) []byte {
+	p := make([]byte, 8+len(body))
+	p[0] = typ
+	binary.BigEndian.PutUint16(p[4:], id)
+	copy(p[8:], body)
+	return p
+}
+
+func TestParseRule(t *testing.T) {
+	cases := []struct {
+		rule   string
+		expect string
+	}{
+		{"node1:22/tcp", "node1 -> *:22/tcp"},
+		{"*:80,443", "* -> *:80,443"},
+		{"*/icmp", "* -> */icmp"},
+		{"node2", "node2 -> *"},
+	}
+	for _, c := range cases {
+		r, err := ParseRule(c.rule)
+		if err != nil {
+			t.Errorf("parse %s err, %s", c.rule, err.Error())
+			continue
+		}
+		if r.String() != c.expect {
+			t.Errorf("expect %s, get %s", c.expect, r.String())
+		}
+	}
+	for _, rule := range []string{"", ":22", "node1->node2", "node1:22/icmp", "node1:ssh", "tag:dev:22"} {
+		if _, err := ParseRule(rule); err == nil {
+			t.Errorf("expect %s invalid", rule)
+		}
+	}
+}
+
+func TestFirewall(t *testing.T) {
+	f, err := New([]string{"node1:22/tcp", "*/icmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.AllowPacket("node1", ipv4Packet(protoTCP, "10.8.0.1", "10.8.0.2", tcpSegment(40000, 22, 0x02))) {
+		t.Errorf("expect ssh of node1 allowed")
+	}
+	if f.AllowPacket("node2", ipv4Packet(protoTCP, "10.8.0.3", "10.8.0.2", tcpSegment(40000, 22, 0x02))) {
+		t.Errorf("expect ssh of node2 denied")
+	}
+	if !f.AllowPacket("node2", ipv4Packet(protoICMP, "10.8.0.3", "10.8.0.2", icmpMessage(8, 1, nil))) {
+		t.Errorf("expect ping of node2 allowed")
+	}
+	if f.AllowPacket("node2", ipv4Packet(protoUDP, "10.8.0.3", "10.8.0.2", tcpSegment(53, 50000, 0)[:8])) {
+		t.Errorf("expect udp of node2 denied")
+	}
+	if f.AllowPacket("node1", ipv4Packet(protoTCP, "10.8.0.1", "10.8.0.2", tcpSegment(40000, 22, 0x02))[:22]) {
+		t.Errorf("expect truncated packet denied")
+	}
+}
@@ -0,0 +1,136 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/withz/ptun/pkg/network"
+)
+
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+)
+
+const (
+	tcpFIN = 0x01
+	tcpRST = 0x04
+)
+
+// connKey is a connection in the direction from this node to peer, icmp echo takes the
+// identifier as both ports.
+type connKey struct {
+	peer    string
+	proto   int
+	src     netip.Addr
+	dst     netip.Addr
+	srcPort uint16
+	dstPort uint16
+}
+
+// reply gives the key of the connection which the packet of key from peer replies to.
+func (k connKey) reply(peer string) connKey {
+	return connKey{
+		peer:    peer,
+		proto:   k.proto,
+		src:     k.dst,
+		dst:     k.src,
+		srcPort: k.dstPort,
+		dstPort: k.srcPort,
+	}
+}
+
+type flow struct {
+	key      connKey
+	tcpFlags byte
+	icmpType byte
+	// related is the connection which an icmp error is about
+	related *connKey
+}
+
+// port gives the destination port of tcp and udp, zero for other protocols.
+func (f *flow) port() uint16 {
+	if f.key.proto != protoTCP && f.key.proto != protoUDP {
+		return 0
+	}
+	return f.key.dstPort
+}
+
+// parseFlow gives the flow of ip packet, it fails when the headers are truncated or the packet
+// is a fragment after the first one.
+func parseFlow(packet []byte) (flow, bool) {
+	if _, offset, _ := network.PacketFragment(packet); offset > 0 {
+		return flow{}, false
+	}
+	proto, payload := network.PacketGetPayload(packet)
+	if payload == nil {
+		return flow{}, false
+	}
+	_, s, d := network.ParsePacket(packet)
+	src, _ := netip.AddrFromSlice(s)
+	dst, _ := netip.AddrFromSlice(d)
+	f := flow{key: connKey{proto: proto, src: src, dst: dst}}
+	switch proto {
+	case protoTCP, protoUDP:
+		if len(payload) < 4 {
+			return f, false
+		}
+		f.key.srcPort = binary.BigEndian.Uint16(payload[0:2])
+		f.key.dstPort = binary.BigEndian.Uint16(payload[2:4])
+		if proto == protoTCP && len(payload) > 13 {
+			f.tcpFlags = payload[13]
+		}
+	case protoICMP, protoICMPv6:
+		if len(payload) < 8 {
+			return f, false
+		}
+		f.icmpType = payload[0]
+		if isICMPEcho(proto, payload[0]) {
+			id := binary.BigEndian.Uint16(payload[4:6])
+			f.key.srcPort, f.key.dstPort = id, id
+		} else if isICMPError(proto, payload[0]) {
+			// the error carries the header of packet which caused it
+			inner, ok := parseFlow(payload[8:])
+			if !ok || inner.related != nil {
+				return f, false
+			}
+			f.related = &inner.key
+		}
+	}
+	return f, true
+}
+
+// tracked tells if the flow may open a connection, icmp only opens it by echo request.
+func (f *flow) tracked() bool {
+	if f.key.proto != protoICMP && f.key.proto != protoICMPv6 {
+		return true
+	}
+	return f.icmpType == 8 || f.icmpType == 128
+}
+
+// replyable tells if the flow may reply a connection, icmp only replies it by echo reply.
+func (f *flow) replyable() bool {
+	if f.key.proto != protoICMP && f.key.proto != protoICMPv6 {
+		return true
+	}
+	return f.icmpType == 0 || f.icmpType == 129
+}
+
+func isICMPEcho(proto int, typ byte) bool {
+	if proto == protoICMP {
+		// echo reply, echo request
+		return typ == 0 || typ == 8
+	}
+	return typ == 128 || typ == 129
+}
+
+func isICMPError(proto int, typ byte) bool {
+	if proto == protoICMP {
+		// destination unreachable, source quench, time exceeded, parameter problem
+		return typ == 3 || typ == 4 || typ == 11 || typ == 12
+	}
+	// destination unreachable, packet too big, time exceeded, parameter problem
+	return typ >= 1 && typ <= 4
+}
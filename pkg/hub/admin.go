@@ -0,0 +1,319 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/model"
+	"github.com/withz/ptun/pkg/nat"
+)
+
+const (
+	// PunchHistorySize is the count of recent punches kept by hub
+	PunchHistorySize = 100
+	detectNatTimeout = 3 * time.Second
+	// remoteDetectNatTimeout is for the detection asked by a federated hub, it is shorter than
+	// detectNatTimeout so the answer arrives before that hub gives up
+	remoteDetectNatTimeout = 2 * time.Second
+)
+
+var (
+	errSessionNotFound    = errors.New("session not found")
+	errPunchSelf          = errors.New("cannot punch node to itself")
+	errStateStoreDisabled = errors.New("state store is not enabled")
+)
+
+// SessionInfo describes an online node.
+type SessionInfo struct {
+	Name string
+	// Network is the virtual network of node, empty for the default network
+	Network string `json:",omitempty"`
+	IP      string
+	Addr    string
+	Nat     *nat.DetectResult `json:",omitempty"`
+	Routes  []string          `json:",omitempty"`
+	LoginAt time.Time
+	Version int
+	Codec   string
+	// Hub is the federated hub which node is on, empty for nodes on this hub
+	Hub string `json:",omitempty"`
+}
+
+type PunchResult string
+
+const (
+	// PunchPlanned means hub has sent the punch plan to both nodes, the hole is made by nodes later
+	PunchPlanned PunchResult = "planned"
+	PunchFailed  PunchResult = "failed"
+)
+
+// PunchRecord is the outcome of a punch coordinated by hub.
+type PunchRecord struct {
+	Time      time.Time
+	From      string
+	To        string
+	Network   string    `json:",omitempty"`
+	Class     nat.Class `json:",omitempty"`
+	Transport string    `json:",omitempty"`
+	Result    PunchResult
+	Error     string `json:",omitempty"`
+
+	// remoteIP is the address reported by the remote node, it is empty if the node did not answer
+	remoteIP string
+}
+
+type punchHistory struct {
+	records []*PunchRecord
+	size    int
+	mutex   sync.Mutex
+}
+
+func newPunchHistory(size int) *punchHistory {
+	return &punchHistory{size: size}
+}
+
+func (p *punchHistory) add(r *PunchRecord) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.records = append(p.records, r)
+	if len(p.records) > p.size {
+		p.records = slices.Delete(p.records, 0, len(p.records)-p.size)
+	}
+}
+
+// list gives the records from the latest one.
+func (p *punchHistory) list() []*PunchRecord {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	records := slices.Clone(p.records)
+	slices.Reverse(records)
+	return records
+}
+
+// Sessions gives the online nodes sorted by network and name, including the nodes on federated hubs.
+func (h *Hub) Sessions() []*SessionInfo {
+	infos := make([]*SessionInfo, 0)
+	h.sessions.Range(func(key, value any) bool {
+		s := value.(*session)
+		info := &SessionInfo{
+			Name:    s.name,
+			Network: s.network,
+			IP:      s.leasedIP(),
+			Nat:     s.getNat(),
+			LoginAt: s.loginAt,
+			Version: s.version,
+			Codec:   s.Codec().Name(),
+		}
+		if addr := s.RemoteAddr(); addr != nil {
+			info.Addr = addr.String()
+		}
+		for _, route := range s.getRoutes() {
+			info.Routes = append(info.Routes, route.String())
+		}
+		infos = append(infos, info)
+		return true
+	})
+	if h.federation != nil {
+		for _, n := range h.federation.nodes() {
+			if h.loadSession(n.network, n.name) != nil {
+				continue
+			}
+			info := &SessionInfo{
+				Name:    n.name,
+				Network: n.network,
+				IP:      n.ip,
+				Hub:     n.link.hub,
+			}
+			for _, route := range n.routes {
+				info.Routes = append(info.Routes, route.String())
+			}
+			infos = append(infos, info)
+		}
+	}
+	slices.SortFunc(infos, func(a, b *SessionInfo) int {
+		if c := strings.Compare(a.Network, b.Network); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return infos
+}
+
+// KnownNode is a node which has logged in to hub.
+type KnownNode struct {
+	NodeState
+	Online bool
+}
+
+// KnownNodes gives the nodes in state store sorted by network and name, the nodes online are seen now.
+func (h *Hub) KnownNodes() ([]*KnownNode, error) {
+	if h.store == nil {
+		return nil, errStateStoreDisabled
+	}
+	nodes, err := h.store.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	result := make([]*KnownNode, 0, len(nodes))
+	for _, n := range nodes {
+		known := &KnownNode{NodeState: *n}
+		if h.loadSession(n.Network, n.Name) != nil {
+			known.Online = true
+			known.LastSeen = now
+		}
+		result = append(result, known)
+	}
+	return result, nil
+}
+
+// Kick closes the session of node in network, the node may login again.
+func (h *Hub) Kick(network string, name string) error {
+	node := nodeKey{network: network, name: name}
+	s := h.loadSession(network, name)
+	if s == nil {
+		return fmt.Errorf("%w, %s", errSessionNotFound, node)
+	}
+	if h.removeSession(s) {
+		h.notifyPeers(s, PeerLeft)
+	}
+	logrus.Infof("session %s is kicked", node)
+	return nil
+}
+
+// Punch asks both nodes for their nat and sends them the punch plan, like node from requests punching node to.
+// Both nodes are in network, node from is on this hub, node to may be on a federated hub.
+func (h *Hub) Punch(network string, from string, to string) (*PunchRecord, error) {
+	if from == to {
+		return nil, errPunchSelf
+	}
+	local := h.loadSession(network, from)
+	if local == nil {
+		return nil, fmt.Errorf("%w, %s", ErrPeerNotFound, from)
+	}
+	remote := h.lookupPeer(network, to)
+	if remote == nil {
+		return nil, fmt.Errorf("%w, %s", ErrPeerNotFound, to)
+	}
+	record, _, err := h.punch(local, nil, remote)
+	return record, err
+}
+
+// PunchHistory gives the recent punches from the latest one.
+func (h *Hub) PunchHistory() []*PunchRecord {
+	return h.punches.list()
+}
+
+// punch analyzes the nat of both sessions and pushes the plan to remote, the plan of local is
+// returned for the reply of its request. If localInfo is nil, hub starts the punch, so it detects
+// the nat of local and pushes the plan to local too.
+func (h *Hub) punch(local *session, localInfo *model.DetectNatResponse, remote peer) (record *PunchRecord, plan *model.PunchResponse, err error) {
+	record = &PunchRecord{
+		Time:    time.Now(),
+		From:    local.name,
+		To:      remote.peerName(),
+		Network: local.network,
+		Result:  PunchPlanned,
+	}
+	defer func() {
+		if err != nil {
+			record.Result = PunchFailed
+			record.Error = err.Error()
+		}
+		h.punches.add(record)
+		if h.store != nil {
+			if err := h.store.AddPunch(record); err != nil {
+				logrus.Warnf("save punch %s to %s err, %s", record.From, record.To, err.Error())
+			}
+		}
+	}()
+
+	if !h.connected(local.network, local.name, remote.peerName()) {
+		return record, nil, fmt.Errorf("%w, %s", ErrPeerNotAllowed, remote.peerName())
+	}
+	pushLocal := localInfo == nil
+	if pushLocal {
+		localInfo, err = h.detectNat(local, detectNatTimeout)
+		if err != nil {
+			return record, nil, err
+		}
+	}
+	remoteInfo, err := h.detectNat(remote, detectNatTimeout)
+	if err != nil {
+		return record, nil, err
+	}
+	localIP, err := peerIP(local, localInfo.Ip)
+	if err != nil {
+		return record, nil, err
+	}
+	remoteIP, err := peerIP(remote, remoteInfo.Ip)
+	if err != nil {
+		return record, nil, err
+	}
+	record.remoteIP = remoteIP
+	encryption, err := negotiateEncryption(localInfo.Encryption, remoteInfo.Encryption)
+	if err != nil {
+		return record, nil, err
+	}
+	lr, rr, err := nat.Analyze(&localInfo.Local.Mapping, &remoteInfo.Local.Mapping)
+	if err != nil {
+		return record, nil, fmt.Errorf("%w, %s", ErrNatAnalyzeFailed, err.Error())
+	}
+	transport := negotiateTransport(localInfo.Transports, remoteInfo.Transports)
+	record.Class = lr.Class
+	record.Transport = transport
+	plan = &model.PunchResponse{
+		LocalIp:        localIP,
+		RemoteIp:       remoteIP,
+		LocalNat:       *lr,
+		RemoteNat:      *rr,
+		RemotePeerName: remote.peerName(),
+		Transport:      transport,
+		Encryption:     encryption,
+		RemoteKey:      remote.publicKey(),
+	}
+	if pushLocal {
+		err = local.Responser.SendSuccess(plan)
+		if err != nil {
+			return record, nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), detectNatTimeout)
+	defer cancel()
+	err = remote.push(ctx, &model.PunchResponse{
+		LocalIp:        remoteIP,
+		RemoteIp:       localIP,
+		LocalNat:       *rr,
+		RemoteNat:      *lr,
+		RemotePeerName: local.name,
+		Transport:      transport,
+		Encryption:     encryption,
+		RemoteKey:      local.publicKey(),
+	})
+	if err != nil {
+		return record, nil, err
+	}
+	return record, plan, nil
+}
+
+func (h *Hub) detectNat(p peer, timeout time.Duration) (*model.DetectNatResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	info, err := p.detectNat(ctx)
+	if s, ok := p.(*session); ok && err == nil {
+		h.storeNode(s)
+	}
+	if errors.Is(err, ErrNatDetectFailed) {
+		return nil, fmt.Errorf("peer %s %w", p.peerName(), err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w, %s %s", ErrPeerUnreachable, p.peerName(), err.Error())
+	}
+	return info, nil
+}
@@ -0,0 +1,26 @@
+package hub
+
+import "github.com/withz/ptun/pkg/proto"
+
+// Codes of hub replies, nodes decide how to retry by them.
+const (
+	CodePeerNotFound       = -101
+	CodePeerUnreachable    = -102
+	CodeNatDetectFailed    = -103
+	CodeNatAnalyzeFailed   = -104
+	CodeRelayUnavailable   = -105
+	CodePeerNotAllowed     = -106
+	CodeIPMismatch         = -107
+	CodeEncryptionMismatch = -108
+)
+
+var (
+	ErrPeerNotFound       = proto.NewError(CodePeerNotFound, "peer not found")
+	ErrPeerUnreachable    = proto.NewError(CodePeerUnreachable, "peer unreachable")
+	ErrNatDetectFailed    = proto.NewError(CodeNatDetectFailed, "nat detect failed")
+	ErrNatAnalyzeFailed   = proto.NewError(CodeNatAnalyzeFailed, "nat analyze failed")
+	ErrRelayUnavailable   = proto.NewError(CodeRelayUnavailable, "relay unavailable")
+	ErrPeerNotAllowed     = proto.NewError(CodePeerNotAllowed, "peer not allowed by acl")
+	ErrIPMismatch         = proto.NewError(CodeIPMismatch, "ip does not match the lease")
+	ErrEncryptionMismatch = proto.NewError(CodeEncryptionMismatch, "encryption mismatch")
+)
@@ -1,12 +1,18 @@
 package hub
 
 import (
-	"reflect"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	"github.com/sirupsen/logrus"
 	"github.com/withz/ptun/model"
+	"github.com/withz/ptun/pkg/acl"
 	"github.com/withz/ptun/pkg/nat"
 	"github.com/withz/ptun/pkg/network"
 	"github.com/withz/ptun/pkg/proto"
@@ -16,33 +22,91 @@ const (
 	LoginConnectionTimeout = 10 * time.Second
 	LoginRepeatWaitTime    = 10 * time.Second
 	LoginRepeatCount       = 3
+
+	// PunchRetryInterval and PunchRetryMaxElapsed bound the retries of punches failed for a transient reason
+	PunchRetryInterval   = 5 * time.Second
+	PunchRetryMaxElapsed = 2 * time.Minute
+	// PunchTimeout covers the nat detection of remote by hub before it replies
+	PunchTimeout = 10 * time.Second
 )
 
 type Exchanger struct {
-	session  *session
-	detector *nat.Detector
-	ip       string
-	info     chan *ExchangeInfo
+	session    *session
+	detector   nat.Detector
+	ip         string
+	transports []string
+	encryption string
+	info       chan *ExchangeInfo
+	ipUpdate   chan string
+	ipMutex    sync.Mutex
+	routes     chan *RouteInfo
+	acls       chan *acl.Policy
+
+	subscribers []*subscriber
+	subMutex    sync.Mutex
+
+	// retries are the backoffs of peers whose punch is being retried
+	retries    map[string]backoff.BackOff
+	retryMutex sync.Mutex
 }
 
-func NewExchanger(c HubClient, d *nat.Detector, ip string) (*Exchanger, error) {
+type PeerEventType string
+
+const (
+	PeerJoined         PeerEventType = "joined"
+	PeerLeft           PeerEventType = "left"
+	PeerAddressChanged PeerEventType = "address"
+)
+
+// PeerEvent tells the presence change of a peer, PeerIP is the tun address of peer.
+type PeerEvent struct {
+	Type     PeerEventType
+	PeerName string
+	PeerIP   string
+}
+
+// NewExchanger logins to hub, transports are the peer transports this node accepts in preference order,
+// and encryption is the one it requires on peer conns.
+func NewExchanger(c HubClient, d nat.Detector, ip string, transports []string, encryption string) (*Exchanger, error) {
 	s, err := tryLogin(c)
 	if err != nil {
 		return nil, err
 	}
 	e := &Exchanger{
-		session:  s,
-		detector: d,
-		info:     make(chan *ExchangeInfo),
-		ip:       ip,
+		session:    s,
+		detector:   d,
+		info:       make(chan *ExchangeInfo),
+		ipUpdate:   make(chan string, 1),
+		routes:     make(chan *RouteInfo, 16),
+		acls:       make(chan *acl.Policy, 1),
+		retries:    make(map[string]backoff.BackOff),
+		ip:         ip,
+		transports: transports,
+		encryption: encryption,
+	}
+	if s.ip != "" {
+		e.ip = s.ip
 	}
-	reqDispatcher := s.Requester.Dispatcher()
-	reqDispatcher.AddHandler(reflect.TypeFor[model.DetectNatRequest]().Name(), e.handleDetectNat)
+	if !s.supports(FeatureACL) {
+		logrus.Warnf("hub does not push acl, the acl of last hub is kept, peers are allowed when there is none")
+	}
+	model.HandleDetectNat(s.Transport, e.handleDetectNat)
 	go s.Requester.RunDispatcher()
 
+	// plans of punches started by peers or hub are pushed
 	respDispatcher := s.Responser.Dispatcher()
-	respDispatcher.AddHandler(reflect.TypeFor[model.PunchResponse]().Name(), e.handlePunch)
+	proto.OnResponse(respDispatcher, func(r *proto.Response, resp *model.PunchResponse) {
+		e.handlePunch(resp, r.Err())
+	})
+	proto.OnResponse(respDispatcher, func(r *proto.Response, resp *model.RelayResponse) {
+		e.handleRelay(resp, r.Err())
+	})
+	proto.OnResponse(respDispatcher, e.handleUpdateIP)
+	proto.OnResponse(respDispatcher, e.handlePeerEvent)
+	proto.OnResponse(respDispatcher, e.handleUpdateRoute)
+	proto.OnResponse(respDispatcher, e.handleUpdateACL)
 	go s.Responser.RunDispatcher()
+	go e.closeSubscribers()
 	return e, nil
 }
 
@@ -50,93 +114,415 @@ func (e *Exchanger) Close() error {
 	return e.session.Close()
 }
 
+// Done is closed when the hub session is lost.
+func (e *Exchanger) Done() <-chan struct{} {
+	return e.session.Done()
+}
+
+// Supports tells whether the feature was negotiated with hub at login.
+func (e *Exchanger) Supports(feature string) bool {
+	return e.session.supports(feature)
+}
+
 func (e *Exchanger) GetName() string {
 	return e.session.name
 }
 
+// GetIP gives the address of this node, which is leased by hub if hub manages addresses.
+func (e *Exchanger) GetIP() string {
+	e.ipMutex.Lock()
+	defer e.ipMutex.Unlock()
+	return e.ip
+}
+
+// IPUpdates gives the address pushed by hub after login.
+func (e *Exchanger) IPUpdates() <-chan string {
+	return e.ipUpdate
+}
+
+// AdvertiseRoutes tells hub the networks reachable through this node, hub pushes them to the other nodes.
+func (e *Exchanger) AdvertiseRoutes(routes []*net.IPNet) error {
+	return e.session.Requester.Send(&model.UpdateRoute{
+		Routes: routes,
+	})
+}
+
+// RouteUpdates gives the routes advertised by peers, each one replaces the former routes of the peer.
+// It must be read unless FeatureRoutes is left out at login, otherwise the exchanger stalls.
+func (e *Exchanger) RouteUpdates() <-chan *RouteInfo {
+	return e.routes
+}
+
+// ACLUpdates gives the acl of network pushed by hub at login, nil when the network has no acl.
+// Hubs without FeatureACL never push it, nodes should deny peers until one is given only when Supports(FeatureACL).
+func (e *Exchanger) ACLUpdates() <-chan *acl.Policy {
+	return e.acls
+}
+
 func (e *Exchanger) GetPeers() ([]string, error) {
-	raw, err := e.session.SendMessage(&model.PeerListRequest{}, LoginConnectionTimeout)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := proto.GetResponsePayload[model.PeerListResponse](raw)
+	ctx, cancel := context.WithTimeout(context.Background(), LoginConnectionTimeout)
+	defer cancel()
+	resp, err := e.session.rpc.PeerList(ctx, &model.PeerListRequest{})
 	if err != nil {
 		return nil, err
 	}
 	return resp.PeerNames, nil
 }
 
+// PunchPeer asks hub to plan the punching with peer, the plan or the failure comes from Accept.
 func (e *Exchanger) PunchPeer(name string, localIP string) (err error) {
 	m, err := e.detector.Detect()
 	if err != nil {
 		return err
 	}
-	return e.session.Requester.Send(&model.PunchRequest{
+	req := &model.PunchRequest{
 		PeerName: name,
 		LocalIp:  localIP,
 		Local: model.PeerNatInfo{
 			Name:    e.session.name,
 			Mapping: *m,
 		},
-	})
+		Transports: e.transports,
+		Encryption: e.encryption,
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), PunchTimeout)
+		defer cancel()
+		resp, err := e.session.rpc.Punch(ctx, req)
+		if resp == nil {
+			e.punchFailed(name, "", err)
+			return
+		}
+		e.handlePunch(resp, err)
+	}()
+	return nil
+}
+
+// RelayPeer asks the hub to connect both sides through the relay, used when punching failed.
+func (e *Exchanger) RelayPeer(name string, localIP string, remoteIP string) error {
+	req := &model.RelayRequest{
+		PeerName:   name,
+		LocalIp:    localIP,
+		RemoteIp:   remoteIP,
+		Encryption: e.encryption,
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), LoginConnectionTimeout)
+		defer cancel()
+		resp, err := e.session.rpc.Relay(ctx, req)
+		if resp == nil {
+			resp = &model.RelayResponse{RemotePeerName: name, RemoteIp: remoteIP}
+		}
+		e.handleRelay(resp, err)
+	}()
+	return nil
+}
+
+// Subscribe gives the presence events pushed by hub, the channel is closed when the session is lost.
+func (e *Exchanger) Subscribe() <-chan *PeerEvent {
+	e.subMutex.Lock()
+	defer e.subMutex.Unlock()
+	sub := &subscriber{ch: make(chan *PeerEvent, subscriberBuffer)}
+	select {
+	case <-e.session.Done():
+		sub.close()
+	default:
+		e.subscribers = append(e.subscribers, sub)
+	}
+	return sub.ch
+}
+
+func (e *Exchanger) closeSubscribers() {
+	<-e.session.Done()
+	e.subMutex.Lock()
+	defer e.subMutex.Unlock()
+	for _, sub := range e.subscribers {
+		sub.close()
+	}
+	e.subscribers = nil
 }
 
 func (e *Exchanger) Accept() <-chan *ExchangeInfo {
 	return e.info
 }
 
-func (e *Exchanger) handleDetectNat(r *proto.Request) {
+func (e *Exchanger) handleDetectNat(req *model.DetectNatRequest) (*model.DetectNatResponse, error) {
 	n, err := e.detector.Detect()
 	if err != nil {
-		// todo return fmt.Errorf("detect nat failed, %w", err)
-		logrus.Debug("detect nat failed")
+		logrus.Debugf("detect nat failed, %s", err.Error())
+		return nil, fmt.Errorf("%w, %s", ErrNatDetectFailed, err.Error())
 	}
-	e.session.Responser.ReplySuccess(r, &model.DetectNatResponse{
+	return &model.DetectNatResponse{
 		Local: model.PeerNatInfo{
 			Name:    e.session.name,
 			Mapping: *n,
 		},
-		Ip: e.ip,
-	})
+		Ip:         e.GetIP(),
+		Transports: e.transports,
+		Encryption: e.encryption,
+	}, nil
 }
 
+// ExchangeInfo tells how to connect a peer, Err is set when hub failed to arrange it and
+// the exchanger does not retry any more.
 type ExchangeInfo struct {
 	NatMessage *nat.Nat
+	Relay      *RelayInfo
 	PeerName   string
 	PeerIP     string
+	// PeerKey is the identity key of peer verified by hub, empty when hub does not verify it
+	PeerKey   string
+	Transport string
+	Err       error
+}
+
+type RouteInfo struct {
+	PeerName string
+	Routes   []*net.IPNet
+}
+
+type RelayInfo struct {
+	Host string
+	Port int
+	// TLS tells the relay serves binds over tls
+	TLS     bool
+	Session string
+	Ticket  string
+	Key     string
 }
 
-func (e *Exchanger) handlePunch(r *proto.Response) {
-	resp, err := proto.GetResponsePayload[model.PunchResponse](r)
+// handlePunch handles the punch plan replied or pushed by hub, err is the error code of the reply.
+func (e *Exchanger) handlePunch(resp *model.PunchResponse, err error) {
 	if err != nil {
-		// todo return fmt.Errorf("parse response err, %w", err)
+		e.punchFailed(resp.RemotePeerName, resp.RemoteIp, err)
+		return
+	}
+	e.resetRetry(resp.RemotePeerName)
+	if err := e.checkEncryption(resp.Encryption); err != nil {
+		e.deliver(&ExchangeInfo{PeerName: resp.RemotePeerName, PeerIP: resp.RemoteIp, Err: err})
+		return
 	}
 	localAddrs, err := network.ResolveUDPAddrs(resp.LocalNat.LocalAddrs)
 	if err != nil {
-		logrus.Debugf("get err %s", err.Error())
-		// todo return fmt.Errorf("parse local addrs err, %w", err)
+		logrus.Debugf("parse local addrs of peer %s err, %s", resp.RemotePeerName, err.Error())
+		e.deliver(&ExchangeInfo{PeerName: resp.RemotePeerName, PeerIP: resp.RemoteIp, Err: err})
+		return
 	}
 	remoteAddrs, err := network.ResolveUDPAddrs(resp.LocalNat.RemoteMappedAddrs)
 	if err != nil {
-		// todo return fmt.Errorf("parse remote addrs err, %w", err)
+		logrus.Debugf("parse remote addrs of peer %s err, %s", resp.RemotePeerName, err.Error())
+		e.deliver(&ExchangeInfo{PeerName: resp.RemotePeerName, PeerIP: resp.RemoteIp, Err: err})
+		return
 	}
 	localNat := &nat.Nat{
+		Class:             resp.LocalNat.Class,
 		LocalAddrs:        localAddrs,
 		RemoteMappedAddrs: remoteAddrs,
 		Role:              resp.LocalNat.Role,
 		Resource:          resp.LocalNat.Resource,
 		Actions:           resp.LocalNat.Actions,
 	}
-	select {
-	case e.info <- &ExchangeInfo{
+	e.deliver(&ExchangeInfo{
 		NatMessage: localNat,
 		PeerName:   resp.RemotePeerName,
 		PeerIP:     resp.RemoteIp,
-	}:
+		PeerKey:    resp.RemoteKey,
+		Transport:  resp.Transport,
+	})
+}
+
+// checkEncryption refuses a plan whose encryption differs from the one of this node, so both sides
+// never talk past each other. Hubs which do not negotiate it leave it empty.
+func (e *Exchanger) checkEncryption(encryption string) error {
+	if encryption == "" || e.encryption == "" || encryption == e.encryption {
+		return nil
+	}
+	return fmt.Errorf("%w, peer uses %s but this node %s", ErrEncryptionMismatch, encryption, e.encryption)
+}
+
+// punchFailed handles a punch refused by hub by its reason. Transient failures are retried with
+// backoff, a peer whose nat can not be punched is relayed, the others are given up.
+func (e *Exchanger) punchFailed(name string, remoteIP string, err error) {
+	logrus.Infof("punch peer %s failed, %s", name, err.Error())
+	switch {
+	case errors.Is(err, ErrPeerUnreachable), errors.Is(err, ErrNatDetectFailed), errors.Is(err, proto.ErrTimeout):
+		if d := e.nextRetry(name); d != backoff.Stop {
+			logrus.Debugf("retry punching peer %s after %s", name, d)
+			time.AfterFunc(d, func() {
+				select {
+				case <-e.session.Done():
+				default:
+					e.PunchPeer(name, e.GetIP())
+				}
+			})
+			return
+		}
+	case errors.Is(err, ErrNatAnalyzeFailed) && remoteIP != "":
+		logrus.Infof("fallback to relay for peer %s", name)
+		e.resetRetry(name)
+		e.RelayPeer(name, e.GetIP(), remoteIP)
+		return
+	}
+	e.resetRetry(name)
+	e.deliver(&ExchangeInfo{PeerName: name, PeerIP: remoteIP, Err: err})
+}
+
+func (e *Exchanger) nextRetry(name string) time.Duration {
+	e.retryMutex.Lock()
+	defer e.retryMutex.Unlock()
+	b, ok := e.retries[name]
+	if !ok {
+		eb := backoff.NewExponentialBackOff()
+		eb.InitialInterval = PunchRetryInterval
+		eb.MaxElapsedTime = PunchRetryMaxElapsed
+		eb.Reset()
+		b = eb
+		e.retries[name] = b
+	}
+	d := b.NextBackOff()
+	if d == backoff.Stop {
+		delete(e.retries, name)
+	}
+	return d
+}
+
+func (e *Exchanger) resetRetry(name string) {
+	e.retryMutex.Lock()
+	defer e.retryMutex.Unlock()
+	delete(e.retries, name)
+}
+
+func (e *Exchanger) deliver(info *ExchangeInfo) {
+	select {
+	case e.info <- info:
+	case <-e.session.Done():
+	}
+}
+
+// handleRelay handles the relay session replied or pushed by hub, err is the error code of the reply.
+func (e *Exchanger) handleRelay(resp *model.RelayResponse, err error) {
+	if err != nil {
+		logrus.Infof("relay peer %s failed, %s", resp.RemotePeerName, err.Error())
+		e.deliver(&ExchangeInfo{PeerName: resp.RemotePeerName, PeerIP: resp.RemoteIp, Err: err})
+		return
+	}
+	if err := e.checkEncryption(resp.Encryption); err != nil {
+		logrus.Infof("relay peer %s failed, %s", resp.RemotePeerName, err.Error())
+		e.deliver(&ExchangeInfo{PeerName: resp.RemotePeerName, PeerIP: resp.RemoteIp, Err: err})
+		return
+	}
+	e.deliver(&ExchangeInfo{
+		Relay: &RelayInfo{
+			Host:    resp.RelayHost,
+			Port:    resp.RelayPort,
+			TLS:     resp.RelayTLS,
+			Session: resp.Session,
+			Ticket:  resp.Ticket,
+			Key:     resp.Key,
+		},
+		PeerName: resp.RemotePeerName,
+		PeerIP:   resp.RemoteIp,
+		PeerKey:  resp.RemoteKey,
+	})
+}
+
+func (e *Exchanger) handleUpdateIP(r *proto.Response, resp *model.UpdateIP) {
+	if len(resp.IPs) == 0 {
+		logrus.Debugf("invalid update ip message")
+		return
+	}
+	ones, _ := resp.IPs[0].Mask.Size()
+	ip := fmt.Sprintf("%s/%d", resp.IPs[0].IP.String(), ones)
+	e.ipMutex.Lock()
+	e.ip = ip
+	e.ipMutex.Unlock()
+	logrus.Infof("hub updates ip to %s", ip)
+	select {
+	case e.ipUpdate <- ip:
+	case <-e.session.Done():
+	}
+}
+
+func (e *Exchanger) handleUpdateRoute(r *proto.Response, resp *model.UpdateRoute) {
+	if resp.PeerName == "" {
+		logrus.Debugf("invalid update route message")
+		return
+	}
+	select {
+	case e.routes <- &RouteInfo{PeerName: resp.PeerName, Routes: resp.Routes}:
+	case <-e.session.Done():
+	}
+}
+
+// handleUpdateACL denies all peers when the acl can not be parsed, it may have rules of newer hubs.
+func (e *Exchanger) handleUpdateACL(r *proto.Response, resp *model.UpdateACL) {
+	var policy *acl.Policy
+	if resp.Enabled {
+		var err error
+		policy, err = acl.NewPolicy(resp.Tags, resp.Rules)
+		if err != nil {
+			logrus.Errorf("parse acl err, all peers are denied, %s", err.Error())
+			policy = &acl.Policy{}
+		}
+	}
+	select {
+	case e.acls <- policy:
 	case <-e.session.Done():
 	}
 }
 
+func (e *Exchanger) handlePeerEvent(r *proto.Response, resp *model.PeerEvent) {
+	ev := &PeerEvent{
+		Type:     PeerEventType(resp.Event),
+		PeerName: resp.PeerName,
+		PeerIP:   resp.PeerIP,
+	}
+	logrus.Debugf("peer %s %s", ev.PeerName, ev.Type)
+	// the dispatcher never waits for subscribers, nor holds the lock while sending
+	e.subMutex.Lock()
+	subscribers := slices.Clone(e.subscribers)
+	e.subMutex.Unlock()
+	for _, sub := range subscribers {
+		if !sub.send(ev) {
+			logrus.Warnf("drop event of peer %s, subscriber is full", ev.PeerName)
+		}
+	}
+}
+
+// subscriberBuffer is the number of events kept for a subscriber, later events are dropped
+// until it reads them. Peers missed are punched by the resync of WatchPeers.
+const subscriberBuffer = 64
+
+type subscriber struct {
+	ch     chan *PeerEvent
+	closed bool
+	mutex  sync.Mutex
+}
+
+// send gives ev to subscriber without blocking, it fails when the buffer is full.
+func (s *subscriber) send(ev *PeerEvent) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return true
+	}
+	select {
+	case s.ch <- ev:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *subscriber) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
 type HubClient interface {
 	Login() (*session, error)
 }
@@ -0,0 +1,45 @@
+package hub
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FailoverHubClient logins the first reachable hub of clients. It starts from the hub logged in
+// last time, so a node stays on the hub it failed over to.
+type FailoverHubClient struct {
+	clients []HubClient
+	current int
+	mutex   sync.Mutex
+}
+
+func NewFailoverHubClient(clients ...HubClient) *FailoverHubClient {
+	if len(clients) == 0 {
+		panic("clients cannot be empty")
+	}
+	return &FailoverHubClient{
+		clients: clients,
+	}
+}
+
+func (c *FailoverHubClient) Login() (*session, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	errs := make([]error, 0, len(c.clients))
+	for i := range c.clients {
+		idx := (c.current + i) % len(c.clients)
+		s, err := c.clients[idx].Login()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if idx != c.current {
+			logrus.Infof("fail over to hub %d", idx)
+		}
+		c.current = idx
+		return s, nil
+	}
+	return nil, errors.Join(errs...)
+}
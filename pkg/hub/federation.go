@@ -0,0 +1,545 @@
+package hub
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/model"
+	"github.com/withz/ptun/pkg/proto"
+)
+
+const (
+	// FederationRetryInterval is the wait before a lost link to other hub is dialed again
+	FederationRetryInterval = 5 * time.Second
+	FederationKeepalive     = 10 * time.Second
+)
+
+var (
+	errFederationToken = errors.New("invalid federation token")
+	errFederationSelf  = errors.New("cannot link hub to itself")
+	errFederationPool  = errors.New("address pool overlaps the one of hub")
+)
+
+type FederationConfig struct {
+	// Name identifies this hub among federated hubs, it must be unique
+	Name string
+	// Token is shared by federated hubs
+	Token string
+	// Port accepts links of other hubs, disabled when zero
+	Port int
+	// Peers are the host:port of other hubs to link, a link dialed by either side is enough
+	Peers []string
+	// TLS serves links over tls when set
+	TLS *tls.Config
+	// PeerTLS dials links over tls when set, the server name is the host of each peer when empty
+	PeerTLS *TLSClientOptions
+}
+
+// UseFederation links hub with other hubs. Linked hubs share their online nodes and forward
+// punches to each other, so nodes on different hubs can connect, and a node may login any of them.
+func (h *Hub) UseFederation(cfg *FederationConfig) {
+	h.federation = &federation{
+		hub:     h,
+		cfg:     cfg,
+		links:   make(map[string]*hubLink),
+		remotes: make(map[nodeKey]*remoteNode),
+		done:    make(chan struct{}),
+	}
+}
+
+type federation struct {
+	hub      *Hub
+	cfg      *FederationConfig
+	listener net.Listener
+	// links are keyed by the name of linked hub
+	links map[string]*hubLink
+	// remotes are the nodes on linked hubs, keyed by network and name
+	remotes   map[nodeKey]*remoteNode
+	mutex     sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// hubLink is the transport between two federated hubs.
+type hubLink struct {
+	*proto.Transport
+	rpc *model.Client
+	hub string
+	// dialer is the name of hub which dialed the link
+	dialer string
+}
+
+// remoteNode is a node online on a linked hub.
+type remoteNode struct {
+	link     *hubLink
+	name     string
+	network  string
+	ip       string
+	routes   []*net.IPNet
+	identity string
+}
+
+func (n *remoteNode) key() nodeKey {
+	return nodeKey{network: n.network, name: n.name}
+}
+
+func (n *remoteNode) peerName() string {
+	return n.name
+}
+
+func (n *remoteNode) publicKey() string {
+	return n.identity
+}
+
+func (n *remoteNode) leasedIP() string {
+	return n.ip
+}
+
+func (n *remoteNode) detectNat(ctx context.Context) (*model.DetectNatResponse, error) {
+	resp, err := n.link.rpc.RemoteDetectNat(ctx, &model.RemoteDetectNatRequest{Peer: n.name, Network: n.network})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Info == nil {
+		return nil, ErrNatDetectFailed
+	}
+	return resp.Info, nil
+}
+
+func (n *remoteNode) push(ctx context.Context, data any) error {
+	req := &model.RemotePushRequest{Peer: n.name, Network: n.network}
+	switch v := data.(type) {
+	case *model.PunchResponse:
+		req.Punch = v
+	case *model.RelayResponse:
+		req.Relay = v
+	default:
+		return fmt.Errorf("cannot push %T through hub %s", data, n.link.hub)
+	}
+	_, err := n.link.rpc.RemotePush(ctx, req)
+	return err
+}
+
+func (f *federation) start() error {
+	if f.cfg.Port != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", f.cfg.Port))
+		if err != nil {
+			return err
+		}
+		if f.cfg.TLS != nil {
+			listener = tls.NewListener(listener, f.cfg.TLS)
+		}
+		f.listener = listener
+		go func() {
+			defer func() {
+				logrus.Debugf("federation accept loop exit")
+			}()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go f.accept(conn)
+			}
+		}()
+	}
+	for _, addr := range f.cfg.Peers {
+		go f.dialLoop(addr)
+	}
+	return nil
+}
+
+func (f *federation) close() {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	f.mutex.Lock()
+	links := make([]*hubLink, 0, len(f.links))
+	for _, l := range f.links {
+		links = append(links, l)
+	}
+	f.mutex.Unlock()
+	for _, l := range links {
+		l.Close()
+	}
+}
+
+// dialLoop keeps a link to the hub at addr, it does not dial while the hub is linked by the other side.
+func (f *federation) dialLoop(addr string) {
+	name := ""
+	for {
+		if name == "" || !f.linked(name) {
+			var err error
+			name, err = f.dial(addr)
+			if err != nil {
+				logrus.Infof("link hub %s err, %s", addr, err.Error())
+			}
+		}
+		select {
+		case <-f.done:
+			return
+		case <-time.After(FederationRetryInterval):
+		}
+	}
+}
+
+// dial links the hub at addr and runs the link until it is lost, the name of hub is returned.
+func (f *federation) dial(addr string) (string, error) {
+	conn, err := f.dialConn(addr)
+	if err != nil {
+		return "", err
+	}
+	t := proto.NewTransport(conn)
+	t.SetDeadline(time.Now().Add(LoginConnectionTimeout))
+	hello, err := model.NewClient(t).HandshakeHubHello(&model.HubHelloRequest{
+		Hub:     f.cfg.Name,
+		Token:   f.cfg.Token,
+		Version: proto.Version,
+		Pools:   f.pools(),
+	}, LoginConnectionTimeout)
+	if err != nil {
+		t.Close()
+		return "", err
+	}
+	if err = f.checkPools(hello.Pools); err != nil {
+		t.Close()
+		return "", fmt.Errorf("hub %s, %w", hello.Hub, err)
+	}
+	t.SetDeadline(time.Time{})
+	f.run(&hubLink{
+		Transport: t,
+		hub:       hello.Hub,
+		dialer:    f.cfg.Name,
+	})
+	return hello.Hub, nil
+}
+
+func (f *federation) dialConn(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: LoginConnectionTimeout}
+	if f.cfg.PeerTLS == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	opts := *f.cfg.PeerTLS
+	if opts.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		opts.ServerName = host
+	}
+	cfg, err := NewTLSClientConfig(&opts)
+	if err != nil {
+		return nil, err
+	}
+	return (&tls.Dialer{NetDialer: dialer, Config: cfg}).Dial("tcp", addr)
+}
+
+func (f *federation) accept(conn net.Conn) {
+	t := proto.NewTransport(conn)
+	req, hello, err := model.AcceptHubHello(t, LoginConnectionTimeout)
+	if err != nil {
+		logrus.Infof("wait for hub hello failed, %s", err.Error())
+		t.Close()
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hello.Token), []byte(f.cfg.Token)) != 1 {
+		err = errFederationToken
+	} else if hello.Hub == f.cfg.Name {
+		err = errFederationSelf
+	} else {
+		err = f.checkPools(hello.Pools)
+	}
+	if err != nil {
+		logrus.Infof("hub %s hello failed, %s", hello.Hub, err.Error())
+		t.Responser.ReplyError(req, err, &model.HubHelloResponse{})
+		t.Close()
+		return
+	}
+	err = t.Responser.ReplySuccess(req, &model.HubHelloResponse{Hub: f.cfg.Name, Pools: f.pools()})
+	if err != nil {
+		t.Close()
+		return
+	}
+	f.run(&hubLink{
+		Transport: t,
+		hub:       hello.Hub,
+		dialer:    hello.Hub,
+	})
+}
+
+// pools gives the address pools of this hub keyed by network id.
+func (f *federation) pools() map[string]string {
+	pools := make(map[string]string, len(f.hub.ipams))
+	for id, m := range f.hub.ipams {
+		pools[id] = m.Pool().String()
+	}
+	return pools
+}
+
+// checkPools refuses a hub whose address pool of a network overlaps the one of this hub, nodes
+// logged in to both would get the same addresses.
+func (f *federation) checkPools(remote map[string]string) error {
+	for id, m := range f.hub.ipams {
+		r, ok := remote[id]
+		if !ok {
+			continue
+		}
+		_, pool, err := net.ParseCIDR(r)
+		local := m.Pool()
+		if err != nil || local.Contains(pool.IP) || pool.Contains(local.IP) {
+			return fmt.Errorf("%w, network %q pool %s", errFederationPool, id, r)
+		}
+	}
+	return nil
+}
+
+// run serves link until it is lost.
+func (f *federation) run(l *hubLink) {
+	l.rpc = model.NewClient(l.Transport)
+	if !f.addLink(l) {
+		logrus.Debugf("hub %s is linked already", l.hub)
+		l.Close()
+		return
+	}
+	logrus.Infof("hub %s linked", l.hub)
+	model.HandleRemoteDetectNat(l.Transport, f.handleRemoteDetectNat)
+	model.HandleRemotePush(l.Transport, f.handleRemotePush)
+	proto.OnResponse(l.Responser.Dispatcher(), func(r *proto.Response, u *model.PresenceUpdate) {
+		f.handlePresence(l, u)
+	})
+	l.SetKeepalive(FederationKeepalive)
+	go l.Responser.RunDispatcher()
+	f.sendFull(l)
+	l.Requester.RunDispatcher()
+	f.removeLink(l)
+	logrus.Infof("hub %s unlinked", l.hub)
+}
+
+// addLink keeps one link for each hub. Both hubs may dial each other, then the link dialed
+// by the smaller name is kept on both sides. A new link from the same dialer replaces the
+// former one, which is lost but not found yet.
+func (f *federation) addLink(l *hubLink) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	old := f.links[l.hub]
+	if old != nil {
+		if old.dialer < l.dialer {
+			return false
+		}
+		old.Close()
+	}
+	f.links[l.hub] = l
+	return true
+}
+
+// removeLink drops l and the nodes learned from it.
+func (f *federation) removeLink(l *hubLink) {
+	f.mutex.Lock()
+	if f.links[l.hub] == l {
+		delete(f.links, l.hub)
+	}
+	gone := make([]*remoteNode, 0)
+	for key, n := range f.remotes {
+		if n.link == l {
+			delete(f.remotes, key)
+			gone = append(gone, n)
+		}
+	}
+	f.mutex.Unlock()
+	for _, n := range gone {
+		f.notify(n, PeerLeft, false)
+	}
+}
+
+func (f *federation) linked(hub string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, ok := f.links[hub]
+	return ok
+}
+
+func (f *federation) lookup(network string, name string) *remoteNode {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.remotes[nodeKey{network: network, name: name}]
+}
+
+func (f *federation) nodes() []*remoteNode {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	nodes := make([]*remoteNode, 0, len(f.remotes))
+	for _, n := range f.remotes {
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+func presenceOf(s *session) model.NodePresence {
+	return model.NodePresence{
+		Name:      s.name,
+		Network:   s.network,
+		IP:        s.leasedIP(),
+		Routes:    s.getRoutes(),
+		PublicKey: s.publicKey(),
+	}
+}
+
+// announce pushes the change of local session s to linked hubs.
+func (f *federation) announce(s *session, left bool) {
+	u := &model.PresenceUpdate{Hub: f.cfg.Name}
+	if left {
+		u.Left = []model.NodePresence{{Name: s.name, Network: s.network}}
+	} else {
+		u.Joined = []model.NodePresence{presenceOf(s)}
+	}
+	f.mutex.Lock()
+	links := make([]*hubLink, 0, len(f.links))
+	for _, l := range f.links {
+		links = append(links, l)
+	}
+	f.mutex.Unlock()
+	for _, l := range links {
+		err := l.Responser.SendSuccess(u)
+		if err != nil {
+			logrus.Debugf("announce %s to hub %s err, %s", s.name, l.hub, err.Error())
+		}
+	}
+}
+
+// sendFull pushes all the local sessions to l.
+func (f *federation) sendFull(l *hubLink) {
+	u := &model.PresenceUpdate{
+		Hub:    f.cfg.Name,
+		Full:   true,
+		Joined: make([]model.NodePresence, 0),
+	}
+	f.hub.sessions.Range(func(key, value any) bool {
+		u.Joined = append(u.Joined, presenceOf(value.(*session)))
+		return true
+	})
+	err := l.Responser.SendSuccess(u)
+	if err != nil {
+		logrus.Debugf("send nodes to hub %s err, %s", l.hub, err.Error())
+	}
+}
+
+type presenceChange struct {
+	node   *remoteNode
+	event  PeerEventType
+	routes bool
+}
+
+func (f *federation) handlePresence(l *hubLink, u *model.PresenceUpdate) {
+	changes := make([]presenceChange, 0)
+	f.mutex.Lock()
+	if f.links[l.hub] != l {
+		f.mutex.Unlock()
+		return
+	}
+	if u.Full {
+		for key, n := range f.remotes {
+			joined := slices.ContainsFunc(u.Joined, func(p model.NodePresence) bool {
+				return p.Name == key.name && p.Network == key.network
+			})
+			if n.link == l && !joined {
+				delete(f.remotes, key)
+				changes = append(changes, presenceChange{node: n, event: PeerLeft})
+			}
+		}
+	}
+	for _, p := range u.Joined {
+		if !ValidName(p.Name) || !ValidName(p.Network) {
+			continue
+		}
+		n := &remoteNode{
+			link:     l,
+			name:     p.Name,
+			network:  p.Network,
+			ip:       p.IP,
+			routes:   f.hub.allowedRoutes(p.Network, p.Routes),
+			identity: p.PublicKey,
+		}
+		old := f.remotes[n.key()]
+		f.remotes[n.key()] = n
+		c := presenceChange{node: n}
+		if old == nil {
+			c.event = PeerJoined
+			c.routes = len(n.routes) > 0
+		} else {
+			if old.ip != n.ip {
+				c.event = PeerAddressChanged
+			}
+			c.routes = !slices.EqualFunc(old.routes, n.routes, func(a, b *net.IPNet) bool {
+				return a.String() == b.String()
+			})
+		}
+		changes = append(changes, c)
+	}
+	for _, p := range u.Left {
+		key := nodeKey{network: p.Network, name: p.Name}
+		n := f.remotes[key]
+		if n != nil && n.link == l {
+			delete(f.remotes, key)
+			changes = append(changes, presenceChange{node: n, event: PeerLeft})
+		}
+	}
+	f.mutex.Unlock()
+
+	for _, c := range changes {
+		f.notify(c.node, c.event, c.routes)
+	}
+}
+
+// notify pushes the change of remote node to local sessions, a local session of the same name
+// takes precedence, so its change is not pushed.
+func (f *federation) notify(n *remoteNode, event PeerEventType, routes bool) {
+	if f.hub.loadSession(n.network, n.name) != nil {
+		return
+	}
+	if event != "" {
+		f.hub.notifyPresence(n.key(), n.ip, event)
+	}
+	if routes {
+		f.hub.pushRoutes(n.key(), n.routes)
+	}
+}
+
+func (f *federation) handleRemoteDetectNat(req *model.RemoteDetectNatRequest) (*model.RemoteDetectNatResponse, error) {
+	s := f.hub.loadSession(req.Network, req.Peer)
+	if s == nil {
+		return nil, fmt.Errorf("%w, %s", ErrPeerNotFound, req.Peer)
+	}
+	info, err := f.hub.detectNat(s, remoteDetectNatTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &model.RemoteDetectNatResponse{Info: info}, nil
+}
+
+func (f *federation) handleRemotePush(req *model.RemotePushRequest) (*model.RemotePushResponse, error) {
+	s := f.hub.loadSession(req.Network, req.Peer)
+	if s == nil {
+		return nil, fmt.Errorf("%w, %s", ErrPeerNotFound, req.Peer)
+	}
+	var err error
+	switch {
+	case req.Punch != nil:
+		err = s.Responser.SendSuccess(req.Punch)
+	case req.Relay != nil:
+		err = s.Responser.SendSuccess(req.Relay)
+	default:
+		err = proto.ErrInvalidMessage
+	}
+	return nil, err
+}
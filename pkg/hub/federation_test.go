@@ -0,0 +1,129 @@
+package hub
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFederation(t *testing.T) {
+	h1 := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21049, Token: "abab"}))
+	h1.UseFederation(&FederationConfig{Name: "hub1", Token: "cdcd", Port: 21050})
+	_, allowed, _ := net.ParseCIDR("192.168.60.0/24")
+	h1.UseRoutes(DefaultNetwork, []*net.IPNet{allowed})
+	if err := h1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+	h2 := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21051, Token: "abab"}))
+	h2.UseFederation(&FederationConfig{Name: "hub2", Token: "cdcd", Peers: []string{"127.0.0.1:21050"}})
+	h2.UseRoutes(DefaultNetwork, []*net.IPNet{allowed})
+	if err := h2.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := func(name string, port int) *TcpHubClient {
+		return NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       port,
+			ClientName: name,
+			Token:      "abab",
+		})
+	}
+	expect := func(events <-chan *PeerEvent, typ PeerEventType, name string) {
+		select {
+		case ev := <-events:
+			if ev.Type != typ || ev.PeerName != name {
+				t.Errorf("expect %s %s, get %+v", name, typ, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("wait %s %s timeout", name, typ)
+		}
+	}
+
+	// the first hub is down, node fails over to the next one
+	ex1, err := NewExchanger(NewFailoverHubClient(client("node1", 21052), client("node1", 21049)), &stubDetector{}, "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ex1.Close()
+	events := ex1.Subscribe()
+
+	ex2, err := NewExchanger(client("node2", 21051), &stubDetector{}, "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ex2.Close()
+	_, route, _ := net.ParseCIDR("192.168.60.0/24")
+	if err = ex2.AdvertiseRoutes([]*net.IPNet{route}); err != nil {
+		t.Fatal(err)
+	}
+	expect(events, PeerJoined, "node2")
+	select {
+	case r := <-ex1.RouteUpdates():
+		if r.PeerName != "node2" || len(r.Routes) != 1 || r.Routes[0].String() != route.String() {
+			t.Errorf("expect node2 routes %s, get %+v", route, r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("wait node2 routes timeout")
+	}
+
+	peers, err := ex1.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(peers, "node2") {
+		t.Errorf("expect node2 in peers of hub1, get %v", peers)
+	}
+	sessions := h1.Sessions()
+	if len(sessions) != 2 || sessions[1].Name != "node2" || sessions[1].Hub != "hub2" {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+
+	// nat of node2 is detected through hub2, and the plan is pushed through it
+	record, err := h1.Punch(DefaultNetwork, "node1", "node2")
+	if err != nil {
+		t.Fatalf("punch through hub2 failed, %s", err.Error())
+	}
+	if record.Result != PunchPlanned {
+		t.Errorf("expect planned punch, get %+v", record)
+	}
+	select {
+	case info := <-ex2.Accept():
+		if info.PeerName != "node1" {
+			t.Errorf("expect plan of node1, get %+v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("wait punch plan timeout")
+	}
+
+	// nodes of a lost hub leave
+	h2.Close()
+	expect(events, PeerLeft, "node2")
+}
+
+func TestFederationPools(t *testing.T) {
+	ipam1, _ := NewIPAM("10.8.0.0/24", "")
+	ipam1.SetPool("10.8.0.0/25")
+	h1 := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21056, Token: "abab"}))
+	h1.UseIPAM(DefaultNetwork, ipam1)
+	h1.UseFederation(&FederationConfig{Name: "hub1", Token: "cdcd", Port: 21057})
+	if err := h1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h1.Close()
+
+	// the pool of hub2 is the whole network, which overlaps the one of hub1
+	ipam2, _ := NewIPAM("10.8.0.0/24", "")
+	h2 := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21058, Token: "abab"}))
+	h2.UseIPAM(DefaultNetwork, ipam2)
+	h2.UseFederation(&FederationConfig{Name: "hub2", Token: "cdcd"})
+	if _, err := h2.federation.dial("127.0.0.1:21057"); err == nil || !strings.Contains(err.Error(), errFederationPool.Error()) {
+		t.Errorf("expect overlapped pools refused, get %v", err)
+	}
+	if h1.federation.linked("hub2") {
+		t.Errorf("expect hub2 not linked")
+	}
+}
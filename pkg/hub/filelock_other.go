@@ -0,0 +1,8 @@
+//go:build !unix
+
+package hub
+
+// lockFile does nothing where flock is missing, the store is only locked within the process.
+func lockFile(path string) (unlock func(), err error) {
+	return func() {}, nil
+}
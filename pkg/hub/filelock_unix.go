@@ -0,0 +1,24 @@
+//go:build unix
+
+package hub
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes the exclusive lock of path shared by processes, such as a running hub and cli.
+func lockFile(path string) (unlock func(), err error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
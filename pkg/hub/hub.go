@@ -1,14 +1,21 @@
 package hub
 
 import (
-	"reflect"
+	"context"
+	"fmt"
+	"net"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/withz/ptun/model"
-	"github.com/withz/ptun/pkg/nat"
+	"github.com/withz/ptun/pkg/acl"
+	"github.com/withz/ptun/pkg/bridge"
+	"github.com/withz/ptun/pkg/metrics"
+	"github.com/withz/ptun/pkg/network"
 	"github.com/withz/ptun/pkg/proto"
+	"github.com/withz/ptun/pkg/tools"
 )
 
 type HubServer interface {
@@ -20,15 +27,129 @@ type HubServer interface {
 type Hub struct {
 	sessions sync.Map
 	servers  []HubServer
+	relay    *RelayConfig
+	// ipams, acls and routes are keyed by network id
+	ipams      map[string]*IPAM
+	acls       map[string]*acl.Policy
+	routes     map[string][]*net.IPNet
+	punches    *punchHistory
+	federation *federation
+	store      StateStore
+}
+
+type RelayConfig struct {
+	Host string
+	Port int
+	// Secret signs the relay tickets of nodes, it is the token of relay server
+	Secret string
+	// TLS tells nodes the relay serves binds over tls
+	TLS bool
 }
 
 func NewHub(servers ...HubServer) *Hub {
 	return &Hub{
 		servers: servers,
+		ipams:   make(map[string]*IPAM),
+		acls:    make(map[string]*acl.Policy),
+		routes:  make(map[string][]*net.IPNet),
+		punches: newPunchHistory(PunchHistorySize),
+	}
+}
+
+// UseRelay sets the relay which nodes fall back to when punching fails.
+func (h *Hub) UseRelay(cfg *RelayConfig) {
+	h.relay = cfg
+}
+
+// UseIPAM sets the address manager of network shared with hub servers, used to change leases at runtime.
+func (h *Hub) UseIPAM(network string, ipam *IPAM) {
+	h.ipams[network] = ipam
+}
+
+// UseACL limits the nodes of network to reach the others allowed by policy. Hub only coordinates
+// punches and relays of connected nodes, and pushes the policy to nodes to filter packets.
+func (h *Hub) UseACL(network string, policy *acl.Policy) {
+	h.acls[network] = policy
+}
+
+// connected tells if acl of network lets node a and b reach each other in either direction.
+func (h *Hub) connected(network string, a string, b string) bool {
+	policy := h.acls[network]
+	return policy == nil || a == b || policy.Connected(a, b)
+}
+
+// UseRoutes lets the nodes of network advertise the routes inside allowed, other routes are dropped.
+// Nodes advertise no routes when a network has none allowed.
+func (h *Hub) UseRoutes(network string, allowed []*net.IPNet) {
+	h.routes[network] = allowed
+}
+
+// allowedRoutes keeps the routes which are inside the allowed routes of network.
+func (h *Hub) allowedRoutes(network string, routes []*net.IPNet) []*net.IPNet {
+	result := make([]*net.IPNet, 0, len(routes))
+	for _, r := range routes {
+		if slices.ContainsFunc(h.routes[network], func(n *net.IPNet) bool { return netContains(n, r) }) {
+			result = append(result, r)
+		} else {
+			logrus.Infof("drop route %s not allowed in network %q", r, network)
+		}
+	}
+	return result
+}
+
+// netContains tells if network inner is inside outer.
+func netContains(outer *net.IPNet, inner *net.IPNet) bool {
+	outerOnes, outerBits := outer.Mask.Size()
+	innerOnes, innerBits := inner.Mask.Size()
+	return outerBits == innerBits && outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// UseStore keeps nodes and punches in store, so hub knows them after restarts.
+func (h *Hub) UseStore(store StateStore) {
+	h.store = store
+}
+
+// UpdateLease assigns a new address to node and pushes it when the node is online.
+func (h *Hub) UpdateLease(network string, name string, addr string) error {
+	ipam := h.ipams[network]
+	if ipam == nil {
+		return fmt.Errorf("ipam is not enabled")
+	}
+	cidr, err := ipam.Assign(name, addr)
+	if err != nil {
+		return err
+	}
+	s := h.loadSession(network, name)
+	if s == nil {
+		return nil
 	}
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	ipnet.IP = ip
+	s.setIP(cidr)
+	err = s.Responser.SendSuccess(&model.UpdateIP{IPs: []*net.IPNet{ipnet}})
+	h.notifyPeers(s, PeerAddressChanged)
+	return err
 }
 
 func (h *Hub) Start() error {
+	if h.store != nil {
+		punches, err := h.store.Punches()
+		if err != nil {
+			return err
+		}
+		for _, r := range punches {
+			h.punches.add(r)
+		}
+	}
+	if h.federation != nil {
+		err := h.federation.start()
+		if err != nil {
+			return err
+		}
+	}
 	for _, s := range h.servers {
 		err := s.Start()
 		if err != nil {
@@ -51,52 +172,247 @@ func (h *Hub) Close() error {
 	for _, s := range h.servers {
 		s.Close()
 	}
+	if h.federation != nil {
+		h.federation.close()
+	}
 	return nil
 }
 
 func (h *Hub) saveSession(s *session) {
-	old := h.loadSession(s.name)
+	old := h.loadSession(s.network, s.name)
 	if old != nil {
 		old.Close()
 	}
-	h.sessions.Store(s.name, s)
+	h.sessions.Store(s.key(), s)
 }
 
-func (h *Hub) removeSession(name string) {
-	old := h.loadSession(name)
-	if old != nil {
-		old.Close()
+// removeSession removes s only if it is still the session of its name, a node may
+// have logged in again before its old session leaves.
+func (h *Hub) removeSession(s *session) bool {
+	s.Close()
+	if !h.sessions.CompareAndDelete(s.key(), s) {
+		return false
 	}
-	h.sessions.Delete(name)
+	h.storeNode(s)
+	return true
 }
 
-func (h *Hub) loadSession(name string) *session {
-	s, ok := h.sessions.Load(name)
+func (h *Hub) loadSession(network string, name string) *session {
+	s, ok := h.sessions.Load(nodeKey{network: network, name: name})
 	if !ok {
 		return nil
 	}
 	return s.(*session)
 }
 
-func (h *Hub) allSessionNames() (names []string) {
+// lookupPeer finds node of network on this hub first, then on federated hubs.
+func (h *Hub) lookupPeer(network string, name string) peer {
+	if s := h.loadSession(network, name); s != nil {
+		return s
+	}
+	if h.federation != nil {
+		if n := h.federation.lookup(network, name); n != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+// allSessionNames gives the nodes of network on this hub and federated hubs.
+func (h *Hub) allSessionNames(network string) (names []string) {
 	names = make([]string, 0)
 	h.sessions.Range(func(key, value any) bool {
-		names = append(names, key.(string))
+		if k := key.(nodeKey); k.network == network {
+			names = append(names, k.name)
+		}
 		return true
 	})
+	if h.federation != nil {
+		for _, n := range h.federation.nodes() {
+			if n.network == network && !slices.Contains(names, n.name) {
+				names = append(names, n.name)
+			}
+		}
+	}
 	return names
 }
 
+// notifyPeers pushes the presence event of s to the other sessions of its network and federated hubs.
+func (h *Hub) notifyPeers(s *session, event PeerEventType) {
+	h.notifyPresence(s.key(), s.leasedIP(), event)
+	if h.federation != nil {
+		h.federation.announce(s, event == PeerLeft)
+	}
+}
+
+// notifyPresence pushes the presence event of node to the sessions of its network except the node itself.
+func (h *Hub) notifyPresence(node nodeKey, ip string, event PeerEventType) {
+	ev := &model.PeerEvent{
+		Event:    string(event),
+		PeerName: node.name,
+		PeerIP:   ip,
+	}
+	h.sessions.Range(func(key, value any) bool {
+		other := value.(*session)
+		if other.network != node.network || other.name == node.name || !other.supports(FeaturePeerEvents) ||
+			!h.connected(node.network, other.name, node.name) {
+			return true
+		}
+		err := other.Responser.SendSuccess(ev)
+		if err != nil {
+			logrus.Debugf("notify %s peer %s %s err, %s", other.name, node, event, err.Error())
+		}
+		return true
+	})
+}
+
+// notifyRoutes pushes the routes advertised by s to the other sessions of its network and federated hubs.
+func (h *Hub) notifyRoutes(s *session) {
+	h.pushRoutes(s.key(), s.getRoutes())
+	if h.federation != nil {
+		h.federation.announce(s, false)
+	}
+}
+
+// pushRoutes pushes the routes of node to the sessions of its network except the node itself.
+func (h *Hub) pushRoutes(node nodeKey, routes []*net.IPNet) {
+	update := &model.UpdateRoute{
+		PeerName: node.name,
+		Routes:   routes,
+	}
+	h.sessions.Range(func(key, value any) bool {
+		other := value.(*session)
+		if other.network != node.network || other.name == node.name || !other.supports(FeatureRoutes) ||
+			!h.connected(node.network, other.name, node.name) {
+			return true
+		}
+		err := other.Responser.SendSuccess(update)
+		if err != nil {
+			logrus.Debugf("notify %s routes of %s err, %s", other.name, node, err.Error())
+		}
+		return true
+	})
+}
+
+// sendRoutes pushes the routes advertised by the other sessions of its network to s.
+func (h *Hub) sendRoutes(s *session) {
+	if !s.supports(FeatureRoutes) {
+		return
+	}
+	h.sessions.Range(func(key, value any) bool {
+		other := value.(*session)
+		routes := other.getRoutes()
+		if other.network != s.network || other.name == s.name || len(routes) == 0 || !h.connected(s.network, s.name, other.name) {
+			return true
+		}
+		err := s.Responser.SendSuccess(&model.UpdateRoute{
+			PeerName: other.name,
+			Routes:   routes,
+		})
+		if err != nil {
+			logrus.Debugf("send %s routes of %s err, %s", s.name, other.name, err.Error())
+		}
+		return true
+	})
+	if h.federation == nil {
+		return
+	}
+	for _, n := range h.federation.nodes() {
+		if n.network != s.network || n.name == s.name || len(n.routes) == 0 || !h.connected(s.network, s.name, n.name) {
+			continue
+		}
+		err := s.Responser.SendSuccess(&model.UpdateRoute{
+			PeerName: n.name,
+			Routes:   n.routes,
+		})
+		if err != nil {
+			logrus.Debugf("send %s routes of %s err, %s", s.name, n.name, err.Error())
+		}
+	}
+}
+
+// sendACL pushes the acl of its network to s.
+func (h *Hub) sendACL(s *session) {
+	if !s.supports(FeatureACL) {
+		return
+	}
+	update := &model.UpdateACL{}
+	if policy := h.acls[s.network]; policy != nil {
+		update.Enabled = true
+		update.Tags = policy.Tags
+		update.Rules = policy.RuleStrings()
+	}
+	err := s.Responser.SendSuccess(update)
+	if err != nil {
+		logrus.Debugf("send %s acl err, %s", s.name, err.Error())
+	}
+}
+
+// restoreNode gives s the nat known before it logs in, until the node reports a new one.
+func (h *Hub) restoreNode(s *session) {
+	if h.store == nil {
+		return
+	}
+	n, err := h.store.Node(s.network, s.name)
+	if err != nil {
+		logrus.Warnf("load state of node %s err, %s", s.name, err.Error())
+		return
+	}
+	if n != nil && n.Nat != nil {
+		s.setNat(n.Nat)
+	}
+}
+
+// storeNode records s as seen now, the state is not needed to serve nodes, so errors are only logged.
+func (h *Hub) storeNode(s *session) {
+	if h.store == nil {
+		return
+	}
+	now := time.Now()
+	state := &NodeState{
+		Name:      s.name,
+		Network:   s.network,
+		IP:        s.leasedIP(),
+		Nat:       s.getNat(),
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	if addr := s.RemoteAddr(); addr != nil {
+		state.Addr = addr.String()
+	}
+	if n, err := h.store.Node(s.network, s.name); err == nil && n != nil {
+		state.FirstSeen = n.FirstSeen
+	}
+	if err := h.store.SaveNode(state); err != nil {
+		logrus.Warnf("save state of node %s err, %s", s.name, err.Error())
+	}
+}
+
 func (h *Hub) handle(session *session) {
 	logrus.Debugf("new seesion come %s", session.name)
+	metrics.HubSessions.Inc()
+	defer metrics.HubSessions.Dec()
 	handler := NewHubHandler(session, h)
-	dispatcher := handler.session.Requester.Dispatcher()
-	dispatcher.AddHandler(reflect.TypeFor[model.PeerListRequest]().Name(), handler.handlePeerList)
-	dispatcher.AddHandler(reflect.TypeFor[model.PunchRequest]().Name(), handler.handlePunch)
+	model.HandlePeerList(session.Transport, handler.handlePeerList)
+	model.HandlePunch(session.Transport, handler.handlePunch)
+	model.HandleRelay(session.Transport, handler.handleRelay)
+	proto.OnRequest(session.Requester.Dispatcher(), handler.handleUpdateRoute)
+	// nodes deny peers until they get the acl, so it goes before peers learn the node
+	h.sendACL(session)
+	h.restoreNode(session)
 	h.saveSession(session)
+	h.storeNode(session)
+	h.notifyPeers(session, PeerJoined)
+	h.sendRoutes(session)
 	handler.session.RunDispatcher()
-	h.removeSession(session.name)
-	handler.session.Close()
+	if h.removeSession(session) {
+		h.notifyPeers(session, PeerLeft)
+	}
+	if session.lease != nil {
+		if err := session.lease.Release(session.name); err != nil {
+			logrus.Warnf("release lease of %s err, %s", session.name, err.Error())
+		}
+	}
 	logrus.Debugf("seesion leave %s", session.name)
 }
 
@@ -112,61 +428,143 @@ func NewHubHandler(session *session, hub *Hub) *hubHandler {
 	}
 }
 
-func (h *hubHandler) handlePeerList(r *proto.Request) {
+func (h *hubHandler) handlePeerList(req *model.PeerListRequest) (*model.PeerListResponse, error) {
 	logrus.Debugf("[%s] recv peer list request", h.session.name)
-	h.session.Responser.ReplySuccess(r, &model.PeerListResponse{
-		PeerNames: h.hub.allSessionNames(),
+	names := h.hub.allSessionNames(h.session.network)
+	names = slices.DeleteFunc(names, func(name string) bool {
+		return !h.hub.connected(h.session.network, h.session.name, name)
 	})
+	return &model.PeerListResponse{
+		PeerNames: names,
+	}, nil
 }
 
-func (h *hubHandler) handlePunch(r *proto.Request) {
-	logrus.Debugf("[%s] recv punch request, %v", h.session.name, r.Payload())
-	req, err := proto.GetPayload[model.PunchRequest](r)
+func (h *hubHandler) handlePunch(req *model.PunchRequest) (*model.PunchResponse, error) {
+	logrus.Debugf("[%s] recv punch request, %v", h.session.name, req)
+	h.session.setNat(&req.Local.Mapping)
+	h.hub.storeNode(h.session)
+
+	remote := h.hub.lookupPeer(h.session.network, req.PeerName)
+	if remote == nil {
+		logrus.Debugf("peer %s not found in sessions", req.PeerName)
+		return &model.PunchResponse{
+			RemotePeerName: req.PeerName,
+		}, fmt.Errorf("%w, %s", ErrPeerNotFound, req.PeerName)
+	}
+	record, plan, err := h.hub.punch(h.session, &model.DetectNatResponse{
+		Ip:         req.LocalIp,
+		Local:      req.Local,
+		Transports: req.Transports,
+		Encryption: req.Encryption,
+	}, remote)
 	if err != nil {
-		// todo
-		return
+		logrus.Debugf("punch %s to %s failed, %s", h.session.name, req.PeerName, err.Error())
+		return &model.PunchResponse{
+			LocalIp:        req.LocalIp,
+			RemoteIp:       record.remoteIP,
+			RemotePeerName: req.PeerName,
+		}, err
 	}
+	return plan, nil
+}
 
-	remoteSession := h.hub.loadSession(req.PeerName)
-	if remoteSession == nil {
+// negotiateTransport picks the first transport of local which remote also supports,
+// nodes which do not tell their transports only speak raw udp.
+func negotiateTransport(local []string, remote []string) string {
+	for _, l := range local {
+		for _, r := range remote {
+			if l == r {
+				return l
+			}
+		}
+	}
+	return string(network.UDP)
+}
+
+// negotiateEncryption agrees the encryption of both sides, a node which does not tell it follows
+// the other one. Nodes never fall back to a weaker one, so different ones fail the punch.
+func negotiateEncryption(local string, remote string) (string, error) {
+	switch {
+	case local == "":
+		return remote, nil
+	case remote == "", local == remote:
+		return local, nil
+	}
+	return "", fmt.Errorf("%w, %s and %s", ErrEncryptionMismatch, local, remote)
+}
+
+func (h *hubHandler) handleRelay(req *model.RelayRequest) (*model.RelayResponse, error) {
+	logrus.Debugf("[%s] recv relay request, %v", h.session.name, req)
+	if h.hub.relay == nil {
+		logrus.Debugf("no relay configured, ignore relay request")
+		return &model.RelayResponse{
+			RemotePeerName: req.PeerName,
+		}, ErrRelayUnavailable
+	}
+	remote := h.hub.lookupPeer(h.session.network, req.PeerName)
+	if remote == nil {
 		logrus.Debugf("peer %s not found in sessions", req.PeerName)
-		// todo
-		return
+		return &model.RelayResponse{
+			RemotePeerName: req.PeerName,
+		}, fmt.Errorf("%w, %s", ErrPeerNotFound, req.PeerName)
 	}
-	resp, err := remoteSession.SendMessage(&model.DetectNatRequest{}, 3*time.Second)
-	if err != nil {
-		// todo
-		logrus.Debugf("peer %s send failed", req.PeerName)
-		return
+	if !h.hub.connected(h.session.network, h.session.name, req.PeerName) {
+		return &model.RelayResponse{
+			RemotePeerName: req.PeerName,
+		}, fmt.Errorf("%w, %s", ErrPeerNotAllowed, req.PeerName)
 	}
-	detectResult, err := proto.GetPayload[model.DetectNatResponse](resp)
+	localIP, err := peerIP(h.session, req.LocalIp)
 	if err != nil {
-		// todo
-		logrus.Debugf("peer %s do not give response", req.PeerName)
-		return
+		return &model.RelayResponse{
+			RemotePeerName: req.PeerName,
+		}, err
 	}
-	remoteIp := detectResult.Ip
-	remote := detectResult.Local.Mapping
-	local := req.Local.Mapping
-
-	lr, rr, err := nat.Analyze(&local, &remote)
+	remoteIP, err := peerIP(remote, req.RemoteIp)
 	if err != nil {
-		// todo
-		logrus.Debugf("nat analyze failed")
-		return
+		return &model.RelayResponse{
+			RemotePeerName: req.PeerName,
+		}, err
 	}
-	h.session.Responser.SendSuccess(&model.PunchResponse{
-		LocalIp:        req.LocalIp,
-		RemoteIp:       remoteIp,
-		LocalNat:       *lr,
-		RemoteNat:      *rr,
-		RemotePeerName: remoteSession.name,
-	})
-	remoteSession.Responser.SendSuccess(&model.PunchResponse{
-		LocalIp:        remoteIp,
-		RemoteIp:       req.LocalIp,
-		LocalNat:       *rr,
-		RemoteNat:      *lr,
+	session := tools.GenUUID()
+	key := genNonce()
+	expire := time.Now().Add(bridge.RelayTicketTTL)
+	ctx, cancel := context.WithTimeout(context.Background(), detectNatTimeout)
+	defer cancel()
+	err = remote.push(ctx, &model.RelayResponse{
+		LocalIp:        remoteIP,
+		RemoteIp:       localIP,
+		RelayHost:      h.hub.relay.Host,
+		RelayPort:      h.hub.relay.Port,
+		RelayTLS:       h.hub.relay.TLS,
+		Session:        session,
 		RemotePeerName: h.session.name,
+		Ticket:         bridge.NewRelayTicket(h.hub.relay.Secret, session, remote.peerName(), expire),
+		Key:            key,
+		Encryption:     req.Encryption,
+		RemoteKey:      h.session.publicKey(),
 	})
+	if err != nil {
+		return &model.RelayResponse{
+			RemotePeerName: req.PeerName,
+		}, fmt.Errorf("%w, %s %s", ErrPeerUnreachable, req.PeerName, err.Error())
+	}
+	return &model.RelayResponse{
+		LocalIp:        localIP,
+		RemoteIp:       remoteIP,
+		RelayHost:      h.hub.relay.Host,
+		RelayPort:      h.hub.relay.Port,
+		RelayTLS:       h.hub.relay.TLS,
+		Session:        session,
+		RemotePeerName: remote.peerName(),
+		Ticket:         bridge.NewRelayTicket(h.hub.relay.Secret, session, h.session.name, expire),
+		Key:            key,
+		Encryption:     req.Encryption,
+		RemoteKey:      remote.publicKey(),
+	}, nil
+}
+
+func (h *hubHandler) handleUpdateRoute(r *proto.Request, req *model.UpdateRoute) {
+	logrus.Debugf("[%s] recv update route, %v", h.session.name, req)
+	h.session.setRoutes(h.hub.allowedRoutes(h.session.network, req.Routes))
+	h.hub.notifyRoutes(h.session)
 }
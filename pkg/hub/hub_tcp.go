@@ -1,8 +1,13 @@
 package hub
 
 import (
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -12,14 +17,28 @@ import (
 )
 
 type TcpHubServerConfig struct {
-	Port  int
+	Port int
+	// Token, Nodes and IPAM are of the default network
 	Token string
+	// Nodes enables identity login when set, only approved nodes can login
+	Nodes NodeStore
+	// IPAM leases node address at login when set
+	IPAM *IPAM
+	// Networks are the networks besides the default one
+	Networks []*NetworkConfig
+	// TLS serves login over tls when set, tokens are sent in cleartext without it
+	TLS *tls.Config
 }
 
 type TcpHubServer struct {
 	cfg       *TcpHubServerConfig
 	listener  net.Listener
 	sessionCh chan *session
+	// logins counts the logins in progress, sessionCh is closed after all of them exit
+	logins sync.WaitGroup
+	closed bool
+	mutex  sync.Mutex
+	done   chan struct{}
 }
 
 func NewTcpHubServer(cfg *TcpHubServerConfig) *TcpHubServer {
@@ -29,6 +48,25 @@ func NewTcpHubServer(cfg *TcpHubServerConfig) *TcpHubServer {
 	return &TcpHubServer{
 		cfg:       cfg,
 		sessionCh: make(chan *session),
+		done:      make(chan struct{}),
+	}
+}
+
+// network gives the network of id, nil when hub does not have it.
+func (cfg *TcpHubServerConfig) network(id string) *NetworkConfig {
+	for _, n := range cfg.Networks {
+		if n.ID == id {
+			return n
+		}
+	}
+	if id != DefaultNetwork {
+		return nil
+	}
+	return &NetworkConfig{
+		ID:    DefaultNetwork,
+		Token: cfg.Token,
+		Nodes: cfg.Nodes,
+		IPAM:  cfg.IPAM,
 	}
 }
 
@@ -37,6 +75,11 @@ func (s *TcpHubServer) Start() error {
 	if err != nil {
 		return err
 	}
+	if s.cfg.TLS != nil {
+		listener = tls.NewListener(listener, s.cfg.TLS)
+	} else {
+		logrus.Warnf("hub listens on %d without tls, tokens are sent in cleartext", s.cfg.Port)
+	}
 	s.listener = listener
 	go func() {
 		defer func() {
@@ -54,49 +97,166 @@ func (s *TcpHubServer) Start() error {
 }
 
 func (s *TcpHubServer) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mutex.Unlock()
+	close(s.done)
 	if s.listener != nil {
 		s.listener.Close()
 	}
-	close(s.sessionCh)
+	go func() {
+		s.logins.Wait()
+		close(s.sessionCh)
+	}()
 	return nil
 }
 
+// startLogin counts a login in progress, it fails once the server is closed.
+func (s *TcpHubServer) startLogin() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	s.logins.Add(1)
+	return true
+}
+
 func (s *TcpHubServer) Accept() <-chan *session {
 	return s.sessionCh
 }
 
+// handleLogin logins the node of conn and gives its session to Accept, conn is closed on any error.
 func (s *TcpHubServer) handleLogin(conn net.Conn) {
-	t := proto.NewTransport(conn)
-	req, err := t.Requester.Read(5 * time.Second)
-	if err != nil {
-		logrus.Infof("wait for login failed, %s", err.Error())
-		t.Close()
+	if !s.startLogin() {
+		conn.Close()
 		return
 	}
-	login, err := proto.GetPayload[model.LoginRequest](req)
+	defer s.logins.Done()
+	t := proto.NewTransport(conn)
+	session, err := s.login(t)
 	if err != nil {
 		logrus.Infof("login failed, %s", err.Error())
 		t.Close()
 		return
 	}
-	if login.Token != s.cfg.Token {
-		logrus.Infof("login failed, invalid token")
-		t.Close()
-		return
+	select {
+	case s.sessionCh <- session:
+	case <-s.done:
+		if session.lease != nil {
+			session.lease.Release(session.name)
+		}
+		session.Close()
 	}
-	if login.Name == "" {
+}
+
+// login checks the login of t and replies it, the caller closes t on error.
+func (s *TcpHubServer) login(t *proto.Transport) (*session, error) {
+	req, login, err := model.AcceptLogin(t, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("wait for login, %w", err)
+	}
+	if !ValidName(login.Name) || !ValidName(login.Network) {
+		return nil, fmt.Errorf("%w, %s %s", errInvalidName, login.Network, login.Name)
+	}
+	network := s.cfg.network(login.Network)
+	if network == nil {
+		return nil, fmt.Errorf("%w, %s", errNetworkNotFound, login.Network)
+	}
+	if login.Token != network.Token {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if network.Nodes != nil {
+		req, err = s.verifyIdentity(t, req, login, network.Nodes)
+		if err != nil {
+			return nil, fmt.Errorf("node %s, %w", login.Name, err)
+		}
+	}
+	anonymous := login.Name == ""
+	if anonymous {
 		login.Name = tools.GenUUID()
 	}
-	err = t.Responser.SendSuccess(&model.LoginResponse{
-		Name: login.Name,
-	})
+	ip := login.IP
+	var lease *IPAM
+	if network.IPAM != nil {
+		ip, err = network.IPAM.Lease(login.Name, login.IP)
+		if err != nil {
+			return nil, fmt.Errorf("lease ip for %s, %w", login.Name, err)
+		}
+		if anonymous {
+			lease = network.IPAM
+		}
+	}
+	n := negotiateLogin(login)
+	resp := &model.LoginResponse{
+		Name:     login.Name,
+		IP:       ip,
+		Version:  proto.Version,
+		Codec:    n.codec.Name(),
+		Features: n.features,
+	}
+	if network.Nodes != nil {
+		err = t.Responser.ReplySuccess(req, &model.LoginProofResponse{LoginResponse: *resp})
+	} else {
+		err = t.Responser.ReplySuccess(req, resp)
+	}
 	if err != nil {
-		logrus.Infof("login failed, %s", err.Error())
-		t.Close()
-		return
+		if lease != nil {
+			lease.Release(login.Name)
+		}
+		return nil, err
 	}
+	t.SetCodec(n.codec)
 	session := NewSession(login.Name, t)
-	s.sessionCh <- session
+	session.network = network.ID
+	if network.Nodes != nil {
+		session.identity = login.PublicKey
+	}
+	session.ip = ip
+	session.lease = lease
+	session.version = n.version
+	session.features = n.features
+	return session, nil
+}
+
+// verifyIdentity checks the node key is approved and asks the node to sign a challenge. The proof
+// request of node is given to reply the login.
+func (s *TcpHubServer) verifyIdentity(t *proto.Transport, req *proto.Request, login *model.LoginRequest, nodes NodeStore) (*proto.Request, error) {
+	if login.Name == "" {
+		return nil, errIdentityNameEmpty
+	}
+	record, err := nodes.Lookup(login.Name)
+	if errors.Is(err, errNodeNotEnrolled) && login.PublicKey != "" {
+		err = nodes.Enroll(login.Name, login.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errNodeNotApproved
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.PublicKey != login.PublicKey {
+		return nil, errNodeKeyMismatch
+	}
+	if !record.Approved {
+		return nil, errNodeNotApproved
+	}
+
+	nonce := genNonce()
+	err = t.Responser.ReplySuccess(req, &model.LoginResponse{Challenge: nonce})
+	if err != nil {
+		return nil, err
+	}
+	r, proof, err := model.AcceptLoginProof(t, LoginConnectionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return r, verifyLogin(record.PublicKey, login.Name, nonce, proof.Signature)
 }
 
 type TcpHubClientConfig struct {
@@ -104,23 +264,39 @@ type TcpHubClientConfig struct {
 	Port       int
 	ClientName string
 	Token      string
+	// Network selects the network on hub, the default network when empty
+	Network string
+	// Key signs the login challenge, required when hub enables identity login
+	Key ed25519.PrivateKey
+	// IP is the wanted address, may be empty when hub leases one
+	IP string
+	// Codecs are offered to hub in preference order, DefaultCodecs when empty
+	Codecs []string
+	// Features are offered to hub, all Features of this build when nil
+	Features []string
+	// TLS dials hub over tls when set
+	TLS *tls.Config
 }
 
 type TcpHubClient struct {
 	cfg *TcpHubClientConfig
+	// dial connects hub, login messages are the same for all carriers
+	dial func() (net.Conn, error)
 }
 
 func NewTcpHubClient(cfg *TcpHubClientConfig) *TcpHubClient {
 	if cfg == nil {
 		panic("config cannot be nil")
 	}
-	return &TcpHubClient{
+	c := &TcpHubClient{
 		cfg: cfg,
 	}
+	c.dial = c.dialTCP
+	return c
 }
 
 func (c *TcpHubClient) Login() (*session, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", c.cfg.Host, c.cfg.Port))
+	conn, err := c.dial()
 	if err != nil {
 		return nil, err
 	}
@@ -134,21 +310,70 @@ func (c *TcpHubClient) Login() (*session, error) {
 	t.SetDeadline(time.Now().Add(LoginConnectionTimeout))
 	defer t.SetDeadline(time.Time{})
 
-	err = t.Requester.Send(&model.LoginRequest{
-		Name:  c.cfg.ClientName,
-		Token: c.cfg.Token,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("login failed, %w", err)
+	login := &model.LoginRequest{
+		Name:     c.cfg.ClientName,
+		Token:    c.cfg.Token,
+		Network:  c.cfg.Network,
+		IP:       c.cfg.IP,
+		Version:  proto.Version,
+		Codecs:   c.cfg.Codecs,
+		Features: c.cfg.Features,
+	}
+	if len(login.Codecs) == 0 {
+		login.Codecs = DefaultCodecs
+	}
+	if login.Features == nil {
+		login.Features = Features
 	}
-	resp, err := t.Responser.Read(LoginConnectionTimeout)
+	if c.cfg.Key != nil {
+		login.PublicKey = EncodePublicKey(c.cfg.Key)
+	}
+	rpc := model.NewClient(t)
+	loginResp, err := rpc.HandshakeLogin(login, LoginConnectionTimeout)
 	if err != nil {
 		return nil, fmt.Errorf("login failed, %w", err)
 	}
-	login, err := proto.GetPayload[model.LoginResponse](resp)
+	if loginResp.Challenge != "" {
+		loginResp, err = c.answerChallenge(rpc, loginResp.Challenge)
+		if err != nil {
+			return nil, fmt.Errorf("login failed, %w", err)
+		}
+	}
+	n, err := acceptNegotiation(loginResp)
 	if err != nil {
 		return nil, fmt.Errorf("login failed, %w", err)
 	}
-	session := NewSession(login.Name, t)
+	t.SetCodec(n.codec)
+	session := NewSession(loginResp.Name, t)
+	session.network = c.cfg.Network
+	session.ip = loginResp.IP
+	session.version = n.version
+	session.features = n.features
+	logrus.Debugf("login hub with version %d, codec %s", n.version, n.codec.Name())
 	return session, nil
 }
+
+func (c *TcpHubClient) dialTCP() (net.Conn, error) {
+	addr := net.JoinHostPort(c.cfg.Host, strconv.Itoa(c.cfg.Port))
+	if c.cfg.TLS == nil {
+		return net.Dial("tcp", addr)
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: LoginConnectionTimeout},
+		Config:    c.cfg.TLS,
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+func (c *TcpHubClient) answerChallenge(rpc *model.Client, nonce string) (*model.LoginResponse, error) {
+	if c.cfg.Key == nil {
+		return nil, errInvalidIdentity
+	}
+	resp, err := rpc.HandshakeLoginProof(&model.LoginProofRequest{
+		Signature: signLogin(c.cfg.Key, c.cfg.ClientName, nonce),
+	}, LoginConnectionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.LoginResponse, nil
+}
@@ -0,0 +1,516 @@
+package hub
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/withz/ptun/model"
+	"github.com/withz/ptun/pkg/acl"
+	"github.com/withz/ptun/pkg/nat"
+	"github.com/withz/ptun/pkg/network"
+)
+
+func TestPeerEvents(t *testing.T) {
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21042, Token: "abab"}))
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	login := func(name string, ip string) *Exchanger {
+		ex, err := NewExchanger(NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21042,
+			ClientName: name,
+			Token:      "abab",
+			IP:         ip,
+		}), nil, ip, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	expect := func(events <-chan *PeerEvent, typ PeerEventType, name string, ip string) {
+		select {
+		case ev := <-events:
+			if ev.Type != typ || ev.PeerName != name || ev.PeerIP != ip {
+				t.Errorf("expect %s %s %s, get %+v", name, typ, ip, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("wait %s %s timeout", name, typ)
+		}
+	}
+
+	ex1 := login("node1", "10.8.0.1/24")
+	defer ex1.Close()
+	// a subscriber which never reads does not stall the others
+	stalled := ex1.Subscribe()
+	for range subscriberBuffer + 1 {
+		ex1.handlePeerEvent(nil, &model.PeerEvent{Event: string(PeerJoined), PeerName: "node3"})
+	}
+	events := ex1.Subscribe()
+
+	ex2 := login("node2", "10.8.0.2/24")
+	expect(events, PeerJoined, "node2", "10.8.0.2/24")
+	ex2.Close()
+	expect(events, PeerLeft, "node2", "10.8.0.2/24")
+	if len(stalled) != subscriberBuffer {
+		t.Errorf("expect stalled subscriber full, get %d", len(stalled))
+	}
+}
+
+func TestRouteAdvertisement(t *testing.T) {
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21043, Token: "abab"}))
+	_, allowed, _ := net.ParseCIDR("192.168.56.0/23")
+	h.UseRoutes(DefaultNetwork, []*net.IPNet{allowed})
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	login := func(name string, features []string) *Exchanger {
+		ex, err := NewExchanger(NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21043,
+			ClientName: name,
+			Token:      "abab",
+			Features:   features,
+		}), nil, "", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	expect := func(ex *Exchanger, name string, route string) {
+		select {
+		case r := <-ex.RouteUpdates():
+			if r.PeerName != name || len(r.Routes) != 1 || r.Routes[0].String() != route {
+				t.Errorf("expect %s routes %s, get %+v", name, route, r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("wait %s routes timeout", name)
+		}
+	}
+
+	ex1 := login("node1", nil)
+	defer ex1.Close()
+	_, n, _ := net.ParseCIDR("192.168.56.0/24")
+	if err := ex1.AdvertiseRoutes([]*net.IPNet{n}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// routes advertised before login are sent at login
+	ex2 := login("node2", nil)
+	defer ex2.Close()
+	expect(ex2, "node1", "192.168.56.0/24")
+	// nodes without the feature get no routes
+	ex3 := login("node3", []string{FeaturePeerEvents})
+	defer ex3.Close()
+
+	// routes out of the allowed ones are dropped
+	_, n, _ = net.ParseCIDR("192.168.57.0/24")
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	_, wide, _ := net.ParseCIDR("192.168.0.0/16")
+	if err := ex1.AdvertiseRoutes([]*net.IPNet{all, n, wide}); err != nil {
+		t.Fatal(err)
+	}
+	expect(ex2, "node1", "192.168.57.0/24")
+	select {
+	case r := <-ex3.RouteUpdates():
+		t.Errorf("expect no routes without feature, get %+v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21044, Token: "abab"}))
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	login := func(name string, ip string) *Exchanger {
+		ex, err := NewExchanger(NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21044,
+			ClientName: name,
+			Token:      "abab",
+			IP:         ip,
+		}), nil, ip, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	ex1 := login("node1", "10.8.0.1/24")
+	defer ex1.Close()
+	events := ex1.Subscribe()
+	ex2 := login("node2", "10.8.0.2/24")
+	defer ex2.Close()
+	<-events
+
+	sessions := h.Sessions()
+	if len(sessions) != 2 || sessions[0].Name != "node1" || sessions[1].IP != "10.8.0.2/24" {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+	if _, err := h.Punch(DefaultNetwork, "node1", "node1"); !errors.Is(err, errPunchSelf) {
+		t.Errorf("expect punch self error, get %v", err)
+	}
+	if _, err := h.Punch(DefaultNetwork, "node1", "node3"); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("expect peer not found, get %v", err)
+	}
+
+	if err := h.Kick(DefaultNetwork, "node2"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != PeerLeft || ev.PeerName != "node2" {
+			t.Errorf("expect node2 left, get %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("wait node2 left timeout")
+	}
+	if sessions := h.Sessions(); len(sessions) != 1 {
+		t.Errorf("expect 1 session after kick, get %d", len(sessions))
+	}
+}
+
+func TestPunchHistory(t *testing.T) {
+	p := newPunchHistory(2)
+	for _, to := range []string{"node2", "node3", "node4"} {
+		p.add(&PunchRecord{From: "node1", To: to})
+	}
+	records := p.list()
+	if len(records) != 2 || records[0].To != "node4" || records[1].To != "node3" {
+		t.Errorf("unexpected records %+v", records)
+	}
+}
+
+type stubDetector struct {
+	err error
+}
+
+func (d *stubDetector) Detect() (*nat.DetectResult, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &nat.DetectResult{}, nil
+}
+
+func TestPunchError(t *testing.T) {
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21045, Token: "abab"}))
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	login := func(name string, d nat.Detector) *Exchanger {
+		ex, err := NewExchanger(NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21045,
+			ClientName: name,
+			Token:      "abab",
+		}), d, "", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	ex1 := login("node1", &stubDetector{})
+	defer ex1.Close()
+	ex2 := login("node2", &stubDetector{err: errors.New("stun timeout")})
+	defer ex2.Close()
+
+	// peer offline is given up at once
+	if err := ex1.PunchPeer("node3", ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case info := <-ex1.Accept():
+		if info.PeerName != "node3" || !errors.Is(info.Err, ErrPeerNotFound) {
+			t.Errorf("expect node3 not found, get %+v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait punch error timeout")
+	}
+
+	// the reason of remote is carried back to hub
+	if _, err := h.Punch(DefaultNetwork, "node1", "node2"); !errors.Is(err, ErrNatDetectFailed) {
+		t.Errorf("expect nat detect failed, get %v", err)
+	}
+	records := h.PunchHistory()
+	if len(records) == 0 || records[0].Result != PunchFailed {
+		t.Errorf("expect failed punch record, get %+v", records)
+	}
+}
+
+func TestACL(t *testing.T) {
+	policy, err := acl.NewPolicy(map[string][]string{
+		"dev": {"dev1"},
+		"db":  {"db1"},
+	}, []string{"tag:dev -> tag:db:5432/tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21055, Token: "abab"}))
+	h.UseACL(DefaultNetwork, policy)
+	if err = h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	login := func(name string) *Exchanger {
+		ex, err := NewExchanger(NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21055,
+			ClientName: name,
+			Token:      "abab",
+		}), &stubDetector{}, "", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	dev := login("dev1")
+	defer dev.Close()
+	db := login("db1")
+	defer db.Close()
+	other := login("other")
+	defer other.Close()
+
+	select {
+	case p := <-dev.ACLUpdates():
+		if p == nil || !p.Connected("dev1", "db1") {
+			t.Errorf("unexpected acl of dev1 %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait acl timeout")
+	}
+	peers, err := other.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != "other" {
+		t.Errorf("expect other only sees itself, get %v", peers)
+	}
+	peers, err = db.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Errorf("expect db1 sees dev1, get %v", peers)
+	}
+
+	if _, err = h.Punch(DefaultNetwork, "other", "db1"); !errors.Is(err, ErrPeerNotAllowed) {
+		t.Errorf("expect punch of other refused, get %v", err)
+	}
+	if _, err = h.Punch(DefaultNetwork, "db1", "dev1"); err != nil {
+		t.Errorf("expect punch of db1 and dev1 planned, get %v", err)
+	}
+	if err = other.PunchPeer("dev1", ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case info := <-other.Accept():
+		if info.PeerName != "dev1" || !errors.Is(info.Err, ErrPeerNotAllowed) {
+			t.Errorf("expect dev1 not allowed, get %+v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait punch error timeout")
+	}
+}
+
+func TestLeasedIP(t *testing.T) {
+	ipam, err := NewIPAM("10.9.0.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21062, Token: "abab", IPAM: ipam}))
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	login := func(name string) *Exchanger {
+		ex, err := NewExchanger(NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21062,
+			ClientName: name,
+			Token:      "abab",
+		}), &stubDetector{}, "", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	ex1 := login("node1")
+	defer ex1.Close()
+	ex2 := login("node2")
+	defer ex2.Close()
+
+	// a node cannot claim the address of another one
+	if err := ex1.PunchPeer("node2", ex2.GetIP()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case info := <-ex1.Accept():
+		if info.PeerName != "node2" || !errors.Is(info.Err, ErrIPMismatch) {
+			t.Errorf("expect ip mismatch, get %+v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait punch error timeout")
+	}
+
+	// the plan carries the leases whatever node claims
+	if err := ex1.PunchPeer("node2", ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case info := <-ex1.Accept():
+		if info.PeerName != "node2" || info.PeerIP != ex2.GetIP() {
+			t.Errorf("expect leased ip %s of node2, get %+v", ex2.GetIP(), info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait punch plan timeout")
+	}
+}
+
+func TestEncryptionMismatch(t *testing.T) {
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21063, Token: "abab"}))
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	login := func(name string, encryption string) *Exchanger {
+		ex, err := NewExchanger(NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21063,
+			ClientName: name,
+			Token:      "abab",
+		}), &stubDetector{}, "", nil, encryption)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	ex1 := login("node1", network.EncryptionAEAD)
+	defer ex1.Close()
+	ex2 := login("node2", network.EncryptionNone)
+	defer ex2.Close()
+
+	if err := ex1.PunchPeer("node2", ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case info := <-ex1.Accept():
+		if info.PeerName != "node2" || !errors.Is(info.Err, ErrEncryptionMismatch) {
+			t.Errorf("expect encryption mismatch, get %+v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait punch error timeout")
+	}
+}
+
+// filteringNat forwards the packets of clients on listen to server from a port of its own, and only
+// lets back the replies from server itself, so the replies to CHANGE-REQUEST are dropped.
+func filteringNat(t *testing.T, listen string, server string) {
+	l, err := net.ListenPacket("udp4", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := make(map[string]net.PacketConn)
+	var mutex sync.Mutex
+	t.Cleanup(func() {
+		l.Close()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, c := range ports {
+			c.Close()
+		}
+	})
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, client, err := l.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			c, ok := ports[client.String()]
+			if !ok {
+				c, err = net.ListenPacket("udp4", "127.0.0.1:0")
+				if err != nil {
+					mutex.Unlock()
+					return
+				}
+				ports[client.String()] = c
+				go func() {
+					p := make([]byte, 1500)
+					for {
+						n, from, err := c.ReadFrom(p)
+						if err != nil {
+							return
+						}
+						if from.String() == saddr.String() {
+							l.WriteTo(p[:n], client)
+						}
+					}
+				}()
+			}
+			mutex.Unlock()
+			c.WriteTo(buf[:n], saddr)
+		}
+	}()
+}
+
+func TestPunchFilteringNat(t *testing.T) {
+	stun := nat.NewStandardServer("127.0.0.1", "127.0.0.2", 21064, 21065)
+	if err := stun.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stun.Stop()
+	// the same port as primary, so the request to the alternate ip reaches server
+	filteringNat(t, "127.0.0.3:21064", "127.0.0.1:21064")
+
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21066, Token: "abab"}))
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	login := func(name string) *Exchanger {
+		ex, err := NewExchanger(NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21066,
+			ClientName: name,
+			Token:      "abab",
+		}), nat.NewStandardDetector("127.0.0.3", 21064), "", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for range ex.Accept() {
+			}
+		}()
+		return ex
+	}
+	ex1 := login("node1")
+	defer ex1.Close()
+	ex2 := login("node2")
+	defer ex2.Close()
+
+	// the filter tests of both nodes time out behind the nat, hub must not wait for them
+	if _, err := h.Punch(DefaultNetwork, "node1", "node2"); err != nil {
+		t.Errorf("expect punch planned, get %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+var (
+	errTLSPinMismatch = errors.New("server certificate does not match pins")
+	errTLSNoCert      = errors.New("server gives no certificate")
+)
+
+// NewTLSServerConfig loads the certificate of hub listener from pem files.
+func NewTLSServerConfig(certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls certificate err, %w", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+type TLSClientOptions struct {
+	// ServerName is verified against the certificate of hub, it is the host of hub usually
+	ServerName string
+	// CA is the pem file of trusted roots, system roots are used when empty
+	CA string
+	// Pins are the PublicKeyPin of accepted hub certificates. With pins and no CA, a self-signed
+	// certificate is accepted if it matches a pin and the server name.
+	Pins []string
+}
+
+// NewTLSClientConfig makes the tls config of hub client.
+func NewTLSClientConfig(opts *TLSClientOptions) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: opts.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if opts.CA != "" {
+		p, err := os.ReadFile(opts.CA)
+		if err != nil {
+			return nil, fmt.Errorf("read tls ca err, %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(p) {
+			return nil, fmt.Errorf("read tls ca err, no certificate in %s", opts.CA)
+		}
+	}
+	if len(opts.Pins) == 0 {
+		return cfg, nil
+	}
+	// the chain is verified by pins, the server name is still checked below
+	skipChain := opts.CA == ""
+	cfg.InsecureSkipVerify = skipChain
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errTLSNoCert
+		}
+		leaf := cs.PeerCertificates[0]
+		if skipChain {
+			if err := leaf.VerifyHostname(opts.ServerName); err != nil {
+				return err
+			}
+		}
+		if !slices.Contains(opts.Pins, PublicKeyPin(leaf)) {
+			return errTLSPinMismatch
+		}
+		return nil
+	}
+	return cfg, nil
+}
+
+// PublicKeyPin gives the base64 sha256 of the public key of cert, it is kept across renewals
+// with the same key.
+func PublicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,117 @@
+package hub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// genCert writes a self-signed certificate of name into dir.
+func genCert(t *testing.T, dir string, name string) (certFile string, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "hub.crt")
+	keyFile = filepath.Join(dir, "hub.key")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestTLSLogin(t *testing.T) {
+	certFile, keyFile, cert := genCert(t, t.TempDir(), "hub.test")
+	serverConfig, err := NewTLSServerConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub(
+		NewTcpHubServer(&TcpHubServerConfig{Port: 21046, Token: "abab"}),
+		NewTcpHubServer(&TcpHubServerConfig{Port: 21047, Token: "abab", TLS: serverConfig}),
+	)
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	login := func(name string, port int, opts *TLSClientOptions) error {
+		cfg := &TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       port,
+			ClientName: name,
+			Token:      "abab",
+		}
+		if opts != nil {
+			cfg.TLS, err = NewTLSClientConfig(opts)
+			if err != nil {
+				return err
+			}
+		}
+		s, err := NewTcpHubClient(cfg).Login()
+		if err != nil {
+			return err
+		}
+		s.Close()
+		return nil
+	}
+
+	cases := []struct {
+		name string
+		port int
+		opts *TLSClientOptions
+		ok   bool
+	}{
+		{"plain", 21046, nil, true},
+		{"pinned", 21047, &TLSClientOptions{ServerName: "hub.test", Pins: []string{PublicKeyPin(cert)}}, true},
+		{"ca", 21047, &TLSClientOptions{ServerName: "hub.test", CA: certFile}, true},
+		{"untrusted", 21047, &TLSClientOptions{ServerName: "hub.test"}, false},
+		{"wrong-pin", 21047, &TLSClientOptions{ServerName: "hub.test", Pins: []string{"AAAA"}}, false},
+		{"wrong-name", 21047, &TLSClientOptions{ServerName: "other.test", Pins: []string{PublicKeyPin(cert)}}, false},
+	}
+	for _, c := range cases {
+		err := login(c.name, c.port, c.opts)
+		if c.ok && err != nil {
+			t.Errorf("%s login failed, %s", c.name, err.Error())
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s login should fail", c.name)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package hub
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// connectProxy is a http proxy which only tunnels CONNECT.
+func connectProxy(t *testing.T, tunnels *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "connect only", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") == "" {
+			http.Error(w, "auth required", http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		atomic.AddInt32(tunnels, 1)
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+}
+
+func TestWsLogin(t *testing.T) {
+	h := NewHub(NewWsHubServer(&WsHubServerConfig{
+		TcpHubServerConfig: TcpHubServerConfig{Port: 21048, Token: "abab"},
+	}))
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var tunnels int32
+	proxy := connectProxy(t, &tunnels)
+	defer proxy.Close()
+
+	login := func(name string, proxy string) {
+		ex, err := NewExchanger(NewWsHubClient(&WsHubClientConfig{
+			TcpHubClientConfig: TcpHubClientConfig{
+				Host:       "127.0.0.1",
+				Port:       21048,
+				ClientName: name,
+				Token:      "abab",
+			},
+			Proxy: proxy,
+		}), nil, "", nil, "")
+		if err != nil {
+			t.Fatalf("%s login failed, %s", name, err.Error())
+		}
+		defer ex.Close()
+		peers, err := ex.GetPeers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(peers) != 1 || peers[0] != name {
+			t.Errorf("%s expect only itself, get %v", name, peers)
+		}
+	}
+	login("direct", "")
+	login("proxied", strings.Replace(proxy.URL, "http://", "http://user:pass@", 1))
+	if atomic.LoadInt32(&tunnels) != 1 {
+		t.Errorf("expect 1 tunnel through proxy, get %d", tunnels)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.Sessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(h.Sessions()); n != 0 {
+		t.Errorf("expect sessions left, get %d", n)
+	}
+}
+
+func TestWsClose(t *testing.T) {
+	s := NewWsHubServer(&WsHubServerConfig{
+		TcpHubServerConfig: TcpHubServerConfig{Port: 21060, Token: "abab"},
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range s.Accept() {
+		}
+	}()
+	c := NewWsHubClient(&WsHubClientConfig{
+		TcpHubClientConfig: TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21060,
+			ClientName: "node1",
+			Token:      "abab",
+		},
+	})
+	session, err := c.Login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	go session.RunDispatcher()
+
+	// hijacked conns are not closed by http server, the ws server closes them itself
+	s.Close()
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("expect session closed with server")
+	}
+}
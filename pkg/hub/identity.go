@@ -0,0 +1,268 @@
+package hub
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const identityPemType = "PRIVATE KEY"
+
+var (
+	errInvalidIdentity   = errors.New("invalid identity key")
+	errNodeNotEnrolled   = errors.New("node not enrolled")
+	errNodeNotApproved   = errors.New("node not approved")
+	errNodeKeyMismatch   = errors.New("node key mismatch")
+	errInvalidSignature  = errors.New("invalid login signature")
+	errIdentityNameEmpty = errors.New("node name is required with identity login")
+)
+
+// GenerateIdentity creates a new ed25519 key and writes it to path in PKCS8 PEM.
+func GenerateIdentity(path string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	p := pem.EncodeToMemory(&pem.Block{Type: identityPemType, Bytes: der})
+	err = os.WriteFile(path, p, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func LoadIdentity(path string) (ed25519.PrivateKey, error) {
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(p)
+	if block == nil || block.Type != identityPemType {
+		return nil, errInvalidIdentity
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errInvalidIdentity
+	}
+	return key, nil
+}
+
+func EncodePublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// DecodePublicKey parses the key given by EncodePublicKey.
+func DecodePublicKey(pub string) (ed25519.PublicKey, error) {
+	k, err := base64.StdEncoding.DecodeString(pub)
+	if err != nil || len(k) != ed25519.PublicKeySize {
+		return nil, errInvalidIdentity
+	}
+	return ed25519.PublicKey(k), nil
+}
+
+func signLogin(key ed25519.PrivateKey, name string, nonce string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, loginMessage(name, nonce)))
+}
+
+func verifyLogin(pub string, name string, nonce string, sig string) error {
+	k, err := DecodePublicKey(pub)
+	if err != nil {
+		return err
+	}
+	s, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return errInvalidSignature
+	}
+	if !ed25519.Verify(k, loginMessage(name, nonce), s) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func loginMessage(name string, nonce string) []byte {
+	return []byte("ptun login\n" + name + "\n" + nonce)
+}
+
+func genNonce() string {
+	p := make([]byte, 32)
+	rand.Read(p)
+	return base64.StdEncoding.EncodeToString(p)
+}
+
+type NodeRecord struct {
+	Name      string
+	PublicKey string
+	Approved  bool
+}
+
+// NodeStore maps node names to their public keys, nodes can only login after approved.
+type NodeStore interface {
+	Lookup(name string) (*NodeRecord, error)
+	Enroll(name string, publicKey string) error
+	Approve(name string) error
+	Remove(name string) error
+	List() ([]*NodeRecord, error)
+}
+
+// FileNodeStore keeps the records in a json file. The file is read on every call,
+// so approving a node from cli takes effect on a running hub. Changes lock the file
+// beside it, so the hub and cli never overwrite the records of each other.
+type FileNodeStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewFileNodeStore(path string) *FileNodeStore {
+	return &FileNodeStore{
+		path: path,
+	}
+}
+
+func (s *FileNodeStore) load() (map[string]*NodeRecord, error) {
+	records := make(map[string]*NodeRecord)
+	p, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return records, nil
+	}
+	err = json.Unmarshal(p, &records)
+	return records, err
+}
+
+// save replaces the file with records, a crash leaves either the old file or the new one.
+func (s *FileNodeStore) save(records map[string]*NodeRecord) error {
+	p, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.path)
+	f, err := os.CreateTemp(dir, filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(p)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), s.path); err != nil {
+		return err
+	}
+	// the rename itself is kept once the directory is synced, not every system can sync one
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// update changes the records by fn under the lock of file, they are saved when fn tells so.
+func (s *FileNodeStore) update(fn func(records map[string]*NodeRecord) (bool, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	changed, err := fn(records)
+	if err != nil || !changed {
+		return err
+	}
+	return s.save(records)
+}
+
+func (s *FileNodeStore) Lookup(name string) (*NodeRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	r, ok := records[name]
+	if !ok {
+		return nil, errNodeNotEnrolled
+	}
+	return r, nil
+}
+
+// Enroll records a node waiting for approve, an existing record is not changed.
+func (s *FileNodeStore) Enroll(name string, publicKey string) error {
+	return s.update(func(records map[string]*NodeRecord) (bool, error) {
+		if _, ok := records[name]; ok {
+			return false, nil
+		}
+		records[name] = &NodeRecord{
+			Name:      name,
+			PublicKey: publicKey,
+		}
+		return true, nil
+	})
+}
+
+func (s *FileNodeStore) Approve(name string) error {
+	return s.update(func(records map[string]*NodeRecord) (bool, error) {
+		r, ok := records[name]
+		if !ok {
+			return false, errNodeNotEnrolled
+		}
+		r.Approved = true
+		return true, nil
+	})
+}
+
+func (s *FileNodeStore) Remove(name string) error {
+	return s.update(func(records map[string]*NodeRecord) (bool, error) {
+		_, ok := records[name]
+		delete(records, name)
+		return ok, nil
+	})
+}
+
+func (s *FileNodeStore) List() ([]*NodeRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*NodeRecord, 0, len(records))
+	for _, r := range records {
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
@@ -0,0 +1,92 @@
+package hub
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestIdentityLogin(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileNodeStore(path.Join(dir, "nodes.json"))
+	s := NewTcpHubServer(&TcpHubServerConfig{Port: 21041, Token: "abab", Nodes: store})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	go func() {
+		for range s.Accept() {
+		}
+	}()
+
+	if _, err := GenerateIdentity(path.Join(dir, "node.key")); err != nil {
+		t.Fatal(err)
+	}
+	key, err := LoadIdentity(path.Join(dir, "node.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewTcpHubClient(&TcpHubClientConfig{
+		Host:       "127.0.0.1",
+		Port:       21041,
+		ClientName: "node1",
+		Token:      "abab",
+		Key:        key,
+	})
+
+	if _, err = c.Login(); err == nil {
+		t.Fatal("login should fail before approved")
+	}
+	r, err := store.Lookup("node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Approved || r.PublicKey != EncodePublicKey(key) {
+		t.Errorf("node should be enrolled as pending, get %+v", r)
+	}
+
+	if err = store.Approve("node1"); err != nil {
+		t.Fatal(err)
+	}
+	session, err := c.Login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+
+	other, err := GenerateIdentity(path.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cfg.Key = other
+	if _, err = c.Login(); err == nil {
+		t.Error("login should fail with another key")
+	}
+}
+
+func TestFileNodeStoreShared(t *testing.T) {
+	p := path.Join(t.TempDir(), "nodes.json")
+	// like a running hub and cli, each store has its own mutex
+	stores := []*FileNodeStore{NewFileNodeStore(p), NewFileNodeStore(p)}
+	var wg sync.WaitGroup
+	for i, s := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := s.Enroll(fmt.Sprintf("node%d-%d", i, j), "key"); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	records, err := stores[0].List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 40 {
+		t.Errorf("expect 40 records, get %d", len(records))
+	}
+}
@@ -0,0 +1,194 @@
+package hub
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+var (
+	errIPAMExhausted = errors.New("no free address in network")
+	errIPAMNotInNet  = errors.New("address not in network")
+	errIPAMInUse     = errors.New("address already leased")
+	errIPAMOnlyIPv4  = errors.New("only ipv4 network is supported")
+	errIPAMPool      = errors.New("pool not in network")
+)
+
+// IPAM leases addresses of the network to nodes. Leases are sticky by node name and
+// saved to file, so a node gets the same address after hub or node restarts.
+type IPAM struct {
+	network *net.IPNet
+	// pool is the part of network which new leases come from, federated hubs lease from
+	// disjoint pools of the same network
+	pool   *net.IPNet
+	path   string
+	leases map[string]string
+	mutex  sync.Mutex
+}
+
+func NewIPAM(cidr string, path string) (*IPAM, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ipnet.IP.To4() == nil {
+		return nil, errIPAMOnlyIPv4
+	}
+	m := &IPAM{
+		network: ipnet,
+		pool:    ipnet,
+		path:    path,
+		leases:  make(map[string]string),
+	}
+	if path == "" {
+		return m, nil
+	}
+	p, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(p) > 0 {
+		err = json.Unmarshal(p, &m.leases)
+	}
+	return m, err
+}
+
+// SetPool limits new leases to the pool inside network.
+func (m *IPAM) SetPool(cidr string) error {
+	_, pool, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	poolOnes, _ := pool.Mask.Size()
+	ones, _ := m.network.Mask.Size()
+	if pool.IP.To4() == nil || poolOnes < ones || !m.network.Contains(pool.IP) {
+		return fmt.Errorf("%w, %s", errIPAMPool, cidr)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pool = pool
+	return nil
+}
+
+// Pool gives the pool which new leases come from.
+func (m *IPAM) Pool() *net.IPNet {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.pool
+}
+
+// Lease gives the address of node in cidr form. The sticky lease is used first, then
+// the requested address if it is free, otherwise the first free address.
+func (m *IPAM) Lease(name string, requested string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if ip, ok := m.leases[name]; ok {
+		return m.cidr(ip), nil
+	}
+	if requested != "" {
+		ip, _, err := net.ParseCIDR(requested)
+		if err == nil && m.usable(ip) && m.pool.Contains(ip) && m.owner(ip.String()) == "" {
+			return m.cidr(ip.String()), m.set(name, ip.String())
+		}
+	}
+	ones, bits := m.pool.Mask.Size()
+	base := binary.BigEndian.Uint32(m.pool.IP.To4())
+	for i := uint32(1); i < uint32(1)<<(bits-ones); i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, base+i)
+		if !m.usable(ip) || m.owner(ip.String()) != "" {
+			continue
+		}
+		return m.cidr(ip.String()), m.set(name, ip.String())
+	}
+	return "", errIPAMExhausted
+}
+
+// Assign changes the lease of node to the given address.
+func (m *IPAM) Assign(name string, addr string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		ip, _, _ = net.ParseCIDR(addr)
+	}
+	if ip == nil || !m.usable(ip) || !m.pool.Contains(ip) {
+		return "", errIPAMNotInNet
+	}
+	if owner := m.owner(ip.String()); owner != "" && owner != name {
+		return "", errIPAMInUse
+	}
+	return m.cidr(ip.String()), m.set(name, ip.String())
+}
+
+func (m *IPAM) Release(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.leases, name)
+	return m.save()
+}
+
+func (m *IPAM) Leases() map[string]string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	result := make(map[string]string, len(m.leases))
+	for name, ip := range m.leases {
+		result[name] = m.cidr(ip)
+	}
+	return result
+}
+
+func (m *IPAM) usable(ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil || !m.network.Contains(ip) {
+		return false
+	}
+	ones, bits := m.network.Mask.Size()
+	if bits-ones < 2 {
+		return true
+	}
+	// skip network and broadcast address
+	offset := binary.BigEndian.Uint32(ip) - binary.BigEndian.Uint32(m.network.IP.To4())
+	return offset != 0 && offset != uint32(1)<<(bits-ones)-1
+}
+
+func (m *IPAM) owner(ip string) string {
+	for name, leased := range m.leases {
+		if leased == ip {
+			return name
+		}
+	}
+	return ""
+}
+
+func (m *IPAM) cidr(ip string) string {
+	ones, _ := m.network.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+func (m *IPAM) set(name string, ip string) error {
+	m.leases[name] = ip
+	return m.save()
+}
+
+func (m *IPAM) save() error {
+	if m.path == "" {
+		return nil
+	}
+	p, err := json.MarshalIndent(m.leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err = os.WriteFile(tmp, p, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIPAMLease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	m, err := NewIPAM("10.8.0.0/30", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip1, err := m.Lease("node1", "")
+	if err != nil || ip1 != "10.8.0.1/30" {
+		t.Fatalf("lease node1 got %s, %v", ip1, err)
+	}
+	ip2, err := m.Lease("node2", "10.8.0.1/30")
+	if err != nil || ip2 != "10.8.0.2/30" {
+		t.Fatalf("lease node2 got %s, %v", ip2, err)
+	}
+	if _, err = m.Lease("node3", ""); err != errIPAMExhausted {
+		t.Fatalf("lease node3 should be exhausted, got %v", err)
+	}
+
+	// leases are sticky after reload
+	m, err = NewIPAM("10.8.0.0/30", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, err := m.Lease("node2", "")
+	if err != nil || ip != ip2 {
+		t.Fatalf("reload lease node2 got %s, %v", ip, err)
+	}
+	if _, err = m.Assign("node1", "10.8.0.2"); err != errIPAMInUse {
+		t.Fatalf("assign used address should fail, got %v", err)
+	}
+	m.Release("node2")
+	if ip, err = m.Assign("node1", "10.8.0.2"); err != nil || ip != "10.8.0.2/30" {
+		t.Fatalf("assign node1 got %s, %v", ip, err)
+	}
+}
+
+func TestIPAMPool(t *testing.T) {
+	m, err := NewIPAM("10.8.0.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = m.SetPool("10.9.0.0/25"); err == nil {
+		t.Errorf("expect pool out of network rejected")
+	}
+	if err = m.SetPool("10.8.0.128/25"); err != nil {
+		t.Fatal(err)
+	}
+	// addresses come from pool, in the prefix of network
+	ip, err := m.Lease("node1", "10.8.0.5/24")
+	if err != nil || ip != "10.8.0.129/24" {
+		t.Fatalf("lease node1 got %s, %v", ip, err)
+	}
+	if _, err = m.Assign("node1", "10.8.0.5"); err != errIPAMNotInNet {
+		t.Fatalf("assign address out of pool should fail, got %v", err)
+	}
+}
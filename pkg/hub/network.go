@@ -0,0 +1,45 @@
+package hub
+
+import (
+	"errors"
+	"strings"
+)
+
+// DefaultNetwork is the network of nodes which do not select one at login
+const DefaultNetwork = ""
+
+var (
+	errNetworkNotFound = errors.New("network not found")
+	errInvalidName     = errors.New("invalid name, / is not allowed")
+)
+
+// ValidName tells if s can be a network id or node name, / would make the logs of nodes
+// in different networks look the same.
+func ValidName(s string) bool {
+	return !strings.Contains(s, "/")
+}
+
+// NetworkConfig is a virtual network on hub. Nodes select it by ID at login, and only see,
+// punch and get events of the nodes in the same network.
+type NetworkConfig struct {
+	ID    string
+	Token string
+	// Nodes enables identity login of the network when set
+	Nodes NodeStore
+	// IPAM leases node address of the network at login when set
+	IPAM *IPAM
+}
+
+// nodeKey identifies a node on hub, node names are only unique in each network.
+type nodeKey struct {
+	network string
+	name    string
+}
+
+// String is only for logs, it is not unique across networks.
+func (k nodeKey) String() string {
+	if k.network == DefaultNetwork {
+		return k.name
+	}
+	return k.network + "/" + k.name
+}
@@ -0,0 +1,127 @@
+package hub
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNetworks(t *testing.T) {
+	ipam, err := NewIPAM("10.9.0.0/24", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{
+		Port:  21054,
+		Token: "abab",
+		Networks: []*NetworkConfig{
+			{ID: "dev", Token: "dev", IPAM: ipam},
+			{ID: "staging", Token: "staging"},
+		},
+	}))
+	h.UseIPAM("dev", ipam)
+	if err = h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	client := func(name string, network string, token string) *TcpHubClient {
+		return NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21054,
+			ClientName: name,
+			Token:      token,
+			Network:    network,
+		})
+	}
+	login := func(name string, network string, token string) *Exchanger {
+		ex, err := NewExchanger(client(name, network, token), &stubDetector{}, "", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	if _, err = client("node1", "dev", "abab").Login(); err == nil {
+		t.Errorf("expect token of default network rejected by dev")
+	}
+	if _, err = client("node1", "prod", "abab").Login(); err == nil {
+		t.Errorf("expect unknown network rejected")
+	}
+	if _, err = client("staging/node2", DefaultNetwork, "abab").Login(); err == nil {
+		t.Errorf("expect name with / rejected")
+	}
+
+	ex1 := login("node1", DefaultNetwork, "abab")
+	defer ex1.Close()
+	events := ex1.Subscribe()
+	dev1 := login("node1", "dev", "dev")
+	defer dev1.Close()
+	devEvents := dev1.Subscribe()
+	dev2 := login("node2", "dev", "dev")
+	defer dev2.Close()
+	staging := login("node2", "staging", "staging")
+	defer staging.Close()
+
+	select {
+	case ev := <-devEvents:
+		if ev.Type != PeerJoined || ev.PeerName != "node2" {
+			t.Errorf("expect node2 joined dev, get %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait node2 joined dev timeout")
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("expect no event of other networks, get %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	peers, err := dev1.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(peers)
+	if !slices.Equal(peers, []string{"node1", "node2"}) {
+		t.Errorf("unexpected peers of dev %v", peers)
+	}
+	peers, err = ex1.GetPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(peers, []string{"node1"}) {
+		t.Errorf("unexpected peers of default network %v", peers)
+	}
+	if ip, _, err := net.ParseCIDR(dev2.GetIP()); err != nil || !ipam.network.Contains(ip) {
+		t.Errorf("expect address of dev, get %s", dev2.GetIP())
+	}
+
+	if _, err = h.Punch("staging", "node2", "node1"); !errors.Is(err, ErrPeerNotFound) {
+		t.Errorf("expect node1 not found in staging, get %v", err)
+	}
+	record, err := h.Punch("dev", "node1", "node2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Network != "dev" {
+		t.Errorf("expect punch in dev, get %+v", record)
+	}
+	if sessions := h.Sessions(); len(sessions) != 4 || sessions[0].Network != DefaultNetwork || sessions[3].Network != "staging" {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+
+	// a node without name never comes back for its lease, it is released when the node leaves
+	anonymous := login("", "dev", "dev")
+	if _, ok := ipam.Leases()[anonymous.GetName()]; !ok {
+		t.Errorf("expect lease of %s", anonymous.GetName())
+	}
+	anonymous.Close()
+	for i := 0; i < 50; i++ {
+		if _, ok := ipam.Leases()[anonymous.GetName()]; !ok {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("expect lease of %s released", anonymous.GetName())
+}
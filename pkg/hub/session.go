@@ -1,17 +1,138 @@
 package hub
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/withz/ptun/model"
+	"github.com/withz/ptun/pkg/nat"
 	"github.com/withz/ptun/pkg/proto"
 )
 
+// peer is a node which hub coordinates punches with, it is online on this hub or a federated one.
+type peer interface {
+	peerName() string
+	// publicKey is the identity key of node verified by its hub, empty without identity login
+	publicKey() string
+	// leasedIP is the address leased by the hub of node, empty when it does not manage addresses
+	leasedIP() string
+	detectNat(ctx context.Context) (*model.DetectNatResponse, error)
+	// push sends a punch or relay plan to node
+	push(ctx context.Context, data any) error
+}
+
 type session struct {
 	*proto.Transport
+	rpc  *model.Client
 	name string
+	// network is the virtual network which node is in
+	network string
+	// identity is the public key of node, set when hub verifies it at login
+	identity string
+	// ip is leased by hub, empty when hub does not manage addresses
+	ip string
+	// lease releases ip when the session leaves, set for nodes without name which never come back
+	// for the same lease
+	lease *IPAM
+	// routes are advertised by node
+	routes []*net.IPNet
+	// nat is the last detect result reported by node
+	nat     *nat.DetectResult
+	loginAt time.Time
+	mutex   sync.Mutex
+
+	// version and features are negotiated at login
+	version  int
+	features []string
 }
 
 func NewSession(name string, conn *proto.Transport) *session {
 	return &session{
 		Transport: conn,
+		rpc:       model.NewClient(conn),
 		name:      name,
+		loginAt:   time.Now(),
 	}
 }
+
+func (s *session) key() nodeKey {
+	return nodeKey{network: s.network, name: s.name}
+}
+
+func (s *session) getRoutes() []*net.IPNet {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.routes
+}
+
+func (s *session) setRoutes(routes []*net.IPNet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.routes = routes
+}
+
+func (s *session) getNat() *nat.DetectResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.nat
+}
+
+func (s *session) setNat(n *nat.DetectResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nat = n
+}
+
+func (s *session) peerName() string {
+	return s.name
+}
+
+func (s *session) publicKey() string {
+	return s.identity
+}
+
+func (s *session) leasedIP() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.ip
+}
+
+func (s *session) setIP(ip string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ip = ip
+}
+
+func (s *session) detectNat(ctx context.Context) (*model.DetectNatResponse, error) {
+	info, err := s.rpc.DetectNat(ctx, &model.DetectNatRequest{})
+	if err != nil {
+		return nil, err
+	}
+	s.setNat(&info.Local.Mapping)
+	return info, nil
+}
+
+func (s *session) push(ctx context.Context, data any) error {
+	return s.Responser.SendSuccess(data)
+}
+
+// peerIP gives the address of peer in punch and relay plans, which is the lease when its hub
+// manages addresses, so a node cannot claim the address of another one.
+func peerIP(p peer, claimed string) (string, error) {
+	ip := p.leasedIP()
+	if ip == "" {
+		return claimed, nil
+	}
+	if claimed != "" && claimed != ip {
+		return "", fmt.Errorf("%w, %s claims %s but leases %s", ErrIPMismatch, p.peerName(), claimed, ip)
+	}
+	return ip, nil
+}
+
+func (s *session) supports(feature string) bool {
+	return slices.Contains(s.features, feature)
+}
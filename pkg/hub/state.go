@@ -0,0 +1,355 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/pkg/nat"
+)
+
+const (
+	// stateCompactSize is the count of log entries which makes the store write a new snapshot
+	stateCompactSize  = 1000
+	maxStateEntrySize = 1 << 20
+	// stateFlushInterval is how often the changes are written to log
+	stateFlushInterval = time.Second
+)
+
+var errStateStoreClosed = errors.New("state store is closed")
+
+// NodeState is what hub knows about a node which has logged in.
+type NodeState struct {
+	Name    string
+	Network string `json:",omitempty"`
+	IP      string `json:",omitempty"`
+	Addr    string `json:",omitempty"`
+	// Nat is the last detect result of node
+	Nat       *nat.DetectResult `json:",omitempty"`
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// StateStore keeps the nodes and punches of hub across hub restarts.
+type StateStore interface {
+	// Node gives the state of node in network, nil when the node is unknown
+	Node(network string, name string) (*NodeState, error)
+	Nodes() ([]*NodeState, error)
+	SaveNode(n *NodeState) error
+	// Punches gives the recent punches from the earliest one
+	Punches() ([]*PunchRecord, error)
+	AddPunch(r *PunchRecord) error
+	Close() error
+}
+
+type stateSnapshot struct {
+	// Seq is the last log entry in snapshot
+	Seq uint64
+	// Networks keys nodes by network and then name
+	Networks map[string]map[string]*NodeState
+	// Nodes is the flat map of older snapshots, it is moved to Networks at load
+	Nodes   map[string]*NodeState `json:",omitempty"`
+	Punches []*PunchRecord
+}
+
+type stateEntry struct {
+	Seq   uint64
+	Node  *NodeState   `json:",omitempty"`
+	Punch *PunchRecord `json:",omitempty"`
+}
+
+// FileStateStore keeps the state in memory, and saves it as a json snapshot plus a log of the
+// changes since it, so a change does not rewrite the whole file. Changes are written to the log
+// in batches by a background loop, so saving does not wait for disk. A crash may lose the changes
+// of the last stateFlushInterval but never corrupts the snapshot.
+type FileStateStore struct {
+	path  string
+	state stateSnapshot
+	wal   *os.File
+	// pending are the log entries not written yet, entries counts the entries since snapshot
+	pending []byte
+	entries int
+	closed  bool
+	mutex   sync.Mutex
+	// flushMutex orders the writes of log and snapshot
+	flushMutex sync.Mutex
+	done       chan struct{}
+	exited     chan struct{}
+}
+
+// OpenFileStateStore loads the snapshot at path and replays its log at path.wal.
+func OpenFileStateStore(path string) (*FileStateStore, error) {
+	s := &FileStateStore{
+		path: path,
+		state: stateSnapshot{
+			Networks: make(map[string]map[string]*NodeState),
+		},
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	p, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if len(p) > 0 {
+		if err = json.Unmarshal(p, &s.state); err != nil {
+			return nil, err
+		}
+		if s.state.Networks == nil {
+			s.state.Networks = make(map[string]map[string]*NodeState)
+		}
+		for _, n := range s.state.Nodes {
+			s.putNode(n)
+		}
+		s.state.Nodes = nil
+	}
+	if err = s.replay(); err != nil {
+		return nil, err
+	}
+	p, err = json.MarshalIndent(&s.state, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = s.writeSnapshot(p); err != nil {
+		return nil, err
+	}
+	go s.flushLoop()
+	return s, nil
+}
+
+func (s *FileStateStore) walPath() string {
+	return s.path + ".wal"
+}
+
+func (s *FileStateStore) replay() error {
+	f, err := os.Open(s.walPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxStateEntrySize)
+	for scanner.Scan() {
+		entry := &stateEntry{}
+		if err = json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			// the last entry may be torn by a crash
+			logrus.Warnf("drop state log from entry %d, %s", s.state.Seq+1, err.Error())
+			break
+		}
+		// entries before a crash between snapshot and truncating log are in snapshot already
+		if entry.Seq <= s.state.Seq {
+			continue
+		}
+		s.apply(entry)
+	}
+	return scanner.Err()
+}
+
+func (s *FileStateStore) apply(e *stateEntry) {
+	s.state.Seq = e.Seq
+	if e.Node != nil {
+		s.putNode(e.Node)
+	}
+	if e.Punch != nil {
+		s.state.Punches = append(s.state.Punches, e.Punch)
+		if len(s.state.Punches) > PunchHistorySize {
+			s.state.Punches = slices.Delete(s.state.Punches, 0, len(s.state.Punches)-PunchHistorySize)
+		}
+	}
+}
+
+func (s *FileStateStore) putNode(n *NodeState) {
+	nodes := s.state.Networks[n.Network]
+	if nodes == nil {
+		nodes = make(map[string]*NodeState)
+		s.state.Networks[n.Network] = nodes
+	}
+	nodes[n.Name] = n
+}
+
+func (s *FileStateStore) flushLoop() {
+	defer close(s.exited)
+	ticker := time.NewTicker(stateFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.flush(); err != nil {
+				logrus.Warnf("write state err, %s", err.Error())
+			}
+		}
+	}
+}
+
+// flush writes the pending entries to log, or a new snapshot when the log has enough entries.
+func (s *FileStateStore) flush() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	if s.entries >= stateCompactSize {
+		// the snapshot has all pending entries
+		p, err := json.MarshalIndent(&s.state, "", "  ")
+		s.pending = nil
+		s.entries = 0
+		s.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		return s.writeSnapshot(p)
+	}
+	p := s.pending
+	s.pending = nil
+	s.mutex.Unlock()
+	if len(p) == 0 {
+		return nil
+	}
+	_, err := s.wal.Write(p)
+	return err
+}
+
+// writeSnapshot writes the snapshot p and starts an empty log.
+func (s *FileStateStore) writeSnapshot(p []byte) (err error) {
+	// the snapshot has to be on disk before the log is truncated, or a crash loses both
+	tmp := s.path + ".tmp"
+	if err = writeFileSync(tmp, p); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if err = syncDir(filepath.Dir(s.path)); err != nil {
+		return err
+	}
+	if s.wal != nil {
+		s.wal.Close()
+	}
+	s.wal, err = os.OpenFile(s.walPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// writeFileSync writes p to path and syncs it.
+func writeFileSync(path string, p []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(p); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs the directory entries of dir, so a rename in it is on disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *FileStateStore) append(e *stateEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return errStateStoreClosed
+	}
+	e.Seq = s.state.Seq + 1
+	p, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.pending = append(append(s.pending, p...), '\n')
+	s.apply(e)
+	s.entries++
+	return nil
+}
+
+func (s *FileStateStore) Node(network string, name string) (*NodeState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n, ok := s.state.Networks[network][name]
+	if !ok {
+		return nil, nil
+	}
+	state := *n
+	return &state, nil
+}
+
+// Nodes gives the known nodes sorted by network and name.
+func (s *FileStateStore) Nodes() ([]*NodeState, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make([]*NodeState, 0)
+	for _, nodes := range s.state.Networks {
+		for _, n := range nodes {
+			state := *n
+			result = append(result, &state)
+		}
+	}
+	slices.SortFunc(result, func(a, b *NodeState) int {
+		if c := strings.Compare(a.Network, b.Network); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return result, nil
+}
+
+func (s *FileStateStore) SaveNode(n *NodeState) error {
+	state := *n
+	return s.append(&stateEntry{Node: &state})
+}
+
+func (s *FileStateStore) Punches() ([]*PunchRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.state.Punches), nil
+}
+
+func (s *FileStateStore) AddPunch(r *PunchRecord) error {
+	return s.append(&stateEntry{Punch: r})
+}
+
+// Close writes the snapshot, so the next open does not replay the log.
+func (s *FileStateStore) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	p, err := json.MarshalIndent(&s.state, "", "  ")
+	s.pending = nil
+	s.mutex.Unlock()
+	// no flush runs after the loop exits
+	<-s.exited
+	if err == nil {
+		err = s.writeSnapshot(p)
+	}
+	s.wal.Close()
+	return err
+}
@@ -0,0 +1,155 @@
+package hub
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/withz/ptun/pkg/nat"
+)
+
+func TestFileStateStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := OpenFileStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapping := &nat.DetectResult{}
+	if err = s.SaveNode(&NodeState{Name: "node1", IP: "10.0.0.1/24", Nat: mapping}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SaveNode(&NodeState{Name: "node1", IP: "10.0.0.2/24", Nat: mapping}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < PunchHistorySize+1; i++ {
+		if err = s.AddPunch(&PunchRecord{From: "node1", To: "node2", Result: PunchPlanned}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = s.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash leaves the log without snapshot, and may tear the last entry
+	wal, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Write([]byte(`{"Seq":1000,"Node":{"Na`))
+	wal.Close()
+
+	s, err = OpenFileStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.Node(DefaultNetwork, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == nil || n.IP != "10.0.0.2/24" || n.Nat == nil {
+		t.Errorf("unexpected node1 state %+v", n)
+	}
+	if n, _ = s.Node(DefaultNetwork, "node2"); n != nil {
+		t.Errorf("expect node2 unknown, get %+v", n)
+	}
+	punches, _ := s.Punches()
+	if len(punches) != PunchHistorySize {
+		t.Errorf("expect %d punches, get %d", PunchHistorySize, len(punches))
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SaveNode(&NodeState{Name: "node2"}); err == nil {
+		t.Errorf("expect closed store fails")
+	}
+
+	s, err = OpenFileStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	nodes, _ := s.Nodes()
+	if len(nodes) != 1 || nodes[0].Name != "node1" {
+		t.Errorf("unexpected nodes %+v", nodes)
+	}
+}
+
+func TestHubState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	store, err := OpenFileStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21053, Token: "abab"}))
+	h.UseStore(store)
+	if err = h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	ex, err := NewExchanger(NewTcpHubClient(&TcpHubClientConfig{
+		Host:       "127.0.0.1",
+		Port:       21053,
+		ClientName: "node1",
+		Token:      "abab",
+	}), &stubDetector{}, "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := h.KnownNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "node1" || !nodes[0].Online {
+		t.Errorf("expect node1 online, get %+v", nodes)
+	}
+	ex.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.Sessions()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	store.Close()
+
+	// a restarted hub still knows the node
+	store, err = OpenFileStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	h2 := NewHub()
+	h2.UseStore(store)
+	nodes, err = h2.KnownNodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Online || nodes[0].FirstSeen.IsZero() || nodes[0].LastSeen.Before(nodes[0].FirstSeen) {
+		t.Errorf("expect node1 offline, get %+v", nodes)
+	}
+}
+
+func TestFileStateStoreNetworks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	// older snapshots key nodes by network/name
+	err := os.WriteFile(path, []byte(`{"Seq":1,"Nodes":{"staging/db1":{"Name":"db1","Network":"staging","IP":"10.1.0.2/24"}}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenFileStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.SaveNode(&NodeState{Name: "staging/db1", IP: "10.0.0.9/24"}); err != nil {
+		t.Fatal(err)
+	}
+	n, _ := s.Node("staging", "db1")
+	if n == nil || n.IP != "10.1.0.2/24" {
+		t.Errorf("unexpected staging db1 state %+v", n)
+	}
+	n, _ = s.Node(DefaultNetwork, "staging/db1")
+	if n == nil || n.IP != "10.0.0.9/24" {
+		t.Errorf("unexpected default staging/db1 state %+v", n)
+	}
+}
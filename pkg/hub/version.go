@@ -0,0 +1,69 @@
+package hub
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/withz/ptun/model"
+	"github.com/withz/ptun/pkg/proto"
+)
+
+// Features of hub protocol, hub does not push the messages of a feature to nodes without it.
+const (
+	FeaturePeerEvents = "peer-events"
+	FeatureRoutes     = "routes"
+	FeatureACL        = "acl"
+)
+
+var (
+	// Features are supported by this build
+	Features = []string{FeaturePeerEvents, FeatureRoutes, FeatureACL}
+	// DefaultCodecs are offered by nodes in preference order
+	DefaultCodecs = []string{proto.CodecCBOR, proto.CodecJSON}
+
+	errUnknownCodec = errors.New("unknown codec")
+)
+
+type negotiation struct {
+	version  int
+	codec    proto.Codec
+	features []string
+}
+
+// negotiateLogin picks the lower version, the first codec of node known by hub and the common features.
+// Nodes older than negotiation get json and no features.
+func negotiateLogin(login *model.LoginRequest) *negotiation {
+	n := &negotiation{
+		version: min(login.Version, proto.Version),
+		codec:   proto.DefaultCodec(),
+	}
+	for _, name := range login.Codecs {
+		if c, ok := proto.GetCodec(name); ok {
+			n.codec = c
+			break
+		}
+	}
+	for _, f := range login.Features {
+		if slices.Contains(Features, f) {
+			n.features = append(n.features, f)
+		}
+	}
+	return n
+}
+
+// acceptNegotiation applies the result of hub, hubs older than negotiation give no codec.
+func acceptNegotiation(resp *model.LoginResponse) (*negotiation, error) {
+	n := &negotiation{
+		version:  min(resp.Version, proto.Version),
+		codec:    proto.DefaultCodec(),
+		features: resp.Features,
+	}
+	if resp.Codec != "" {
+		c, ok := proto.GetCodec(resp.Codec)
+		if !ok {
+			return nil, errUnknownCodec
+		}
+		n.codec = c
+	}
+	return n, nil
+}
@@ -0,0 +1,35 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/withz/ptun/model"
+	"github.com/withz/ptun/pkg/proto"
+)
+
+func TestNegotiateLogin(t *testing.T) {
+	// node older than negotiation
+	n := negotiateLogin(&model.LoginRequest{Name: "node1"})
+	if n.version != 0 || n.codec.Name() != proto.CodecJSON || len(n.features) != 0 {
+		t.Errorf("unexpected negotiation of old node %+v", n)
+	}
+
+	n = negotiateLogin(&model.LoginRequest{
+		Name:     "node1",
+		Version:  proto.Version + 1,
+		Codecs:   []string{"msgpack", proto.CodecCBOR, proto.CodecJSON},
+		Features: []string{FeatureRoutes, "unknown"},
+	})
+	if n.version != proto.Version || n.codec.Name() != proto.CodecCBOR || len(n.features) != 1 || n.features[0] != FeatureRoutes {
+		t.Errorf("unexpected negotiation %+v", n)
+	}
+
+	// hub older than negotiation
+	n, err := acceptNegotiation(&model.LoginResponse{Name: "node1"})
+	if err != nil || n.codec.Name() != proto.CodecJSON {
+		t.Errorf("unexpected negotiation of old hub %+v, %v", n, err)
+	}
+	if _, err := acceptNegotiation(&model.LoginResponse{Codec: "msgpack"}); err == nil {
+		t.Errorf("expect unknown codec error")
+	}
+}
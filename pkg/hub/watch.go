@@ -0,0 +1,69 @@
+package hub
+
+import (
+	"time"
+)
+
+// PeerResyncInterval is the interval to retry peers which are online but not connected
+const PeerResyncInterval = 1 * time.Minute
+
+// Peers are the peers connected by node.
+type Peers interface {
+	HasPeer(name string) bool
+	// RemovePeer drops the connection of peer and the routes bound to its address
+	RemovePeer(name string)
+}
+
+// WatchPeers punches the peers online at login, then reacts to presence events pushed by hub
+// until the session is lost. Only the side with smaller name punches a joined or resynced peer, so
+// a pair is punched once. Peers failed to connect are retried every PeerResyncInterval, and peers
+// left are removed at once.
+func (e *Exchanger) WatchPeers(peers Peers, events <-chan *PeerEvent) {
+	// punch tells if this side punches p, the other side punches when its name is smaller
+	punch := func(p string) bool {
+		return e.GetName() < p && !peers.HasPeer(p)
+	}
+	online, err := e.GetPeers()
+	if err != nil {
+		return
+	}
+	for _, p := range online {
+		if punch(p) {
+			e.PunchPeer(p, e.GetIP())
+		}
+	}
+
+	ticker := time.NewTicker(PeerResyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			switch ev.Type {
+			case PeerJoined:
+				if punch(ev.PeerName) {
+					e.PunchPeer(ev.PeerName, e.GetIP())
+				}
+			case PeerLeft:
+				peers.RemovePeer(ev.PeerName)
+			case PeerAddressChanged:
+				// routes of peer are bound to its old address. The peer does not get its own event,
+				// so this side punches whatever the names are
+				peers.RemovePeer(ev.PeerName)
+				e.PunchPeer(ev.PeerName, e.GetIP())
+			}
+		case <-ticker.C:
+			online, err := e.GetPeers()
+			if err != nil {
+				return
+			}
+			for _, p := range online {
+				if punch(p) {
+					e.PunchPeer(p, e.GetIP())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+// recordPeers is connected to all peers, and records the peers removed.
+type recordPeers struct {
+	removed chan string
+}
+
+func (p *recordPeers) HasPeer(name string) bool {
+	return true
+}
+
+func (p *recordPeers) RemovePeer(name string) {
+	p.removed <- name
+}
+
+func TestWatchPeers(t *testing.T) {
+	h := NewHub(NewTcpHubServer(&TcpHubServerConfig{Port: 21061, Token: "abab"}))
+	if err := h.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	login := func(name string) *Exchanger {
+		ex, err := NewExchanger(NewTcpHubClient(&TcpHubClientConfig{
+			Host:       "127.0.0.1",
+			Port:       21061,
+			ClientName: name,
+			Token:      "abab",
+		}), &stubDetector{}, "", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	ex2 := login("node2")
+	defer ex2.Close()
+	peers := &recordPeers{removed: make(chan string, 1)}
+	events := ex2.Subscribe()
+	go ex2.WatchPeers(peers, events)
+
+	ex1 := login("node1")
+	ex1.Close()
+	select {
+	case name := <-peers.removed:
+		if name != "node1" {
+			t.Errorf("expect node1 removed, get %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expect node1 removed when it left")
+	}
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "ptun"
+
+const (
+	Rx = "rx"
+	Tx = "tx"
+
+	Success = "success"
+	Failure = "failure"
+
+	DropNoRoute    = "no_route"
+	DropWriteError = "write_error"
+	DropFiltered   = "filtered"
+	DropFirewall   = "firewall"
+	DropFragment   = "fragment"
+)
+
+var (
+	// PeerPackets and PeerBytes are labeled by peer name and direction, rx is from peer and tx is to peer
+	PeerPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peer_packets_total",
+		Help:      "Packets transferred with peer.",
+	}, []string{"peer", "direction"})
+
+	PeerBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "peer_bytes_total",
+		Help:      "Bytes transferred with peer.",
+	}, []string{"peer", "direction"})
+
+	DroppedPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dropped_packets_total",
+		Help:      "Packets dropped by bridge.",
+	}, []string{"reason"})
+
+	PunchAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "punch_attempts_total",
+		Help:      "Hole punching attempts by nat class.",
+	}, []string{"class"})
+
+	PunchResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "punch_results_total",
+		Help:      "Hole punching results by nat class.",
+	}, []string{"class", "result"})
+
+	// PunchAnalyzes is counted by hub when it plans the punching of two nodes
+	PunchAnalyzes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "punch_analyzes_total",
+		Help:      "Nat analyzes of punch requests by nat class.",
+	}, []string{"class", "result"})
+
+	HubSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "hub_sessions",
+		Help:      "Active node sessions of hub.",
+	})
+
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of requests waiting for response.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"message"})
+
+	KeepaliveTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "keepalive_timeouts_total",
+		Help:      "Connections closed for keepalive timeout.",
+	})
+)
+
+// DeletePeer removes the series of peer, called when peer is disconnected.
+func DeletePeer(name string) {
+	PeerPackets.DeletePartialMatch(prometheus.Labels{"peer": name})
+	PeerBytes.DeletePartialMatch(prometheus.Labels{"peer": name})
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/elliotchance/pie/v2"
 	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/pkg/metrics"
 	"github.com/withz/ptun/pkg/network"
 )
 
@@ -28,7 +29,17 @@ type Resource struct {
 	LocalPortCount  int
 }
 
+// Class tells how hard the nats of both sides are to punch.
+type Class string
+
+const (
+	DoubleEasy Class = "easy-easy"
+	HasEasy    Class = "easy-hard"
+	DoubleHard Class = "hard-hard"
+)
+
 type AnalyzeResult struct {
+	Class             Class `json:",omitempty"`
 	LocalAddrs        []string
 	RemoteLocalAddrs  []string
 	RemoteMappedAddrs []string
@@ -55,6 +66,7 @@ func GetNatFromAnalyze(lresult *AnalyzeResult, rresult *AnalyzeResult) (localNat
 		return nil, nil, err
 	}
 	localNat = &Nat{
+		Class:             lresult.Class,
 		LocalAddrs:        localAddrs,
 		RemoteMappedAddrs: remoteAddrs,
 		Role:              lresult.Role,
@@ -62,6 +74,7 @@ func GetNatFromAnalyze(lresult *AnalyzeResult, rresult *AnalyzeResult) (localNat
 		Actions:           lresult.Actions,
 	}
 	remoteNat = &Nat{
+		Class:             rresult.Class,
 		LocalAddrs:        rLocalAddrs,
 		RemoteMappedAddrs: rRemoteAddrs,
 		Role:              rresult.Role,
@@ -72,12 +85,24 @@ func GetNatFromAnalyze(lresult *AnalyzeResult, rresult *AnalyzeResult) (localNat
 }
 
 func Analyze(local *DetectResult, remote *DetectResult) (lresult *AnalyzeResult, rresult *AnalyzeResult, err error) {
-	hardLocal := isRandomPort(local) || isMultiExternIP(local)
-	hardRemote := isRandomPort(remote) || isMultiExternIP(remote)
+	hardLocal := isHard(local)
+	hardRemote := isHard(remote)
 
+	class := HasEasy
 	switch {
 	case !hardLocal && !hardRemote:
-		lresult, rresult, err = analyzeDoubleEasy(local, remote)
+		class = DoubleEasy
+	case hardLocal && hardRemote:
+		class = DoubleHard
+	}
+	switch {
+	case !hardLocal && !hardRemote:
+		// server side opens its filter first, so the restricted side should be server side
+		if isOpenFilter(remote) && !isOpenFilter(local) {
+			rresult, lresult, err = analyzeDoubleEasy(remote, local)
+		} else {
+			lresult, rresult, err = analyzeDoubleEasy(local, remote)
+		}
 	case hardLocal && !hardRemote:
 		lresult, rresult, err = analyzeHasEasy(local, remote)
 	case !hardLocal && hardRemote:
@@ -86,8 +111,12 @@ func Analyze(local *DetectResult, remote *DetectResult) (lresult *AnalyzeResult,
 		lresult, rresult, err = analyzeDoubleHard(local, remote)
 	}
 	if err != nil {
+		metrics.PunchAnalyzes.WithLabelValues(string(class), metrics.Failure).Inc()
 		return nil, nil, err
 	}
+	metrics.PunchAnalyzes.WithLabelValues(string(class), metrics.Success).Inc()
+	lresult.Class = class
+	rresult.Class = class
 
 	a, _ := json.Marshal(lresult)
 	b, _ := json.Marshal(rresult)
@@ -167,6 +196,26 @@ func analyzeHasEasy(local *DetectResult, remote *DetectResult) (lresult *Analyze
 			},
 		},
 	}
+	if isOpenFilter(remote) {
+		// remote accepts packets from any port, no need to guess the ports of hard side
+		rresult = &AnalyzeResult{
+			LocalAddrs:        []string{remote.LocalAddr},
+			RemoteLocalAddrs:  filter([]string{local.LocalAddr}),
+			RemoteMappedAddrs: filter([]string{local.PrimaryMappedAddr, local.SecondaryMappedAddr}),
+			Role:              ServerSide,
+			Resource: Resource{
+				LocalPortCount:  1,
+				RemotePortCount: 1,
+			},
+			Actions: []Action{
+				{
+					Repeat:    true,
+					TryRemote: true,
+				},
+			},
+		}
+		return lresult, rresult, nil
+	}
 	ls, le, _ := portsDistance(local)
 	if ls > 10000 {
 		ls = 10000
@@ -278,6 +327,23 @@ func resolve(addrs []string) ([]*net.UDPAddr, error) {
 	return results, nil
 }
 
+// isHard reports whether the mapped port changes with destination. The behavior from
+// standard stun server is preferred, otherwise guess it from the two mapped addrs.
+func isHard(r *DetectResult) bool {
+	switch r.MappingBehavior {
+	case NoNAT, EndpointIndependent:
+		return false
+	case AddressDependent, AddressPortDependent:
+		return true
+	}
+	return isRandomPort(r) || isMultiExternIP(r)
+}
+
+// isOpenFilter reports whether the nat accepts packets from any remote endpoint once mapped.
+func isOpenFilter(r *DetectResult) bool {
+	return r.MappingBehavior == NoNAT || r.FilterBehavior == EndpointIndependent
+}
+
 func isMultiExternIP(r *DetectResult) bool {
 	primary, _ := net.ResolveUDPAddr("udp", r.PrimaryMappedAddr)
 	secondary, _ := net.ResolveUDPAddr("udp", r.SecondaryMappedAddr)
@@ -0,0 +1,47 @@
+package nat
+
+import (
+	"testing"
+)
+
+func TestAnalyzeFilterBehavior(t *testing.T) {
+	open := &DetectResult{
+		LocalAddr:           "0.0.0.0:30001",
+		PrimaryMappedAddr:   "1.1.1.1:30001",
+		SecondaryMappedAddr: "1.1.1.1:30001",
+		MappingBehavior:     EndpointIndependent,
+		FilterBehavior:      EndpointIndependent,
+	}
+	restricted := &DetectResult{
+		LocalAddr:           "0.0.0.0:30002",
+		PrimaryMappedAddr:   "2.2.2.2:30002",
+		SecondaryMappedAddr: "2.2.2.2:30002",
+		MappingBehavior:     EndpointIndependent,
+		FilterBehavior:      AddressPortDependent,
+	}
+	lr, rr, err := Analyze(restricted, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lr.Role != ServerSide || rr.Role != ClientSide {
+		t.Errorf("restricted side should open filter first as server, get %s and %s", lr.Role, rr.Role)
+	}
+
+	hard := &DetectResult{
+		LocalAddr:           "0.0.0.0:30003",
+		PrimaryMappedAddr:   "3.3.3.3:30003",
+		SecondaryMappedAddr: "3.3.3.3:30003",
+		MappingBehavior:     AddressPortDependent,
+		FilterBehavior:      AddressPortDependent,
+	}
+	lr, rr, err = Analyze(hard, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lr.Resource.LocalPortCount != 256 {
+		t.Errorf("hard side should open many ports, get %d", lr.Resource.LocalPortCount)
+	}
+	if rr.Resource.RemotePortCount != 1 {
+		t.Errorf("open filter side need not guess ports, get %d", rr.Resource.RemotePortCount)
+	}
+}
@@ -1,12 +1,13 @@
 package nat
 
 import (
-	"fmt"
+	"errors"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/pkg/metrics"
 	"github.com/withz/ptun/pkg/network"
 )
 
@@ -20,7 +21,10 @@ const (
 	waitMakeHoleTimeout = 5 * time.Second
 )
 
+var ErrMakeHole = errors.New("make hole error")
+
 type Nat struct {
+	Class             Class
 	LocalAddrs        []*net.UDPAddr
 	RemoteLocalAddrs  []*net.UDPAddr
 	RemoteMappedAddrs []*net.UDPAddr
@@ -30,6 +34,7 @@ type Nat struct {
 }
 
 func MakeHole(t *Nat) (conn net.PacketConn, raddr *net.UDPAddr, err error) {
+	metrics.PunchAttempts.WithLabelValues(string(t.Class)).Inc()
 	localConns, remoteAddrs := genEndpoint(t)
 
 	for _, action := range t.Actions {
@@ -57,10 +62,12 @@ func MakeHole(t *Nat) (conn net.PacketConn, raddr *net.UDPAddr, err error) {
 			if action.TryRemote {
 				echoTo(conn, raddr)
 			}
+			metrics.PunchResults.WithLabelValues(string(t.Class), metrics.Success).Inc()
 			return conn, raddr, nil
 		}
 	}
-	return conn, raddr, fmt.Errorf("make hole error")
+	metrics.PunchResults.WithLabelValues(string(t.Class), metrics.Failure).Inc()
+	return conn, raddr, ErrMakeHole
 }
 
 func echoTo(conn *net.UDPConn, raddr *net.UDPAddr) error {
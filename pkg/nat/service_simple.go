@@ -90,23 +90,51 @@ type DetectResult struct {
 	LocalAddr           string
 	PrimaryMappedAddr   string
 	SecondaryMappedAddr string
+
+	// MappingBehavior and FilterBehavior are only given by standard stun server
+	MappingBehavior Behavior `json:",omitempty"`
+	FilterBehavior  Behavior `json:",omitempty"`
+}
+
+type Detector interface {
+	Detect() (*DetectResult, error)
+}
+
+const (
+	SimpleDetectorType   = "simple"
+	StandardDetectorType = "standard"
+)
+
+// NewDetector gives the detector working with the stun server of type, the simple one when type is
+// empty. The standard one only uses the primary port, and starts classifying the nat at once.
+func NewDetector(typ string, host string, primary, secondary int) (Detector, error) {
+	switch typ {
+	case "", SimpleDetectorType:
+		return NewSimpleDetector(host, primary, secondary), nil
+	case StandardDetectorType:
+		d := NewStandardDetector(host, primary)
+		d.classify()
+		return d, nil
+	}
+	return nil, fmt.Errorf("unknown stun server type %s", typ)
 }
 
-type Detector struct {
+// SimpleDetector works with the simple server, it only knows the mapped addrs of two ports.
+type SimpleDetector struct {
 	host      string
 	primary   int
 	secondary int
 }
 
-func NewDetector(host string, primary, secondary int) *Detector {
-	return &Detector{
+func NewSimpleDetector(host string, primary, secondary int) *SimpleDetector {
+	return &SimpleDetector{
 		host:      host,
 		primary:   primary,
 		secondary: secondary,
 	}
 }
 
-func (d *Detector) Detect() (*DetectResult, error) {
+func (d *SimpleDetector) Detect() (*DetectResult, error) {
 	return Detect(d.host, d.primary, d.secondary)
 }
 
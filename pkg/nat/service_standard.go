@@ -0,0 +1,150 @@
+package nat
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/pion/stun/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	changeIPFlag   = 0x04
+	changePortFlag = 0x02
+
+	stunSoftware = "ptun"
+)
+
+var (
+	errNotBindingRequest   = errors.New("not a binding request")
+	errInvalidStunServerIP = errors.New("invalid stun server ip")
+)
+
+// NatServer is the server side of nat detection, which hub runs beside itself.
+type NatServer interface {
+	Start() error
+	Stop() error
+}
+
+// StandardServer is a RFC 5389/5780 stun server. It listens on two ips and two ports,
+// so CHANGE-REQUEST can be answered from the alternate ip and/or port.
+type StandardServer struct {
+	PrimaryIP     string
+	SecondaryIP   string
+	PrimaryPort   int
+	SecondaryPort int
+
+	// listeners are indexed by [ip][port], 0 is primary and 1 is secondary
+	listeners [2][2]*net.UDPConn
+}
+
+func NewStandardServer(ip1, ip2 string, p1, p2 int) *StandardServer {
+	return &StandardServer{
+		PrimaryIP:     ip1,
+		SecondaryIP:   ip2,
+		PrimaryPort:   p1,
+		SecondaryPort: p2,
+	}
+}
+
+func (s *StandardServer) Start() (err error) {
+	logrus.Info("standard nat server start")
+
+	ips := [2]net.IP{net.ParseIP(s.PrimaryIP), net.ParseIP(s.SecondaryIP)}
+	ports := [2]int{s.PrimaryPort, s.SecondaryPort}
+	for i, ip := range ips {
+		if ip == nil {
+			s.Stop()
+			return errInvalidStunServerIP
+		}
+		for j, port := range ports {
+			s.listeners[i][j], err = net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+			if err != nil {
+				s.Stop()
+				return err
+			}
+		}
+	}
+
+	handler := func(i, j int) {
+		for {
+			err := s.handleConnection(i, j)
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				logrus.Info("standard nat server stopped")
+				break
+			}
+			if err != nil {
+				logrus.Debugf("handle stun message error, %s", err.Error())
+			}
+		}
+	}
+	for i := range s.listeners {
+		for j := range s.listeners[i] {
+			go handler(i, j)
+		}
+	}
+	return nil
+}
+
+func (s *StandardServer) Stop() error {
+	for i := range s.listeners {
+		for j := range s.listeners[i] {
+			if s.listeners[i][j] != nil {
+				s.listeners[i][j].Close()
+			}
+		}
+	}
+	return nil
+}
+
+func (s *StandardServer) handleConnection(i, j int) error {
+	conn := s.listeners[i][j]
+	p := make([]byte, 1500)
+	n, addr, err := conn.ReadFromUDP(p)
+	if err != nil {
+		return err
+	}
+	p = p[:n]
+	if !stun.IsMessage(p) {
+		return errNotBindingRequest
+	}
+	req := &stun.Message{Raw: p}
+	if err = req.Decode(); err != nil {
+		return err
+	}
+	if req.Type != stun.BindingRequest {
+		return errNotBindingRequest
+	}
+
+	ri, rj := i, j
+	if v, err := req.Get(stun.AttrChangeRequest); err == nil && len(v) == 4 {
+		flags := binary.BigEndian.Uint32(v)
+		if flags&changeIPFlag != 0 {
+			ri = 1 - ri
+		}
+		if flags&changePortFlag != 0 {
+			rj = 1 - rj
+		}
+	}
+	reply := s.listeners[ri][rj]
+	origin := reply.LocalAddr().(*net.UDPAddr)
+	other := s.listeners[1-i][1-j].LocalAddr().(*net.UDPAddr)
+
+	resp, err := stun.Build(
+		stun.NewTransactionIDSetter(req.TransactionID),
+		stun.BindingSuccess,
+		&stun.XORMappedAddress{IP: addr.IP, Port: addr.Port},
+		&stun.MappedAddress{IP: addr.IP, Port: addr.Port},
+		&stun.ResponseOrigin{IP: origin.IP, Port: origin.Port},
+		&stun.OtherAddress{IP: other.IP, Port: other.Port},
+		stun.NewSoftware(stunSoftware),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = reply.WriteToUDP(resp.Raw, addr)
+	return err
+}
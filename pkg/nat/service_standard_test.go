@@ -0,0 +1,24 @@
+package nat
+
+import (
+	"testing"
+)
+
+func TestStandardServer(t *testing.T) {
+	s := NewStandardServer("127.0.0.1", "127.0.0.2", 21021, 21022)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	b, err := AnalyzeStunBehavior("127.0.0.1:21021")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.MappingBehavior != EndpointIndependent {
+		t.Errorf("mapping behavior should be %s, but get %s", EndpointIndependent, b.MappingBehavior)
+	}
+	if b.FilterBehavior != EndpointIndependent {
+		t.Errorf("filter behavior should be %s, but get %s", EndpointIndependent, b.FilterBehavior)
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"errors"
 	"net"
 	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pion/stun/v2"
+	"github.com/sirupsen/logrus"
 )
 
 type Behavior string
@@ -84,6 +87,117 @@ func AnalyzeStunBehavior(stunAddr string) (*StunBehavior, error) {
 	}, nil
 }
 
+// StandardDetector works with a RFC 5780 stun server, it classifies mapping and filtering behavior.
+// The filter tests wait for replies which a filtering nat drops, so the behavior is classified in
+// background at first and again when the mapping changes, and Detect only binds a new port.
+type StandardDetector struct {
+	host string
+	port int
+
+	// behavior is the last classification, nil before the first one is done
+	behavior    *StunBehavior
+	classifying bool
+	mutex       sync.Mutex
+}
+
+func NewStandardDetector(host string, port int) *StandardDetector {
+	return &StandardDetector{
+		host: host,
+		port: port,
+	}
+}
+
+func (d *StandardDetector) addr() string {
+	return net.JoinHostPort(d.host, strconv.Itoa(d.port))
+}
+
+// Detect gives the mapped addrs of a new port with the behavior classified last, which is empty
+// until the first classification is done.
+func (d *StandardDetector) Detect() (*DetectResult, error) {
+	r, err := bindStun(d.addr())
+	if err != nil {
+		return nil, err
+	}
+	d.mutex.Lock()
+	b := d.behavior
+	d.mutex.Unlock()
+	if b == nil || mappingChanged(b, r) {
+		d.classify()
+		return r, nil
+	}
+	r.MappingBehavior = b.MappingBehavior
+	r.FilterBehavior = b.FilterBehavior
+	return r, nil
+}
+
+// Classify runs the mapping and filter tests now and keeps the behavior for Detect.
+func (d *StandardDetector) Classify() error {
+	b, err := AnalyzeStunBehavior(d.addr())
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.behavior = b
+	return nil
+}
+
+// classify runs Classify in background once at a time.
+func (d *StandardDetector) classify() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.classifying {
+		return
+	}
+	d.classifying = true
+	go func() {
+		err := d.Classify()
+		if err != nil {
+			logrus.Debugf("classify nat behavior err, %s", err.Error())
+		}
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		d.classifying = false
+	}()
+}
+
+// mappingChanged tells whether the nat maps otherwise than it did when b was classified.
+func mappingChanged(b *StunBehavior, r *DetectResult) bool {
+	primary, err := net.ResolveUDPAddr("udp", r.PrimaryMappedAddr)
+	if err != nil || len(b.MappedIpList) == 0 || b.MappedIpList[0] != primary.IP.String() {
+		return true
+	}
+	independent := b.MappingBehavior == NoNAT || b.MappingBehavior == EndpointIndependent
+	return independent != (r.PrimaryMappedAddr == r.SecondaryMappedAddr)
+}
+
+// bindStun gives the mapped addrs of a new port from the primary ip and the alternate ip of stun
+// server, which are answered by it whatever the nat filters.
+func bindStun(stunAddr string) (*DetectResult, error) {
+	conn, err := connectStun(stunAddr, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.conn.Close()
+
+	if _, err = mappingTest1(conn); err != nil {
+		return nil, err
+	}
+	if _, err = mappingTest2(conn); err != nil {
+		return nil, err
+	}
+	// the second mapped addr comes from the request to the alternate ip
+	secondary := conn.mappedAddrs[0]
+	if len(conn.mappedAddrs) > 1 {
+		secondary = conn.mappedAddrs[1]
+	}
+	return &DetectResult{
+		LocalAddr:           conn.LocalAddr.String(),
+		PrimaryMappedAddr:   conn.mappedAddrs[0].String(),
+		SecondaryMappedAddr: secondary.String(),
+	}, nil
+}
+
 func MappingTests(stunAddr string) (Behavior, error) {
 	conn, err := connectStun(stunAddr, nil)
 	if err != nil {
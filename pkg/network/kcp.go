@@ -11,16 +11,19 @@ type KcpConn struct {
 	kcpConn *kcp.UDPSession
 }
 
-func NewKcpConn(conn net.PacketConn, raddr net.Addr) (net.Conn, error) {
-	kcpConn, err := kcp.NewConn3(1, raddr, nil, 10, 3, conn)
+func NewKcpConn(conn net.PacketConn, raddr net.Addr, opts *KcpOptions) (net.Conn, error) {
+	if opts == nil {
+		opts = &DefaultKcpOptions
+	}
+	kcpConn, err := kcp.NewConn3(1, raddr, nil, opts.DataShards, opts.ParityShards, conn)
 	if err != nil {
 		return nil, err
 	}
 	kcpConn.SetStreamMode(true)
 	kcpConn.SetWriteDelay(true)
-	kcpConn.SetNoDelay(1, 20, 2, 1)
-	kcpConn.SetMtu(1350)
-	kcpConn.SetWindowSize(1024, 1024)
+	kcpConn.SetNoDelay(opts.NoDelay, opts.Interval, opts.Resend, opts.NoCongestion)
+	kcpConn.SetMtu(opts.Mtu)
+	kcpConn.SetWindowSize(opts.SndWnd, opts.RcvWnd)
 	kcpConn.SetACKNoDelay(false)
 	return &KcpConn{
 		kcpConn: kcpConn,
@@ -21,7 +21,14 @@ type quicConn struct {
 	stream   quic.Stream
 }
 
-func NewQuicConn(ctx context.Context, conn net.PacketConn, raddr net.Addr, role string) (net.Conn, error) {
+func NewQuicConn(ctx context.Context, conn net.PacketConn, raddr net.Addr, role string, opts *QuicOptions) (net.Conn, error) {
+	if opts == nil {
+		opts = &DefaultQuicOptions
+	}
+	quicConfig := &quic.Config{
+		MaxIdleTimeout:  opts.IdleTimeout,
+		KeepAlivePeriod: opts.KeepAlivePeriod,
+	}
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true,
 		NextProtos:         []string{"quic"},
@@ -32,7 +39,7 @@ func NewQuicConn(ctx context.Context, conn net.PacketConn, raddr net.Addr, role
 		tlsConfig.Certificates = []tls.Certificate{*cert}
 
 		conn.Close()
-		listener, err := quic.ListenAddr(conn.LocalAddr().String(), tlsConfig, nil)
+		listener, err := quic.ListenAddr(conn.LocalAddr().String(), tlsConfig, quicConfig)
 		if err != nil {
 			return nil, err
 		}
@@ -54,7 +61,7 @@ func NewQuicConn(ctx context.Context, conn net.PacketConn, raddr net.Addr, role
 		}, nil
 	} else {
 		tlsConfig.ServerName = raddr.String()
-		client, err := quic.Dial(ctx, conn, raddr, tlsConfig, nil)
+		client, err := quic.Dial(ctx, conn, raddr, tlsConfig, quicConfig)
 		if err != nil {
 			return nil, err
 		}
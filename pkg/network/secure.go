@@ -0,0 +1,488 @@
+package network
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	secureInit   byte = 1
+	secureResp   byte = 2
+	secureRecord byte = 3
+
+	secureKeySize        = chacha20poly1305.KeySize
+	securePubSize        = 32
+	secureMacSize        = sha256.Size
+	secureRecordHeader   = 1 + 1 + 8
+	secureMaxRecordSize  = 65535
+	secureReplayWindow   = 64
+	secureHandshakeRetry = 1 * time.Second
+	secureHandshakeWait  = 10 * time.Second
+
+	// keys are rotated after whichever limit comes first
+	SecureRekeyMessages = 1 << 20
+	SecureRekeyInterval = 2 * time.Minute
+)
+
+// Encryptions of peer conns, hub negotiates them like transports.
+const (
+	EncryptionNone = "none"
+	EncryptionAEAD = "aead"
+)
+
+var (
+	errSecureHandshake = errors.New("secure handshake failed")
+	errSecureReplay    = errors.New("secure record replayed")
+	errSecureEpoch     = errors.New("secure record epoch mismatch")
+	errSecureMalformed = errors.New("secure record malformed")
+	errSecureTimeout   = errors.New("secure handshake timeout")
+)
+
+type SecureConfig struct {
+	// Key is the pre-shared key which authenticates the handshake
+	Key []byte
+	// Identity signs the ephemeral key of this side, PeerKey verifies the one of peer. With
+	// PeerKey only the holder of its private key completes the handshake, even if Key is shared.
+	Identity  ed25519.PrivateKey
+	PeerKey   ed25519.PublicKey
+	Initiator bool
+	// Stream should be set when conn does not keep message boundary, such as tcp or quic stream
+	Stream bool
+}
+
+type cipherState struct {
+	key     []byte
+	aead    cipher.AEAD
+	epoch   uint8
+	counter uint64
+	created time.Time
+
+	// replay window, highest counter seen and bitmap of the previous ones
+	highest uint64
+	bitmap  uint64
+	seen    bool
+}
+
+func newCipherState(key []byte, epoch uint8) (*cipherState, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherState{
+		key:     key,
+		aead:    aead,
+		epoch:   epoch,
+		created: time.Now(),
+	}, nil
+}
+
+func (cs *cipherState) next() (*cipherState, error) {
+	key := make([]byte, secureKeySize)
+	_, err := io.ReadFull(hkdf.Expand(sha256.New, cs.key, []byte("ptun rekey")), key)
+	if err != nil {
+		return nil, err
+	}
+	return newCipherState(key, cs.epoch+1)
+}
+
+func (cs *cipherState) nonce(counter uint64) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n
+}
+
+// check tells whether counter is fresh, it does not update the window
+func (cs *cipherState) check(counter uint64) bool {
+	if !cs.seen || counter > cs.highest {
+		return true
+	}
+	diff := cs.highest - counter
+	if diff >= secureReplayWindow {
+		return false
+	}
+	return cs.bitmap&(1<<diff) == 0
+}
+
+func (cs *cipherState) update(counter uint64) {
+	if !cs.seen {
+		cs.seen = true
+		cs.highest = counter
+		cs.bitmap = 1
+		return
+	}
+	if counter > cs.highest {
+		shift := counter - cs.highest
+		if shift >= secureReplayWindow {
+			cs.bitmap = 0
+		} else {
+			cs.bitmap <<= shift
+		}
+		cs.bitmap |= 1
+		cs.highest = counter
+		return
+	}
+	cs.bitmap |= 1 << (cs.highest - counter)
+}
+
+// secureConn protects every written message with chacha20-poly1305. Session keys come from
+// an ephemeral x25519 exchange authenticated by the pre-shared key and the identity keys of
+// both sides when given, and are rotated by epoch.
+type secureConn struct {
+	conn net.Conn
+	cfg  *SecureConfig
+
+	sendMutex sync.Mutex
+	send      *cipherState
+
+	recvMutex sync.Mutex
+	recv      *cipherState
+	prevRecv  *cipherState
+
+	readBuf []byte
+	// kept by responder to answer the retransmitted init
+	initMsg []byte
+	respMsg []byte
+}
+
+func NewSecureConn(conn net.Conn, cfg *SecureConfig) (net.Conn, error) {
+	sc := &secureConn{
+		conn:    conn,
+		cfg:     cfg,
+		readBuf: make([]byte, secureMaxRecordSize),
+	}
+	conn.SetDeadline(time.Now().Add(secureHandshakeWait))
+	defer conn.SetDeadline(time.Time{})
+
+	var err error
+	if cfg.Initiator {
+		err = sc.handshakeInitiator()
+	} else {
+		err = sc.handshakeResponder()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w, %w", errSecureHandshake, err)
+	}
+	return sc, nil
+}
+
+func (sc *secureConn) mac(parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, sc.cfg.Key)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// sign gives the signature of identity, empty without identity.
+func (sc *secureConn) sign(parts ...[]byte) []byte {
+	if sc.cfg.Identity == nil {
+		return nil
+	}
+	return ed25519.Sign(sc.cfg.Identity, bytes.Join(parts, nil))
+}
+
+// verify checks the signature of peer, any is accepted without PeerKey.
+func (sc *secureConn) verify(sig []byte, parts ...[]byte) bool {
+	if sc.cfg.PeerKey == nil {
+		return true
+	}
+	return len(sig) == ed25519.SignatureSize && ed25519.Verify(sc.cfg.PeerKey, bytes.Join(parts, nil), sig)
+}
+
+// parseHandshake splits the handshake message of typ into the ephemeral key, mac and the
+// signature which is empty when peer has no identity.
+func parseHandshake(msg []byte, typ byte) (pub []byte, mac []byte, sig []byte, ok bool) {
+	size := 1 + securePubSize + secureMacSize
+	if (len(msg) != size && len(msg) != size+ed25519.SignatureSize) || msg[0] != typ {
+		return nil, nil, nil, false
+	}
+	return msg[1 : 1+securePubSize], msg[1+securePubSize : size], msg[size:], true
+}
+
+func (sc *secureConn) deriveKeys(priv *ecdh.PrivateKey, peer []byte, initPub, respPub []byte) error {
+	pub, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return err
+	}
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	info := append([]byte("ptun keys"), append(initPub, respPub...)...)
+	keys := make([]byte, 2*secureKeySize)
+	_, err = io.ReadFull(hkdf.New(sha256.New, secret, sc.cfg.Key, info), keys)
+	if err != nil {
+		return err
+	}
+	i2r, r2i := keys[:secureKeySize], keys[secureKeySize:]
+	if !sc.cfg.Initiator {
+		i2r, r2i = r2i, i2r
+	}
+	sc.send, err = newCipherState(i2r, 0)
+	if err != nil {
+		return err
+	}
+	sc.recv, err = newCipherState(r2i, 0)
+	return err
+}
+
+func (sc *secureConn) handshakeInitiator() error {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	pub := priv.PublicKey().Bytes()
+	init := append([]byte{secureInit}, pub...)
+	init = append(init, sc.mac([]byte("ptun init"), pub)...)
+	init = append(init, sc.sign([]byte("ptun init"), pub)...)
+
+	if sc.cfg.Stream {
+		// a stream never loses the init, and a read cut by deadline may leave half of a frame on
+		// it, so it is one exchange bounded by the deadline of handshake
+		if _, err = sc.writeMessage(init); err != nil {
+			return err
+		}
+		msg, err := sc.readMessage()
+		if isTimeout(err) {
+			return errSecureTimeout
+		}
+		if err != nil {
+			return err
+		}
+		rpub, ok := sc.checkResp(msg, pub)
+		if !ok {
+			return errSecureMalformed
+		}
+		return sc.deriveKeys(priv, rpub, pub, rpub)
+	}
+
+	deadline := time.Now().Add(secureHandshakeWait)
+	for time.Now().Before(deadline) {
+		if _, err = sc.writeMessage(init); err != nil {
+			return err
+		}
+		sc.conn.SetReadDeadline(time.Now().Add(secureHandshakeRetry))
+		msg, err := sc.readMessage()
+		if isTimeout(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		rpub, ok := sc.checkResp(msg, pub)
+		if !ok {
+			// stray or forged datagram
+			continue
+		}
+		return sc.deriveKeys(priv, rpub, pub, rpub)
+	}
+	return errSecureTimeout
+}
+
+// checkResp verifies the response to the init with ephemeral key pub, and gives the one of responder.
+func (sc *secureConn) checkResp(msg []byte, pub []byte) ([]byte, bool) {
+	rpub, mac, sig, ok := parseHandshake(msg, secureResp)
+	if !ok || !hmac.Equal(mac, sc.mac([]byte("ptun resp"), pub, rpub)) {
+		return nil, false
+	}
+	return rpub, sc.verify(sig, []byte("ptun resp"), pub, rpub)
+}
+
+func (sc *secureConn) handshakeResponder() error {
+	for {
+		msg, err := sc.readMessage()
+		if isTimeout(err) {
+			return errSecureTimeout
+		}
+		if err != nil {
+			return err
+		}
+		ipub, mac, sig, ok := parseHandshake(msg, secureInit)
+		ok = ok && hmac.Equal(mac, sc.mac([]byte("ptun init"), ipub)) && sc.verify(sig, []byte("ptun init"), ipub)
+		if !ok && sc.cfg.Stream {
+			// only the initiator writes on a stream before keys are set
+			return errSecureMalformed
+		}
+		if !ok {
+			continue
+		}
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		pub := priv.PublicKey().Bytes()
+		resp := append([]byte{secureResp}, pub...)
+		resp = append(resp, sc.mac([]byte("ptun resp"), ipub, pub)...)
+		resp = append(resp, sc.sign([]byte("ptun resp"), ipub, pub)...)
+		if _, err = sc.writeMessage(resp); err != nil {
+			return err
+		}
+		sc.initMsg = append([]byte{}, msg...)
+		sc.respMsg = resp
+		return sc.deriveKeys(priv, ipub, ipub, pub)
+	}
+}
+
+// writeMessage writes one message, with length prefix on stream conns
+func (sc *secureConn) writeMessage(p []byte) (int, error) {
+	if !sc.cfg.Stream {
+		return sc.conn.Write(p)
+	}
+	b := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(b, uint16(len(p)))
+	copy(b[2:], p)
+	return sc.conn.Write(b)
+}
+
+// readMessage reads one message into readBuf, the result is only valid until the next read
+func (sc *secureConn) readMessage() ([]byte, error) {
+	if !sc.cfg.Stream {
+		n, err := sc.conn.Read(sc.readBuf)
+		if err != nil {
+			return nil, err
+		}
+		return sc.readBuf[:n], nil
+	}
+	h := sc.readBuf[:2]
+	if _, err := io.ReadFull(sc.conn, h); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(h))
+	if _, err := io.ReadFull(sc.conn, sc.readBuf[:n]); err != nil {
+		return nil, err
+	}
+	return sc.readBuf[:n], nil
+}
+
+func (sc *secureConn) Write(b []byte) (n int, err error) {
+	if len(b)+secureRecordHeader+chacha20poly1305.Overhead > secureMaxRecordSize {
+		return 0, errSecureMalformed
+	}
+	sc.sendMutex.Lock()
+	defer sc.sendMutex.Unlock()
+	if sc.send.counter >= SecureRekeyMessages || time.Since(sc.send.created) > SecureRekeyInterval {
+		next, err := sc.send.next()
+		if err != nil {
+			return 0, err
+		}
+		sc.send = next
+	}
+	record := make([]byte, secureRecordHeader, secureRecordHeader+len(b)+chacha20poly1305.Overhead)
+	record[0] = secureRecord
+	record[1] = sc.send.epoch
+	binary.BigEndian.PutUint64(record[2:], sc.send.counter)
+	record = sc.send.aead.Seal(record, sc.send.nonce(sc.send.counter), b, record[:secureRecordHeader])
+	sc.send.counter++
+	if _, err = sc.writeMessage(record); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (sc *secureConn) Read(b []byte) (n int, err error) {
+	sc.recvMutex.Lock()
+	defer sc.recvMutex.Unlock()
+	for {
+		msg, err := sc.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) > 0 && msg[0] == secureInit && bytes.Equal(msg, sc.initMsg) {
+			// our response was lost, answer again
+			sc.writeMessage(sc.respMsg)
+			continue
+		}
+		p, err := sc.open(msg)
+		if err != nil {
+			if sc.cfg.Stream {
+				return 0, err
+			}
+			// stray or forged datagram, drop it
+			continue
+		}
+		if len(b) < len(p) {
+			return 0, fmt.Errorf("secure read err, buf length too short")
+		}
+		return copy(b, p), nil
+	}
+}
+
+func (sc *secureConn) open(msg []byte) ([]byte, error) {
+	if len(msg) < secureRecordHeader+chacha20poly1305.Overhead || msg[0] != secureRecord {
+		return nil, errSecureMalformed
+	}
+	epoch := msg[1]
+	counter := binary.BigEndian.Uint64(msg[2:])
+
+	cs := sc.recv
+	rotated := false
+	switch {
+	case epoch == sc.recv.epoch:
+	case epoch == sc.recv.epoch+1:
+		next, err := sc.recv.next()
+		if err != nil {
+			return nil, err
+		}
+		cs, rotated = next, true
+	case sc.prevRecv != nil && epoch == sc.prevRecv.epoch:
+		cs = sc.prevRecv
+	default:
+		return nil, errSecureEpoch
+	}
+	if !cs.check(counter) {
+		return nil, errSecureReplay
+	}
+	p, err := cs.aead.Open(msg[secureRecordHeader:secureRecordHeader], cs.nonce(counter), msg[secureRecordHeader:], msg[:secureRecordHeader])
+	if err != nil {
+		return nil, err
+	}
+	cs.update(counter)
+	if rotated {
+		sc.prevRecv, sc.recv = sc.recv, cs
+	}
+	return p, nil
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (sc *secureConn) Close() error {
+	return sc.conn.Close()
+}
+
+func (sc *secureConn) LocalAddr() net.Addr {
+	return sc.conn.LocalAddr()
+}
+
+func (sc *secureConn) RemoteAddr() net.Addr {
+	return sc.conn.RemoteAddr()
+}
+
+func (sc *secureConn) SetDeadline(t time.Time) error {
+	return sc.conn.SetDeadline(t)
+}
+
+func (sc *secureConn) SetReadDeadline(t time.Time) error {
+	return sc.conn.SetReadDeadline(t)
+}
+
+func (sc *secureConn) SetWriteDeadline(t time.Time) error {
+	return sc.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,143 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSecureConn(t *testing.T) {
+	c1, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 21031}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 21032})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 21032}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 21031})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan net.Conn)
+	go func() {
+		s, err := NewSecureConn(c2, &SecureConfig{Key: []byte("abab")})
+		if err != nil {
+			t.Error(err)
+		}
+		ch <- s
+	}()
+	s1, err := NewSecureConn(c1, &SecureConfig{Key: []byte("abab"), Initiator: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := <-ch
+	if s2 == nil {
+		return
+	}
+	defer s1.Close()
+	defer s2.Close()
+
+	buf := make([]byte, 1500)
+	for _, p := range [][]byte{[]byte("ping"), []byte("pong")} {
+		if _, err = s1.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		n, err := s2.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], p) {
+			t.Errorf("secure payload mismatch, get %q", buf[:n])
+		}
+	}
+
+	// rotate keys on sender, receiver should follow
+	sc := s1.(*secureConn)
+	sc.send.counter = SecureRekeyMessages
+	if _, err = s1.Write([]byte("rekey")); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s2.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "rekey" || sc.send.epoch != 1 {
+		t.Errorf("rekey failed, get %q at epoch %d", buf[:n], sc.send.epoch)
+	}
+}
+
+func TestSecureIdentity(t *testing.T) {
+	_, id1, _ := ed25519.GenerateKey(nil)
+	_, id2, _ := ed25519.GenerateKey(nil)
+	_, other, _ := ed25519.GenerateKey(nil)
+	handshake := func(initiator ed25519.PrivateKey) (error, error) {
+		c1, c2 := net.Pipe()
+		ch := make(chan error, 1)
+		go func() {
+			_, err := NewSecureConn(c2, &SecureConfig{
+				Key:      []byte("abab"),
+				Identity: id2,
+				PeerKey:  id1.Public().(ed25519.PublicKey),
+				Stream:   true,
+			})
+			ch <- err
+		}()
+		// the handshake would be done by now when it is accepted
+		time.AfterFunc(200*time.Millisecond, func() { c1.Close(); c2.Close() })
+		_, err := NewSecureConn(c1, &SecureConfig{
+			Key:       []byte("abab"),
+			Identity:  initiator,
+			PeerKey:   id2.Public().(ed25519.PublicKey),
+			Initiator: true,
+			Stream:    true,
+		})
+		return err, <-ch
+	}
+	if err1, err2 := handshake(id1); err1 != nil || err2 != nil {
+		t.Fatalf("expect handshake with identity done, get %v %v", err1, err2)
+	}
+	// the token is known, but the identity is not the one hub verified
+	if err1, err2 := handshake(other); err1 == nil || err2 == nil {
+		t.Errorf("expect handshake of other identity failed")
+	}
+}
+
+func TestSecureStreamHandshake(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		peer := &secureConn{conn: c2, cfg: &SecureConfig{Stream: true}, readBuf: make([]byte, secureMaxRecordSize)}
+		if _, err := peer.readMessage(); err != nil {
+			return
+		}
+		peer.writeMessage([]byte{secureResp, 0})
+	}()
+	// a bad reply on stream fails the handshake at once instead of another init
+	start := time.Now()
+	_, err := NewSecureConn(c1, &SecureConfig{Key: []byte("abab"), Initiator: true, Stream: true})
+	if !errors.Is(err, errSecureMalformed) {
+		t.Errorf("expect malformed handshake, get %v", err)
+	}
+	if time.Since(start) > secureHandshakeRetry {
+		t.Errorf("expect handshake failed without retry, take %s", time.Since(start))
+	}
+}
+
+func TestSecureReplayWindow(t *testing.T) {
+	cs := &cipherState{}
+	for _, c := range []uint64{1, 3, 2, 100} {
+		if !cs.check(c) {
+			t.Errorf("counter %d should be fresh", c)
+		}
+		cs.update(c)
+	}
+	for _, c := range []uint64{1, 2, 3, 100, 36} {
+		if cs.check(c) {
+			t.Errorf("counter %d should be rejected", c)
+		}
+	}
+	if !cs.check(99) {
+		t.Errorf("counter 99 should be fresh")
+	}
+}
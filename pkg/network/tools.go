@@ -1,6 +1,7 @@
 package network
 
 import (
+	"encoding/binary"
 	"net"
 
 	"golang.org/x/net/ipv4"
@@ -92,23 +93,34 @@ func ParsePacket(data []byte) (version byte, src []byte, dst []byte) {
 	return version, src, dst
 }
 
+// PacketGetPayload gives the protocol and payload of ip packet, the payload is nil when
+// the packet is truncated.
 func PacketGetPayload(data []byte) (protocol int, payload []byte) {
 	if len(data) == 0 {
 		return 0, nil
 	}
 	version := data[0] >> 4
 	if version == 4 {
-		headerLength := (data[0] & 0xF) << 2
+		headerLength := int(data[0]&0xF) << 2
+		if headerLength < ipv4.HeaderLen || len(data) < headerLength {
+			return 0, nil
+		}
 		return int(data[9]), data[headerLength:]
 	} else if version == 6 {
+		if len(data) < IPv6FixedHeaderLength {
+			return 0, nil
+		}
 		nextHeader := int(data[6])
 		offset, nextHeader := skipIPv6ExtensionHeaders(data[IPv6FixedHeaderLength:], nextHeader)
+		if offset < 0 {
+			return 0, nil
+		}
 		return nextHeader, data[IPv6FixedHeaderLength+offset:]
 	}
 	return 0, nil
 }
 
-// skipIPv6ExtensionHeaders 跳过所有IPv6扩展头部，返回跳过的字节数和最终的NextHeader
+// skipIPv6ExtensionHeaders 跳过所有IPv6扩展头部，返回跳过的字节数和最终的NextHeader，头部被截断时字节数为-1
 func skipIPv6ExtensionHeaders(mixPayload []byte, nextHeader int) (int, int) {
 	offset := 0
 	for {
@@ -116,16 +128,63 @@ func skipIPv6ExtensionHeaders(mixPayload []byte, nextHeader int) (int, int) {
 		case 41: // 扩展头部：Encapsulated IPv6 Header
 			fallthrough
 		case 0, 43, 44, 50, 51, 60: // 扩展头部类型: Hop-by-Hop, Routing, Fragment, AH, ESP, Destination
+			if len(mixPayload) < offset+2 {
+				return -1, nextHeader
+			}
 			nextHeader = int(mixPayload[offset])
 			headerLen := (int(mixPayload[offset+1]) + 1) * 8
 			offset += headerLen
 		default:
 			// 6: upd, 17: tcp, 58: icmpv6
+			if offset > len(mixPayload) {
+				return -1, nextHeader
+			}
 			return offset, nextHeader
 		}
 	}
 }
 
+// PacketFragment gives the fragment id and offset of ip packet, the packet is fragmented when more
+// is set or offset is not zero. Only the first fragment carries the headers of tcp, udp and icmp.
+func PacketFragment(data []byte) (id uint32, offset int, more bool) {
+	if len(data) == 0 {
+		return 0, 0, false
+	}
+	version := data[0] >> 4
+	if version == 4 {
+		if len(data) < ipv4.HeaderLen {
+			return 0, 0, false
+		}
+		fragment := binary.BigEndian.Uint16(data[6:8])
+		return uint32(binary.BigEndian.Uint16(data[4:6])), int(fragment&0x1FFF) * 8, fragment&0x2000 != 0
+	} else if version == 6 {
+		if len(data) < IPv6FixedHeaderLength {
+			return 0, 0, false
+		}
+		nextHeader := data[6]
+		header := data[IPv6FixedHeaderLength:]
+		for {
+			switch nextHeader {
+			case 0, 43, 60: // 扩展头部类型: Hop-by-Hop, Routing, Destination
+				if len(header) < 2 || len(header) < (int(header[1])+1)*8 {
+					return 0, 0, false
+				}
+				nextHeader = header[0]
+				header = header[(int(header[1])+1)*8:]
+			case 44: // Fragment
+				if len(header) < 8 {
+					return 0, 0, false
+				}
+				fragment := binary.BigEndian.Uint16(header[2:4])
+				return binary.BigEndian.Uint32(header[4:8]), int(fragment>>3) * 8, fragment&1 != 0
+			default:
+				return 0, 0, false
+			}
+		}
+	}
+	return 0, 0, false
+}
+
 func ParseIPNets(cidrs []string) ([]net.IP, []*net.IPNet, error) {
 	nets := make([]*net.IPNet, 0)
 	ips := make([]net.IP, 0)
@@ -0,0 +1,39 @@
+package network
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestPacketFragment(t *testing.T) {
+	v4 := make([]byte, 28)
+	v4[0] = 0x45
+	binary.BigEndian.PutUint16(v4[4:], 7)
+	if _, offset, more := PacketFragment(v4); offset != 0 || more {
+		t.Errorf("expect whole ipv4 packet")
+	}
+	binary.BigEndian.PutUint16(v4[6:], 0x2000)
+	if id, offset, more := PacketFragment(v4); id != 7 || offset != 0 || !more {
+		t.Errorf("expect first ipv4 fragment, get %d %d %v", id, offset, more)
+	}
+	binary.BigEndian.PutUint16(v4[6:], 185)
+	if id, offset, more := PacketFragment(v4); id != 7 || offset != 1480 || more {
+		t.Errorf("expect last ipv4 fragment, get %d %d %v", id, offset, more)
+	}
+
+	// hop-by-hop header before fragment header
+	v6 := make([]byte, IPv6FixedHeaderLength+16)
+	v6[0] = 0x60
+	v6[6] = 0
+	v6[IPv6FixedHeaderLength] = 44
+	frag := v6[IPv6FixedHeaderLength+8:]
+	frag[0] = 17
+	binary.BigEndian.PutUint16(frag[2:], 1480|1)
+	binary.BigEndian.PutUint32(frag[4:], 9)
+	if id, offset, more := PacketFragment(v6); id != 9 || offset != 1480 || !more {
+		t.Errorf("expect middle ipv6 fragment, get %d %d %v", id, offset, more)
+	}
+	if _, offset, more := PacketFragment(v6[:IPv6FixedHeaderLength+12]); offset != 0 || more {
+		t.Errorf("expect truncated ipv6 packet not fragmented")
+	}
+}
@@ -0,0 +1,142 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+type TransportType string
+
+const (
+	UDP  TransportType = "udp"
+	KCP  TransportType = "kcp"
+	QUIC TransportType = "quic"
+)
+
+type KcpOptions struct {
+	NoDelay      int
+	Interval     int
+	Resend       int
+	NoCongestion int
+	SndWnd       int
+	RcvWnd       int
+	Mtu          int
+	DataShards   int
+	ParityShards int
+}
+
+type QuicOptions struct {
+	IdleTimeout     time.Duration
+	KeepAlivePeriod time.Duration
+}
+
+var (
+	DefaultKcpOptions = KcpOptions{
+		NoDelay:      1,
+		Interval:     20,
+		Resend:       2,
+		NoCongestion: 1,
+		SndWnd:       1024,
+		RcvWnd:       1024,
+		Mtu:          1350,
+		DataShards:   10,
+		ParityShards: 3,
+	}
+	DefaultQuicOptions = QuicOptions{
+		IdleTimeout:     30 * time.Second,
+		KeepAlivePeriod: 10 * time.Second,
+	}
+)
+
+// KcpTransportName gives the name of kcp advertised to hub. The fec shards must be the same on both
+// peers, so they are in the name, and the default ones keep the plain name of older nodes.
+func KcpTransportName(opts *KcpOptions) string {
+	if opts.DataShards == DefaultKcpOptions.DataShards && opts.ParityShards == DefaultKcpOptions.ParityShards {
+		return string(KCP)
+	}
+	return fmt.Sprintf("%s/%d,%d", KCP, opts.DataShards, opts.ParityShards)
+}
+
+// ParseTransport gives the type of transport negotiated by hub, and sets the kcp fec shards of it
+// to opts.
+func ParseTransport(name string, opts *TransportOptions) TransportType {
+	t, shards, ok := strings.Cut(name, "/")
+	if TransportType(t) != KCP {
+		return TransportType(name)
+	}
+	opts.Kcp.DataShards = DefaultKcpOptions.DataShards
+	opts.Kcp.ParityShards = DefaultKcpOptions.ParityShards
+	if ok {
+		_, err := fmt.Sscanf(shards, "%d,%d", &opts.Kcp.DataShards, &opts.Kcp.ParityShards)
+		if err != nil {
+			return TransportType(name)
+		}
+	}
+	return KCP
+}
+
+type TransportOptions struct {
+	// Role is the nat role of this side, quic server side listens and client side dials
+	Role string
+	Kcp  KcpOptions
+	Quic QuicOptions
+}
+
+// TransportDialer turns a punched udp conn into a peer conn.
+type TransportDialer func(conn net.PacketConn, raddr *net.UDPAddr, opts *TransportOptions) (net.Conn, error)
+
+type transportEntry struct {
+	dialer TransportDialer
+	stream bool
+}
+
+var transportRegistry = map[TransportType]*transportEntry{}
+
+// RegisterTransport adds a transport, stream tells whether it loses message boundary.
+func RegisterTransport(t TransportType, stream bool, d TransportDialer) {
+	transportRegistry[t] = &transportEntry{
+		dialer: d,
+		stream: stream,
+	}
+}
+
+func HasTransport(t TransportType) bool {
+	_, ok := transportRegistry[t]
+	return ok
+}
+
+func IsStreamTransport(t TransportType) bool {
+	e, ok := transportRegistry[t]
+	return ok && e.stream
+}
+
+func NewTransportConn(t TransportType, conn net.PacketConn, raddr *net.UDPAddr, opts *TransportOptions) (net.Conn, error) {
+	e, ok := transportRegistry[t]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %s", t)
+	}
+	if opts == nil {
+		opts = &TransportOptions{
+			Kcp:  DefaultKcpOptions,
+			Quic: DefaultQuicOptions,
+		}
+	}
+	return e.dialer(conn, raddr, opts)
+}
+
+func init() {
+	RegisterTransport(UDP, false, func(conn net.PacketConn, raddr *net.UDPAddr, opts *TransportOptions) (net.Conn, error) {
+		return NewRawConn(conn, raddr)
+	})
+	RegisterTransport(KCP, true, func(conn net.PacketConn, raddr *net.UDPAddr, opts *TransportOptions) (net.Conn, error) {
+		return NewKcpConn(conn, raddr, &opts.Kcp)
+	})
+	RegisterTransport(QUIC, true, func(conn net.PacketConn, raddr *net.UDPAddr, opts *TransportOptions) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), opts.Quic.IdleTimeout)
+		defer cancel()
+		return NewQuicConn(ctx, conn, raddr, opts.Role, &opts.Quic)
+	})
+}
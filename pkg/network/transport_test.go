@@ -0,0 +1,29 @@
+package network
+
+import "testing"
+
+func TestKcpTransportName(t *testing.T) {
+	opts := DefaultKcpOptions
+	if name := KcpTransportName(&opts); name != "kcp" {
+		t.Errorf("expect plain kcp with default shards, get %s", name)
+	}
+	opts.DataShards, opts.ParityShards = 0, 0
+	name := KcpTransportName(&opts)
+	if name != "kcp/0,0" {
+		t.Errorf("expect kcp without fec, get %s", name)
+	}
+
+	parsed := TransportOptions{Kcp: DefaultKcpOptions}
+	if tt := ParseTransport(name, &parsed); tt != KCP || parsed.Kcp.DataShards != 0 || parsed.Kcp.ParityShards != 0 {
+		t.Errorf("unexpected %s with shards %d,%d", tt, parsed.Kcp.DataShards, parsed.Kcp.ParityShards)
+	}
+	if tt := ParseTransport("kcp", &parsed); tt != KCP || parsed.Kcp.DataShards != 10 || parsed.Kcp.ParityShards != 3 {
+		t.Errorf("unexpected %s with shards %d,%d", tt, parsed.Kcp.DataShards, parsed.Kcp.ParityShards)
+	}
+	if tt := ParseTransport("kcp/x", &parsed); HasTransport(tt) {
+		t.Errorf("expect invalid kcp shards unknown, get %s", tt)
+	}
+	if tt := ParseTransport("quic", &parsed); tt != QUIC {
+		t.Errorf("expect quic, get %s", tt)
+	}
+}
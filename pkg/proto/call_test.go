@@ -0,0 +1,83 @@
+package proto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type echoRequest struct {
+	N int
+}
+
+type echoResponse struct {
+	N int
+}
+
+func init() {
+	RegisterMessage(reflect.TypeFor[echoRequest]())
+	RegisterMessage(reflect.TypeFor[echoResponse]())
+}
+
+func TestCall(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewTransport(c1)
+	server := NewTransport(c2)
+	defer client.Close()
+	defer server.Close()
+
+	server.Requester.Dispatcher().AddHandler("echoRequest", func(r *Request) {
+		req, _ := GetPayload[echoRequest](r)
+		if req.N < 0 {
+			server.Responser.ReplyError(r, ErrInvalidMessage, &echoResponse{})
+			return
+		}
+		// later calls are replied first, so replies only match by id
+		time.Sleep(time.Duration(10-req.N) * time.Millisecond)
+		server.Responser.ReplySuccess(r, &echoResponse{N: req.N})
+	})
+	go server.RunDispatcher()
+	pushes := make(chan int, 1)
+	client.Responser.Dispatcher().AddHandler("echoResponse", func(r *Response) {
+		resp, _ := GetResponsePayload[echoResponse](r)
+		pushes <- resp.N
+	})
+	go client.RunDispatcher()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := client.Call(ctx, &echoRequest{N: n})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if r, _ := GetResponsePayload[echoResponse](resp); r.N != n {
+				t.Errorf("call %d get reply %d", n, r.N)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if _, err := client.SendMessage(&echoRequest{N: -1}, time.Second); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("expect invalid message, get %v", err)
+	}
+
+	server.Responser.SendSuccess(&echoResponse{N: 100})
+	select {
+	case n := <-pushes:
+		if n != 100 {
+			t.Errorf("expect push 100, get %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Error("wait push timeout")
+	}
+}
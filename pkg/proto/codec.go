@@ -0,0 +1,105 @@
+package proto
+
+import (
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Version is the protocol version, peers before negotiation are version 0.
+const Version = 1
+
+const (
+	CodecJSON = "json"
+	CodecCBOR = "cbor"
+)
+
+// Codec encodes messages and their payloads on transport.
+type Codec interface {
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(p []byte, v any) error
+}
+
+var codecs = map[string]Codec{}
+
+func init() {
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(cborCodec{})
+}
+
+// RegisterCodec makes codec available for negotiation by its name.
+func RegisterCodec(c Codec) {
+	codecs[c.Name()] = c
+}
+
+func GetCodec(name string) (Codec, bool) {
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// DefaultCodec is used before codec is negotiated, every peer speaks it.
+func DefaultCodec() Codec {
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return CodecJSON
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(p []byte, v any) error {
+	return json.Unmarshal(p, v)
+}
+
+// cborCodec takes json tags of models, so models need no cbor tags.
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return CodecCBOR
+}
+
+func (cborCodec) Marshal(v any) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(p []byte, v any) error {
+	return cbor.Unmarshal(p, v)
+}
+
+var (
+	jsonNull = []byte("null")
+	cborNull = []byte{0xf6}
+)
+
+// RawData is the encoded payload of message, it is embedded as is by both json and cbor codecs.
+type RawData []byte
+
+func (r RawData) MarshalJSON() ([]byte, error) {
+	if len(r) == 0 {
+		return jsonNull, nil
+	}
+	return r, nil
+}
+
+func (r *RawData) UnmarshalJSON(p []byte) error {
+	*r = append((*r)[0:0], p...)
+	return nil
+}
+
+func (r RawData) MarshalCBOR() ([]byte, error) {
+	if len(r) == 0 {
+		return cborNull, nil
+	}
+	return r, nil
+}
+
+func (r *RawData) UnmarshalCBOR(p []byte) error {
+	*r = append((*r)[0:0], p...)
+	return nil
+}
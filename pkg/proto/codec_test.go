@@ -0,0 +1,42 @@
+package proto
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+type routeMessage struct {
+	Name   string `json:"Name,omitempty"`
+	Routes []*net.IPNet
+}
+
+func init() {
+	RegisterMessage(reflect.TypeFor[routeMessage]())
+}
+
+func TestCodec(t *testing.T) {
+	_, n, _ := net.ParseCIDR("10.8.0.0/24")
+	for _, name := range []string{CodecJSON, CodecCBOR} {
+		c, ok := GetCodec(name)
+		if !ok {
+			t.Fatalf("codec %s not registered", name)
+		}
+		resp := NewIdResponse(7, CodeInvalidMessage, "invalid message", &routeMessage{Name: "node1", Routes: []*net.IPNet{n}})
+		p, err := resp.Pack(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := UnpackResponse(c, p)
+		if err != nil {
+			t.Fatalf("%s unpack err, %s", name, err.Error())
+		}
+		m, err := GetResponsePayload[routeMessage](got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Id != 7 || got.Err() == nil || m.Name != "node1" || len(m.Routes) != 1 || m.Routes[0].String() != n.String() {
+			t.Errorf("%s round trip get %+v, %+v", name, got, m)
+		}
+	}
+}
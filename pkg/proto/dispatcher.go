@@ -2,6 +2,9 @@ package proto
 
 import (
 	"fmt"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
 )
 
 type (
@@ -50,3 +53,27 @@ func GetPayload[V any](e Message) (*V, error) {
 	}
 	return result, nil
 }
+
+// OnRequest registers h for the requests of T, requests with invalid payload are dropped.
+func OnRequest[T any](d *Dispatcher[*Request], h func(r *Request, payload *T)) {
+	d.AddHandler(reflect.TypeFor[T]().Name(), func(r *Request) {
+		payload, err := GetPayload[T](r)
+		if err != nil {
+			logrus.Debugf("invalid request %s, %s", r.GetKey(), err.Error())
+			return
+		}
+		h(r, payload)
+	})
+}
+
+// OnResponse registers h for the responses of T, which are pushed or replied to no pending call.
+func OnResponse[T any](d *Dispatcher[*Response], h func(r *Response, payload *T)) {
+	d.AddHandler(reflect.TypeFor[T]().Name(), func(r *Response) {
+		payload, err := GetResponsePayload[T](r)
+		if err != nil {
+			logrus.Debugf("invalid response %s, %s", r.GetKey(), err.Error())
+			return
+		}
+		h(r, payload)
+	})
+}
@@ -0,0 +1,53 @@
+package proto
+
+import "errors"
+
+// Codes of response, negative codes are errors. Codes below -100 are defined by users of proto.
+const (
+	CodeSuccess        = 0
+	CodeUnknown        = -1
+	CodeInvalidMessage = -2
+	CodeTimeout        = -3
+)
+
+var (
+	ErrInvalidMessage = NewError(CodeInvalidMessage, "invalid message")
+	ErrTimeout        = NewError(CodeTimeout, "timeout")
+)
+
+var errTransportClosed = errors.New("transport closed")
+
+// Error is carried by response with negative code.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func NewError(code int, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is matches errors by code, so errors decoded from responses match the defined ones.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// ErrorCode gives the response code of err, errors not wrapping Error are CodeUnknown.
+func ErrorCode(err error) int {
+	if err == nil {
+		return CodeSuccess
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeUnknown
+}
@@ -1,8 +1,6 @@
 package proto
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
 	"reflect"
 	"sync/atomic"
@@ -13,13 +11,17 @@ var messageRegistry = make(map[string]reflect.Type)
 var sequence uint32 = 0
 
 func Next() uint32 {
-	return atomic.AddUint32(&sequence, 1)
+	id := atomic.AddUint32(&sequence, 1)
+	if id == pushID {
+		id = atomic.AddUint32(&sequence, 1)
+	}
+	return id
 }
 
 type Request struct {
-	Key     string
-	Id      uint32
-	DataRaw json.RawMessage `json:"DataRaw,omitempty"`
+	Key     string  `cbor:"1,keyasint"`
+	Id      uint32  `cbor:"2,keyasint"`
+	DataRaw RawData `json:"DataRaw,omitempty" cbor:"3,keyasint,omitempty"`
 
 	data any
 }
@@ -41,21 +43,21 @@ func (req *Request) Payload() any {
 	return req.data
 }
 
-func (req *Request) Pack() (p []byte, err error) {
-	p, err = json.Marshal(req.data)
+func (req *Request) Pack(c Codec) (p []byte, err error) {
+	p, err = c.Marshal(req.data)
 	if err != nil {
 		return nil, err
 	}
 	req.DataRaw = p
-	return json.Marshal(req)
+	return c.Marshal(req)
 }
 
 type Response struct {
-	Key     string
-	Id      uint32
-	Code    int
-	Message string
-	DataRaw json.RawMessage `json:"DataRaw,omitempty"`
+	Key     string  `cbor:"1,keyasint"`
+	Id      uint32  `cbor:"2,keyasint"`
+	Code    int     `cbor:"3,keyasint"`
+	Message string  `cbor:"4,keyasint"`
+	DataRaw RawData `json:"DataRaw,omitempty" cbor:"5,keyasint,omitempty"`
 
 	data any
 }
@@ -79,18 +81,26 @@ func (resp *Response) Payload() any {
 	return resp.data
 }
 
-func (resp *Response) Pack() (p []byte, err error) {
-	p, err = json.Marshal(resp.data)
+// Err gives the error carried by response, it is nil for success.
+func (resp *Response) Err() error {
+	if resp.Code >= 0 {
+		return nil
+	}
+	return NewError(resp.Code, resp.Message)
+}
+
+func (resp *Response) Pack(c Codec) (p []byte, err error) {
+	p, err = c.Marshal(resp.data)
 	if err != nil {
 		return nil, err
 	}
 	resp.DataRaw = p
-	return json.Marshal(resp)
+	return c.Marshal(resp)
 }
 
-func UnpackRequest(p []byte) (req *Request, err error) {
+func UnpackRequest(c Codec, p []byte) (req *Request, err error) {
 	req = &Request{}
-	err = json.Unmarshal(p, req)
+	err = c.Unmarshal(p, req)
 	if err != nil {
 		return nil, err
 	}
@@ -102,13 +112,13 @@ func UnpackRequest(p []byte) (req *Request, err error) {
 		return req, nil
 	}
 	req.data = reflect.New(t).Interface()
-	err = json.Unmarshal(req.DataRaw, req.data)
+	err = c.Unmarshal(req.DataRaw, req.data)
 	return req, err
 }
 
-func UnpackResponse(p []byte) (resp *Response, err error) {
+func UnpackResponse(c Codec, p []byte) (resp *Response, err error) {
 	resp = &Response{}
-	err = json.Unmarshal(p, resp)
+	err = c.Unmarshal(p, resp)
 	if err != nil {
 		return nil, err
 	}
@@ -116,14 +126,14 @@ func UnpackResponse(p []byte) (resp *Response, err error) {
 	if !ok {
 		return nil, fmt.Errorf("invalid message")
 	}
+	if resp.DataRaw == nil {
+		return resp, nil
+	}
 	resp.data = reflect.New(t).Interface()
-	err = json.Unmarshal(resp.DataRaw, resp.data)
+	err = c.Unmarshal(resp.DataRaw, resp.data)
 	if err != nil {
 		return nil, err
 	}
-	if resp.Code < 0 {
-		return resp, errors.New(resp.Message)
-	}
 	return resp, nil
 }
 
@@ -1,17 +1,28 @@
 package proto
 
 import (
+	"bytes"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/token"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
 	"text/template"
 )
 
-const genCodeFileName = "init.gen.go"
+const (
+	genCodeFileName = "init.gen.go"
+	genRPCFileName  = "rpc.gen.go"
+
+	// MessageMarker marks a struct as message in its doc comment, structs named
+	// like XRequest or XResponse are messages without it
+	MessageMarker = "//ptun:message"
+)
 
 func RegisterMessage(t reflect.Type) {
 	if t.Kind() == reflect.Ptr {
@@ -19,6 +30,15 @@ func RegisterMessage(t reflect.Type) {
 	}
 	messageRegistry[t.Name()] = t
 }
+
+type rpcMethod struct {
+	Name     string
+	Request  string
+	Response string
+}
+
+// GenMessageMethod registers the messages of package in dir, and generates the client and
+// handlers of rpc for each XRequest which has a XResponse.
 func GenMessageMethod(dir string) (err error) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -30,53 +50,27 @@ func GenMessageMethod(dir string) (err error) {
 		if entry.IsDir() {
 			continue
 		}
-		if entry.Name() == genCodeFileName {
+		if entry.Name() == genCodeFileName || entry.Name() == genRPCFileName {
 			continue
 		}
-		if filepath.Ext(entry.Name()) == ".go" {
+		if filepath.Ext(entry.Name()) == ".go" && !strings.HasSuffix(entry.Name(), "_test.go") {
 			files = append(files, path.Join(dir, entry.Name()))
 		}
 	}
 
 	fset := token.NewFileSet()
-	out, err := os.OpenFile(path.Join(dir, genCodeFileName), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	tmpl, err := template.New("header").Parse(templateHeader)
-	if err != nil {
-		return err
-	}
-
-	tmplRow, err := template.New("row").Parse(templateRow)
-	if err != nil {
-		return err
-	}
-
-	headerSetted := false
-
+	pkgName := ""
+	messages := make([]string, 0)
 	for _, f := range files {
 		node, err := parser.ParseFile(fset, f, nil, parser.ParseComments)
 		if err != nil {
 			return err
 		}
-		pkgName := node.Name.Name
-		if !headerSetted {
-			headerSetted = true
-			data := struct{ Package string }{
-				Package: pkgName,
-			}
-			err = tmpl.Execute(out, data)
-			if err != nil {
-				return err
-			}
-		}
+		pkgName = node.Name.Name
 
 		for _, decl := range node.Decls {
 			genDecl, ok := decl.(*ast.GenDecl)
-			if !ok {
+			if !ok || genDecl.Tok != token.TYPE {
 				continue
 			}
 			for _, spec := range genDecl.Specs {
@@ -84,23 +78,81 @@ func GenMessageMethod(dir string) (err error) {
 				if !ok {
 					continue
 				}
-				structName := typeSpec.Name.Name
-
-				data := struct{ Name string }{
-					Name: structName,
+				if _, ok := typeSpec.Type.(*ast.StructType); !ok {
+					continue
+				}
+				doc := typeSpec.Doc
+				if doc == nil && len(genDecl.Specs) == 1 {
+					doc = genDecl.Doc
 				}
-				err = tmplRow.Execute(out, data)
-				if err != nil {
-					return err
+				if isMessage(typeSpec.Name.Name, doc) {
+					messages = append(messages, typeSpec.Name.Name)
 				}
 			}
 		}
 	}
 
-	return nil
+	methods := make([]rpcMethod, 0)
+	for _, m := range messages {
+		name, ok := strings.CutSuffix(m, "Request")
+		if ok && slices.Contains(messages, name+"Response") {
+			methods = append(methods, rpcMethod{
+				Name:     name,
+				Request:  m,
+				Response: name + "Response",
+			})
+		}
+	}
+
+	data := struct {
+		Package  string
+		Messages []string
+		Methods  []rpcMethod
+	}{
+		Package:  pkgName,
+		Messages: messages,
+		Methods:  methods,
+	}
+	err = genFile(path.Join(dir, genCodeFileName), templateInit, data)
+	if err != nil {
+		return err
+	}
+	return genFile(path.Join(dir, genRPCFileName), templateRPC, data)
 }
 
-const templateHeader = `// Code generated .* DO NOT EDIT
+func isMessage(name string, doc *ast.CommentGroup) bool {
+	if strings.HasSuffix(name, "Request") || strings.HasSuffix(name, "Response") {
+		return true
+	}
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.TrimSpace(c.Text) == MessageMarker {
+			return true
+		}
+	}
+	return false
+}
+
+func genFile(name string, text string, data any) error {
+	tmpl, err := template.New(filepath.Base(name)).Parse(text)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	err = tmpl.Execute(buf, data)
+	if err != nil {
+		return err
+	}
+	p, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, p, 0644)
+}
+
+const templateInit = `// Code generated .* DO NOT EDIT
 
 package {{.Package}}
 
@@ -109,10 +161,96 @@ import (
 
 	"github.com/withz/ptun/pkg/proto"
 )
-`
-
-const templateRow = `
+{{range .Messages}}
 func init() {
-	proto.RegisterMessage(reflect.TypeFor[{{.Name}}]())
+	proto.RegisterMessage(reflect.TypeFor[{{.}}]())
+}
+{{end}}`
+
+const templateRPC = `// Code generated .* DO NOT EDIT
+
+package {{.Package}}
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/withz/ptun/pkg/proto"
+)
+
+// Client calls the rpc of remote through transport.
+type Client struct {
+	t *proto.Transport
+}
+
+func NewClient(t *proto.Transport) *Client {
+	return &Client{t: t}
+}
+{{range .Methods}}
+// {{.Name}} calls the {{.Request}} of remote. A reply with error code gives both the response and the error.
+func (c *Client) {{.Name}}(ctx context.Context, req *{{.Request}}) (*{{.Response}}, error) {
+	resp, err := c.t.Call(ctx, req)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[{{.Response}}](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// Handle{{.Name}} registers h for the {{.Request}} of remote, the result of h replies the request.
+func Handle{{.Name}}(t *proto.Transport, h func(req *{{.Request}}) (*{{.Response}}, error)) {
+	t.Requester.Dispatcher().AddHandler("{{.Request}}", func(r *proto.Request) {
+		req, err := proto.GetPayload[{{.Request}}](r)
+		if err != nil {
+			t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &{{.Response}}{})
+			return
+		}
+		resp, err := h(req)
+		if resp == nil {
+			resp = &{{.Response}}{}
+		}
+		if err != nil {
+			t.Responser.ReplyError(r, err, resp)
+			return
+		}
+		t.Responser.ReplySuccess(r, resp)
+	})
+}
+
+// Handshake{{.Name}} sends the {{.Request}} and reads the reply within d, for handshakes before the
+// dispatcher runs. A reply with error code gives both the response and the error.
+func (c *Client) Handshake{{.Name}}(req *{{.Request}}, d time.Duration) (*{{.Response}}, error) {
+	err := c.t.Requester.Send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.t.Responser.Read(d)
+	if resp == nil {
+		return nil, err
+	}
+	payload, perr := proto.GetResponsePayload[{{.Response}}](resp)
+	if perr != nil {
+		return nil, perr
+	}
+	return payload, err
+}
+
+// Accept{{.Name}} reads the {{.Request}} of remote within d, for handshakes before the dispatcher
+// runs. The request is given to reply it.
+func Accept{{.Name}}(t *proto.Transport, d time.Duration) (*proto.Request, *{{.Request}}, error) {
+	r, err := t.Requester.Read(d)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := proto.GetPayload[{{.Request}}](r)
+	if err != nil {
+		t.Responser.ReplyError(r, fmt.Errorf("%w, %s", proto.ErrInvalidMessage, err.Error()), &{{.Response}}{})
+		return nil, nil, err
+	}
+	return r, req, nil
 }
-`
+{{end}}`
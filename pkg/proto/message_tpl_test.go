@@ -0,0 +1,59 @@
+package proto
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const genSource = `package model
+
+type PingRequest struct{}
+
+type PingResponse struct{}
+
+// Notice is pushed without request.
+//
+//ptun:message
+type Notice struct{}
+
+type PeerInfo struct{}
+
+type OrphanRequest struct{}
+`
+
+func TestGenMessageMethod(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "model.go"), []byte(genSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenMessageMethod(dir); err != nil {
+		t.Fatal(err)
+	}
+	init, err := os.ReadFile(filepath.Join(dir, genCodeFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"PingRequest", "PingResponse", "Notice", "OrphanRequest"} {
+		if !strings.Contains(string(init), "reflect.TypeFor["+name+"]") {
+			t.Errorf("message %s is not registered", name)
+		}
+	}
+	if strings.Contains(string(init), "PeerInfo") {
+		t.Errorf("non message PeerInfo is registered")
+	}
+	rpc, err := os.ReadFile(filepath.Join(dir, genRPCFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rpc), "func (c *Client) Ping(ctx context.Context, req *PingRequest) (*PingResponse, error)") ||
+		!strings.Contains(string(rpc), "func HandlePing(t *proto.Transport") ||
+		!strings.Contains(string(rpc), "func (c *Client) HandshakePing(req *PingRequest, d time.Duration) (*PingResponse, error)") ||
+		!strings.Contains(string(rpc), "func AcceptPing(t *proto.Transport, d time.Duration)") {
+		t.Errorf("rpc of ping is not generated")
+	}
+	if strings.Contains(string(rpc), "Orphan(") {
+		t.Errorf("rpc of request without response is generated")
+	}
+}
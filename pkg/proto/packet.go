@@ -1,10 +1,9 @@
 package proto
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"io"
 	"sync"
 )
@@ -12,6 +11,18 @@ import (
 const (
 	maxPayloadSize = 8180
 	headerSize     = 4
+
+	// fragmentHeaderSize is the tag, index and count in front of each fragment
+	fragmentHeaderSize = 6
+	maxFragmentSize    = maxPayloadSize - fragmentHeaderSize
+
+	// MaxMessageSize limits the body reassembled from fragments
+	MaxMessageSize = 4 << 20
+)
+
+var (
+	errPacketTooLong   = errors.New("packet is too long")
+	errMalformedPacket = errors.New("malformed packet")
 )
 
 type header struct {
@@ -26,6 +37,8 @@ const (
 	Resp  PacketTag = 13
 	Ping  PacketTag = 14
 	Pong  PacketTag = 15
+	// Frag carries a part of a body longer than one packet, the last part completes it
+	Frag PacketTag = 16
 )
 
 type PacketTag uint16
@@ -43,7 +56,7 @@ func (pkt *Packet) Body() []byte {
 func (pkt *Packet) SetBody(p []byte) error {
 	pkt.body = p
 	if len(p) > maxPayloadSize+headerSize {
-		return fmt.Errorf("packet is too long")
+		return errPacketTooLong
 	}
 	pkt.header.length = uint16(len(p))
 	return nil
@@ -72,7 +85,7 @@ func PackRaw(pt PacketTag, p []byte) (*Packet, error) {
 		body: p,
 	}
 	if len(p) > maxPayloadSize {
-		return nil, fmt.Errorf("packet is too long")
+		return nil, errPacketTooLong
 	}
 	if len(p) > 0 {
 		pkt.header.length = uint16(len(p))
@@ -81,77 +94,138 @@ func PackRaw(pt PacketTag, p []byte) (*Packet, error) {
 	return pkt, nil
 }
 
+// PackInto writes payload to w, each packet is written by one Write. A payload longer than one
+// packet is split into fragments, so writers of w should be serialized.
 func PackInto(pt PacketTag, payload []byte, w io.Writer) error {
-	pkt, err := PackRaw(pt, payload)
-	if err != nil {
-		return err
-	}
-	writer := bufio.NewWriterSize(w, headerSize+maxPayloadSize)
-	payloads := []any{pkt.header.tag, pkt.header.length}
-	for _, payload := range payloads {
-		if err = binary.Write(writer, binary.BigEndian, payload); err != nil {
+	if len(payload) <= maxPayloadSize {
+		return writePacket(pt, payload, w)
+	}
+	if len(payload) > MaxMessageSize {
+		return errPacketTooLong
+	}
+	count := (len(payload) + maxFragmentSize - 1) / maxFragmentSize
+	frag := make([]byte, fragmentHeaderSize+maxFragmentSize)
+	binary.BigEndian.PutUint16(frag, uint16(pt))
+	binary.BigEndian.PutUint16(frag[4:], uint16(count))
+	for i := 0; i < count; i++ {
+		part := payload[i*maxFragmentSize : min((i+1)*maxFragmentSize, len(payload))]
+		binary.BigEndian.PutUint16(frag[2:], uint16(i))
+		n := copy(frag[fragmentHeaderSize:], part)
+		if err := writePacket(Frag, frag[:fragmentHeaderSize+n], w); err != nil {
 			return err
 		}
 	}
-	if pkt.body == nil {
-		return writer.Flush()
-	}
-	if err = binary.Write(writer, binary.BigEndian, pkt.body); err != nil {
+	return nil
+}
+
+func writePacket(pt PacketTag, payload []byte, w io.Writer) error {
+	pkt, err := PackRaw(pt, payload)
+	if err != nil {
 		return err
 	}
-	return writer.Flush()
+	pbuf := bytesPool.Get().(*[]byte)
+	defer bytesPool.Put(pbuf)
+	buf := (*pbuf)[:headerSize+len(pkt.body)]
+	binary.BigEndian.PutUint16(buf, uint16(pkt.header.tag))
+	binary.BigEndian.PutUint16(buf[2:], pkt.header.length)
+	copy(buf[headerSize:], pkt.body)
+	_, err = w.Write(buf)
+	return err
 }
 
+// Unpack reads the packet of a datagram, which holds exactly one packet.
 func Unpack(p []byte) (pkt *Packet, err error) {
-	reader := bytes.NewReader(p)
-	return UnpackFrom(reader)
+	if len(p) < headerSize || len(p) != headerSize+int(binary.BigEndian.Uint16(p[2:])) {
+		return nil, errMalformedPacket
+	}
+	return UnpackFrom(bytes.NewReader(p))
 }
 
+// UnpackFrom reads one packet from a stream, it blocks until the whole packet is read.
 func UnpackFrom(r io.Reader) (pkt *Packet, err error) {
 	pbuf := bytesPool.Get().(*[]byte)
 	buf := *pbuf
-	h := buf[:headerSize]
-	n, err := r.Read(h)
-	if err != nil {
-		return nil, err
-	}
-	if n != headerSize {
-		return nil, fmt.Errorf("malformed packet")
-	}
-	pkt = &Packet{
-		buf: pbuf,
-	}
 	defer func() {
 		if err != nil {
 			bytesPool.Put(pbuf)
 		}
 	}()
-	reader := bytes.NewReader(h)
-	if err = binary.Read(reader, binary.BigEndian, &pkt.header.tag); err != nil {
+	h := buf[:headerSize]
+	_, err = io.ReadFull(r, h)
+	if err != nil {
 		return nil, err
 	}
-	if err = binary.Read(reader, binary.BigEndian, &pkt.header.length); err != nil {
-		return nil, err
+	pkt = &Packet{
+		header: header{
+			tag:    PacketTag(binary.BigEndian.Uint16(h)),
+			length: binary.BigEndian.Uint16(h[2:]),
+		},
+		buf: pbuf,
 	}
 	if pkt.header.length == 0 {
 		return pkt, nil
 	}
 	if pkt.header.length > maxPayloadSize {
-		return nil, fmt.Errorf("malformed packet")
+		return nil, errMalformedPacket
+	}
+	p := buf[headerSize : headerSize+int(pkt.header.length)]
+	_, err = io.ReadFull(r, p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-
-	p := buf[headerSize : headerSize+pkt.header.length]
-	n, err = r.Read(p)
 	if err != nil {
 		return nil, err
 	}
-	if n != int(pkt.header.length) {
-		return nil, fmt.Errorf("malformed packet")
-	}
 	pkt.body = p
 	return pkt, nil
 }
 
+// reassembler joins the fragments of one body, fragments of different bodies never interleave.
+type reassembler struct {
+	tag   PacketTag
+	next  uint16
+	count uint16
+	body  []byte
+}
+
+// add takes a Frag packet and gives the whole packet once its last fragment arrives. A fragment
+// out of order drops the body being joined, which happens when a datagram is lost.
+func (ra *reassembler) add(pkt *Packet) (*Packet, error) {
+	defer pkt.Release()
+	p := pkt.body
+	if len(p) < fragmentHeaderSize {
+		return nil, errMalformedPacket
+	}
+	tag := PacketTag(binary.BigEndian.Uint16(p))
+	index := binary.BigEndian.Uint16(p[2:])
+	count := binary.BigEndian.Uint16(p[4:])
+	if index == 0 {
+		ra.tag, ra.next, ra.count, ra.body = tag, 0, count, nil
+	}
+	if index != ra.next || tag != ra.tag || count != ra.count || index >= count {
+		ra.body = nil
+		ra.next = 0
+		return nil, errMalformedPacket
+	}
+	if len(ra.body)+len(p)-fragmentHeaderSize > MaxMessageSize {
+		ra.body = nil
+		ra.next = 0
+		return nil, errPacketTooLong
+	}
+	ra.body = append(ra.body, p[fragmentHeaderSize:]...)
+	ra.next++
+	if ra.next < ra.count {
+		return nil, nil
+	}
+	whole := &Packet{
+		header: header{tag: ra.tag},
+		body:   ra.body,
+	}
+	ra.body = nil
+	ra.next = 0
+	return whole, nil
+}
+
 var (
 	bytesPool *sync.Pool
 )
@@ -0,0 +1,126 @@
+package proto
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestPacketStream(t *testing.T) {
+	body := bytes.Repeat([]byte("ptun"), 3*maxPayloadSize)
+	buf := &bytes.Buffer{}
+	if err := PackInto(Req, body, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := PackInto(Ping, nil, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// a stream may give any count of bytes in one read
+	r := iotest.OneByteReader(buf)
+	ra := &reassembler{}
+	var pkt *Packet
+	for pkt == nil {
+		p, err := UnpackFrom(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Tag() != Frag {
+			t.Fatalf("want fragment, got tag %d", p.Tag())
+		}
+		pkt, err = ra.add(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pkt.Tag() != Req || !bytes.Equal(pkt.Body(), body) {
+		t.Fatalf("reassembled packet mismatch, tag %d, length %d", pkt.Tag(), len(pkt.Body()))
+	}
+	p, err := UnpackFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Tag() != Ping {
+		t.Fatalf("want ping, got tag %d", p.Tag())
+	}
+}
+
+func TestPacketLostFragment(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := PackInto(Raw, make([]byte, 2*maxPayloadSize), buf); err != nil {
+		t.Fatal(err)
+	}
+	first, err := UnpackFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UnpackFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	last, err := UnpackFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ra := &reassembler{}
+	if _, err = ra.add(first); err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := ra.add(last)
+	if err == nil || pkt != nil {
+		t.Fatalf("want the body dropped, got %v", pkt)
+	}
+}
+
+func TestTransportLargeMessage(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client := NewTransport(c1)
+	server := NewTransport(c2)
+	defer client.Close()
+	defer server.Close()
+
+	want := bytes.Repeat([]byte{0x5a}, 100*1024)
+	go client.Write(want)
+	got := make([]byte, len(want))
+	n, err := server.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:n], want) {
+		t.Fatalf("large message mismatch, length %d", n)
+	}
+}
+
+func TestDatagramTransport(t *testing.T) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.DialUDP("udp", nil, l.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewDatagramTransport(c)
+	defer client.Close()
+
+	go client.Write(bytes.Repeat([]byte{1}, 2*maxPayloadSize))
+	buf := make([]byte, 2*(headerSize+maxPayloadSize))
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 3; i++ {
+		n, _, err := l.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt, err := Unpack(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Tag() != Frag {
+			t.Fatalf("want fragment, got tag %d", pkt.Tag())
+		}
+		pkt.Release()
+	}
+	l.Close()
+}
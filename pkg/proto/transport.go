@@ -2,6 +2,7 @@ package proto
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"net"
@@ -10,11 +11,15 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/withz/ptun/pkg/metrics"
 	"github.com/withz/ptun/pkg/tools"
 )
 
 const maxAliveCount = 5
 
+// pushID is the id of responses pushed without request, ids of requests start from 1.
+const pushID = 0
+
 type requester struct {
 	transport  *Transport
 	recvCh     chan *Packet
@@ -26,21 +31,20 @@ func (r *requester) Send(data any) error {
 }
 
 func (r *requester) Write(req *Request) error {
-	p, err := req.Pack()
+	p, err := req.Pack(r.transport.codec)
 	if err != nil {
 		return err
 	}
-	return PackInto(Req, p, r.transport.conn)
+	return r.transport.write(Req, p)
 }
 
 func (r *requester) Read(d time.Duration) (*Request, error) {
-	select {
-	case p := <-r.recvCh:
-		defer p.Release()
-		return UnpackRequest(p.body)
-	case <-time.After(d):
-		return nil, fmt.Errorf("read request timeout")
+	p, err := receive(r.recvCh, r.transport.done, d)
+	if err != nil {
+		return nil, fmt.Errorf("read request failed, %w", err)
 	}
+	defer p.Release()
+	return UnpackRequest(r.transport.codec, p.body)
 }
 
 func (r *requester) Dispatcher() *Dispatcher[*Request] {
@@ -48,28 +52,25 @@ func (r *requester) Dispatcher() *Dispatcher[*Request] {
 }
 
 func (r *requester) RunDispatcher() {
-	for {
-		p, ok := <-r.recvCh
-		if !ok {
-			return
-		}
-		defer p.Release()
-		req, err := UnpackRequest(p.body)
-		if err != nil {
-			continue
-		}
-		err = r.dispatcher.Dispatch(req)
-		if err != nil {
-			continue
-		}
+	dispatch(r.transport.done, r.recvCh, nil, r.handle, nil)
+}
+
+func (r *requester) handle(p *Packet) {
+	defer p.Release()
+	req, err := UnpackRequest(r.transport.codec, p.body)
+	if err != nil {
+		return
 	}
+	r.dispatcher.Dispatch(req)
 }
 
+// responser sends responses, and receives the replies of pending calls and the pushes of remote.
 type responser struct {
 	transport  *Transport
 	recvCh     chan *Packet
 	dispatcher *Dispatcher[*Response]
-	replyer    map[uint32]chan *Response
+	pending    map[uint32]chan *Response
+	mutex      sync.Mutex
 }
 
 func (r *responser) ReplySuccess(req *Request, data any) error {
@@ -80,8 +81,14 @@ func (r *responser) Reply(req *Request, code int, message string, data any) erro
 	return r.SendWithID(req.Id, code, message, data)
 }
 
+// ReplyError replies req with the code and message of err, data tells which request failed.
+func (r *responser) ReplyError(req *Request, err error, data any) error {
+	return r.SendWithID(req.Id, ErrorCode(err), err.Error(), data)
+}
+
+// SendSuccess pushes data to remote, pushes carry no id so they never match a pending call.
 func (r *responser) SendSuccess(data any) error {
-	return r.SendSuccessWithID(Next(), data)
+	return r.SendSuccessWithID(pushID, data)
 }
 
 func (r *responser) SendSuccessWithID(id uint32, data any) error {
@@ -89,7 +96,7 @@ func (r *responser) SendSuccessWithID(id uint32, data any) error {
 }
 
 func (r *responser) Send(code int, message string, data any) error {
-	return r.SendWithID(Next(), code, message, data)
+	return r.SendWithID(pushID, code, message, data)
 }
 
 func (r *responser) SendWithID(id uint32, code int, message string, data any) error {
@@ -97,24 +104,24 @@ func (r *responser) SendWithID(id uint32, code int, message string, data any) er
 }
 
 func (r *responser) Write(resp *Response) error {
-	p, err := resp.Pack()
+	p, err := resp.Pack(r.transport.codec)
 	if err != nil {
 		return err
 	}
-	return PackInto(Resp, p, r.transport.conn)
+	return r.transport.write(Resp, p)
 }
 
 func (r *responser) Read(d time.Duration) (*Response, error) {
-	select {
-	case p := <-r.recvCh:
-		if p == nil {
-			return nil, fmt.Errorf("read response timeout")
-		}
-		defer p.Release()
-		return UnpackResponse(p.body)
-	case <-time.After(d):
-		return nil, fmt.Errorf("read response timeout")
+	p, err := receive(r.recvCh, r.transport.done, d)
+	if err != nil {
+		return nil, fmt.Errorf("read response %w", err)
 	}
+	defer p.Release()
+	resp, err := UnpackResponse(r.transport.codec, p.body)
+	if err != nil {
+		return nil, err
+	}
+	return resp, resp.Err()
 }
 
 func (r *responser) Dispatcher() *Dispatcher[*Response] {
@@ -122,25 +129,48 @@ func (r *responser) Dispatcher() *Dispatcher[*Response] {
 }
 
 func (r *responser) RunDispatcher() {
-	for {
-		p, ok := <-r.recvCh
-		if !ok {
-			return
-		}
-		defer p.Release()
-		resp, err := UnpackResponse(p.body)
-		if err != nil {
-			continue
-		}
-		if ch, ok := r.replyer[resp.Id]; ok {
-			ch <- resp
-			continue
-		}
-		err = r.dispatcher.Dispatch(resp)
-		if err != nil {
-			continue
-		}
+	dispatch(r.transport.done, nil, r.recvCh, nil, r.handle)
+}
+
+// handle gives the reply of a pending call to its caller, the others are pushes and dispatched by key.
+func (r *responser) handle(p *Packet) {
+	defer p.Release()
+	resp, err := UnpackResponse(r.transport.codec, p.body)
+	if err != nil {
+		return
+	}
+	if r.resolve(resp) {
+		return
 	}
+	r.dispatcher.Dispatch(resp)
+}
+
+func (r *responser) register(id uint32) chan *Response {
+	ch := make(chan *Response, 1)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.pending[id] = ch
+	return ch
+}
+
+func (r *responser) unregister(id uint32) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.pending, id)
+}
+
+func (r *responser) resolve(resp *Response) bool {
+	if resp.Id == pushID {
+		return false
+	}
+	r.mutex.Lock()
+	ch, ok := r.pending[resp.Id]
+	delete(r.pending, resp.Id)
+	r.mutex.Unlock()
+	if ok {
+		ch <- resp
+	}
+	return ok
 }
 
 type Transport struct {
@@ -149,6 +179,11 @@ type Transport struct {
 
 	conn  net.Conn
 	rawCh chan *Packet
+	// stream is false when each read of conn gives one datagram
+	stream     bool
+	writeMutex sync.Mutex
+	// codec is negotiated at login, it must be set before messages are read or dispatched
+	codec Codec
 
 	aliveCount    int64
 	aliveInterval time.Duration
@@ -157,10 +192,23 @@ type Transport struct {
 	done          chan struct{}
 }
 
+// NewTransport makes a transport on a stream conn, such as tcp.
 func NewTransport(c net.Conn) *Transport {
+	return newTransport(c, true)
+}
+
+// NewDatagramTransport makes a transport on a conn keeping message boundary, such as udp, each
+// datagram holds exactly one packet.
+func NewDatagramTransport(c net.Conn) *Transport {
+	return newTransport(c, false)
+}
+
+func newTransport(c net.Conn, stream bool) *Transport {
 	t := &Transport{
 		conn:       c,
+		stream:     stream,
 		rawCh:      make(chan *Packet, 100),
+		codec:      DefaultCodec(),
 		aliveCount: maxAliveCount,
 		done:       make(chan struct{}),
 	}
@@ -173,12 +221,21 @@ func NewTransport(c net.Conn) *Transport {
 		transport:  t,
 		recvCh:     make(chan *Packet, 10),
 		dispatcher: NewDispatcher[*Response](),
-		replyer:    map[uint32]chan *Response{},
+		pending:    map[uint32]chan *Response{},
 	}
 	go t.readloop()
 	return t
 }
 
+// SetCodec changes the codec of messages, both sides should change it at the same message.
+func (t *Transport) SetCodec(c Codec) {
+	t.codec = c
+}
+
+func (t *Transport) Codec() Codec {
+	return t.codec
+}
+
 func (t *Transport) SetKeepalive(v time.Duration) {
 	if v == t.aliveInterval {
 		return
@@ -206,89 +263,111 @@ func (t *Transport) SetKeepalive(v time.Duration) {
 	go func(interupter chan struct{}) {
 		for !isDone(t.aliveInterval/time.Duration(maxAliveCount), interupter) {
 			atomic.AddInt64(&t.aliveCount, -1)
-			PackInto(Ping, nil, t.conn)
+			t.write(Ping, nil)
 			time.Sleep(1 * time.Second)
 		}
 	}(t.aliveInterupt)
 	go func(interupter chan struct{}) {
 		for !isDone(1*time.Second, interupter) {
-			if t.aliveCount < 0 {
+			if atomic.LoadInt64(&t.aliveCount) < 0 {
+				metrics.KeepaliveTimeouts.Inc()
 				_ = t.Close()
+				return
 			}
 		}
 	}(t.aliveInterupt)
 }
 
-func (t *Transport) SendMessage(data any, timeout time.Duration) (*Response, error) {
+// Call sends data as a request and waits for the reply of remote until ctx is done, the reply
+// is matched by the request id. A reply with negative code is returned with its error.
+func (t *Transport) Call(ctx context.Context, data any) (*Response, error) {
 	req := NewRequest(data)
+	ch := t.Responser.register(req.Id)
+	defer t.Responser.unregister(req.Id)
 	err := t.Requester.Write(req)
 	if err != nil {
 		return nil, err
 	}
-	respCh := make(chan *Response)
-	t.Responser.replyer[req.Id] = respCh
-	defer func() {
-		delete(t.Responser.replyer, req.Id)
-		close(respCh)
-	}()
+	start := time.Now()
 	select {
-	case resp, ok := <-t.Responser.replyer[req.Id]:
-		if !ok {
-			return nil, fmt.Errorf("send message timeout")
+	case resp := <-ch:
+		metrics.RequestDuration.WithLabelValues(req.Key).Observe(time.Since(start).Seconds())
+		return resp, resp.Err()
+	case <-t.done:
+		return nil, fmt.Errorf("call %s failed, transport closed", req.Key)
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("call %s %w", req.Key, ErrTimeout)
 		}
-		return resp, nil
-	case <-time.After(timeout):
-		return nil, fmt.Errorf("send message timeout")
+		return nil, ctx.Err()
 	}
 }
 
+// SendMessage is Call with a timeout.
+func (t *Transport) SendMessage(data any, timeout time.Duration) (*Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return t.Call(ctx, data)
+}
+
 func (t *Transport) RunDispatcher() {
+	dispatch(t.done, t.Requester.recvCh, t.Responser.recvCh, t.Requester.handle, t.Responser.handle)
+	logrus.Debugf("transport dispatcher exit")
+}
+
+// dispatch handles the packets of reqCh and respCh until done, the packets read before done are
+// still handled. A nil channel is never read.
+func dispatch(done chan struct{}, reqCh chan *Packet, respCh chan *Packet, onReq func(*Packet), onResp func(*Packet)) {
 	for {
 		select {
-		case p, ok := <-t.Requester.recvCh:
-			if !ok {
-				logrus.Debugf("request dispatcher exit")
-				return
-			}
-			defer p.Release()
-			req, err := UnpackRequest(p.body)
-			if err != nil {
-				continue
-			}
-			err = t.Requester.dispatcher.Dispatch(req)
-			if err != nil {
-				continue
-			}
-		case p, ok := <-t.Responser.recvCh:
-			if !ok {
-				logrus.Debugf("response dispatcher exit")
-				return
-			}
-			defer p.Release()
-			resp, err := UnpackResponse(p.body)
-			if err != nil {
-				continue
-			}
-			if ch, ok := t.Responser.replyer[resp.Id]; ok {
-				ch <- resp
-				continue
-			}
-			err = t.Responser.dispatcher.Dispatch(resp)
-			if err != nil {
-				continue
+		case p := <-reqCh:
+			onReq(p)
+		case p := <-respCh:
+			onResp(p)
+		case <-done:
+			for {
+				select {
+				case p := <-reqCh:
+					onReq(p)
+				case p := <-respCh:
+					onResp(p)
+				default:
+					return
+				}
 			}
 		}
 	}
 }
 
+// receive waits for a packet of ch for d, a packet read before done is still given.
+func receive(ch chan *Packet, done chan struct{}, d time.Duration) (*Packet, error) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case p := <-ch:
+		return p, nil
+	case <-done:
+		select {
+		case p := <-ch:
+			return p, nil
+		default:
+			return nil, errTransportClosed
+		}
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
 func (t *Transport) readloop() {
 	defer func() {
 		logrus.Debugf("transport readloop exit")
 	}()
-	reader := bufio.NewReader(t.conn)
+	read := t.packetReader()
+	ra := &reassembler{}
 	for {
-		pkt, err := UnpackFrom(reader)
-		if err == io.EOF || tools.IsNetError(err) {
+		pkt, err := read()
+		// a stream cannot find the next packet after a broken one
+		if err == io.EOF || tools.IsNetError(err) || (err != nil && t.stream) {
 			logrus.Debugf("transport readloop err, %s", err.Error())
 			t.Close()
 			return
@@ -296,6 +375,15 @@ func (t *Transport) readloop() {
 		if err != nil {
 			continue
 		}
+		if pkt.Tag() == Frag {
+			pkt, err = ra.add(pkt)
+			if err != nil {
+				logrus.Debugf("transport drop fragment, %s", err.Error())
+			}
+			if pkt == nil {
+				continue
+			}
+		}
 		atomic.StoreInt64(&t.aliveCount, maxAliveCount)
 		select {
 		case <-t.done:
@@ -328,20 +416,48 @@ func (t *Transport) readloop() {
 			case t.Responser.recvCh <- pkt:
 			}
 		case Ping:
-			PackInto(Pong, nil, t.conn)
+			t.write(Pong, nil)
 		case Pong:
 		}
 	}
 }
 
+// packetReader reads whole packets, a stream is read until the packet is full and a datagram
+// is read at once.
+func (t *Transport) packetReader() func() (*Packet, error) {
+	if t.stream {
+		reader := bufio.NewReader(t.conn)
+		return func() (*Packet, error) {
+			return UnpackFrom(reader)
+		}
+	}
+	buf := make([]byte, headerSize+maxPayloadSize)
+	return func() (*Packet, error) {
+		n, err := t.conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return Unpack(buf[:n])
+	}
+}
+
+// write packs p into conn, fragments of p are not mixed with other packets.
+func (t *Transport) write(pt PacketTag, p []byte) error {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	return PackInto(pt, p, t.conn)
+}
+
 func (t *Transport) Done() <-chan struct{} {
 	return t.done
 }
 
 func (t *Transport) Read(b []byte) (n int, err error) {
-	p, ok := <-t.rawCh
-	if !ok {
-		return 0, fmt.Errorf("transport read err, channel closed")
+	var p *Packet
+	select {
+	case p = <-t.rawCh:
+	case <-t.done:
+		return 0, fmt.Errorf("transport read err, %w", errTransportClosed)
 	}
 	defer p.Release()
 	if len(b) < len(p.body) {
@@ -352,7 +468,7 @@ func (t *Transport) Read(b []byte) (n int, err error) {
 }
 
 func (t *Transport) Write(b []byte) (n int, err error) {
-	err = PackInto(Raw, b, t.conn)
+	err = t.write(Raw, b)
 	if err != nil {
 		err = fmt.Errorf("transport write err, %w", err)
 	}
@@ -360,11 +476,9 @@ func (t *Transport) Write(b []byte) (n int, err error) {
 }
 
 func (t *Transport) Close() error {
+	// the receive channels are never closed, readloop may still be sending to them
 	t.closeOnce.Do(func() {
 		close(t.done)
-		close(t.rawCh)
-		close(t.Requester.recvCh)
-		close(t.Responser.recvCh)
 	})
 	return t.conn.Close()
 }